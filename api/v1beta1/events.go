@@ -0,0 +1,45 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+// Event reasons emitted by the controller.
+// They are part of the API and do not change between releases.
+// Warning events about a TCPIngressMapping use the reason of the Ready condition set at the same time,
+// e.g. BackendServiceNotFound or FieldManagerConflict.
+const (
+	// PortChangedEventReason is emitted once a port has been elected, re-issued, adopted or released.
+	// The event is annotated with PortAnnotation and PortChangeReasonAnnotation.
+	PortChangedEventReason = "PortChanged"
+
+	// DryRunEventReason is emitted with the changes planned in dry-run mode
+	DryRunEventReason = DryRunReason
+
+	// FailedCreateMappingEventReason is emitted on an annotated service if a TCPIngressMapping can not be created or updated
+	FailedCreateMappingEventReason = "FailedCreateMapping"
+
+	// FailedDeleteMappingEventReason is emitted on an annotated service if a TCPIngressMapping can not be removed
+	FailedDeleteMappingEventReason = "FailedDeleteMapping"
+)
+
+// Annotations of PortChanged events
+const (
+	// PortAnnotation holds the elected or released port
+	PortAnnotation = "tcpmap.infra.doodle.com/port"
+
+	// PortChangeReasonAnnotation holds the PortChangeReason
+	PortChangeReasonAnnotation = "tcpmap.infra.doodle.com/port-change-reason"
+)
@@ -32,6 +32,188 @@ type TCPIngressMappingSpec struct {
 
 	// +optional
 	TCPConfigMap *TCPConfigMap `json:"tcpConfigMap,omitempty"`
+
+	// TLS configures how TLS is handled at the frontend
+	// +optional
+	TLS *TLS `json:"tls,omitempty"`
+
+	// Limits restricts the connections accepted at the frontend
+	// +optional
+	Limits *Limits `json:"limits,omitempty"`
+
+	// ProxyProtocol configures the PROXY protocol towards the frontend and the backend
+	// +optional
+	ProxyProtocol *ProxyProtocol `json:"proxyProtocol,omitempty"`
+
+	// Probe configures how the published port is probed if probing is enabled
+	// +optional
+	Probe *Probe `json:"probe,omitempty"`
+
+	// Suspend withdraws the mapping from the frontend while its elected port stays reserved
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+
+	// Schedule publishes the mapping during its active windows only, it is suspended outside of them
+	// +optional
+	Schedule *Schedule `json:"schedule,omitempty"`
+
+	// TTL expires the mapping the given duration after its creation
+	// +optional
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+
+	// ExpiresAt expires the mapping at the given time. If ttl is set as well the earlier of both applies.
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// ExpiryPolicy defines what happens once the mapping is expired, defaults to Unpublish.
+	// Delete is unsupported for mappings controlled by another object, e.g. the mappings of annotated services.
+	// +optional
+	ExpiryPolicy ExpiryPolicy `json:"expiryPolicy,omitempty"`
+
+	// WriteConnectionTo writes the connection details (host, port, protocol and TLS CA) of the published endpoint
+	// to a secret or configmap in the namespace of the mapping
+	// +optional
+	WriteConnectionTo *ConnectionTarget `json:"writeConnectionTo,omitempty"`
+}
+
+type Probe struct {
+	// Banner is the expected prefix of the data sent by the backend once connected.
+	// Defaults to the banner configured at the controller, an empty banner is not verified.
+	// +optional
+	Banner *string `json:"banner,omitempty"`
+}
+
+// ConnectionTargetKind is the kind of object the connection details are written to
+// +kubebuilder:validation:Enum=Secret;ConfigMap
+type ConnectionTargetKind string
+
+const (
+	ConnectionTargetSecret    ConnectionTargetKind = "Secret"
+	ConnectionTargetConfigMap ConnectionTargetKind = "ConfigMap"
+)
+
+type ConnectionTarget struct {
+	// Kind of the object, defaults to Secret
+	// +kubebuilder:default=Secret
+	// +optional
+	Kind ConnectionTargetKind `json:"kind,omitempty"`
+
+	// Name of the object which is created and owned by the mapping
+	// +required
+	Name string `json:"name"`
+}
+
+// ExpiryPolicy defines what happens to an expired mapping
+// +kubebuilder:validation:Enum=Unpublish;Delete
+type ExpiryPolicy string
+
+const (
+	// ExpiryUnpublish withdraws the mapping from the frontend and releases its port, the mapping itself is kept
+	ExpiryUnpublish ExpiryPolicy = "Unpublish"
+	// ExpiryDelete deletes the mapping
+	ExpiryDelete ExpiryPolicy = "Delete"
+)
+
+type Schedule struct {
+	// Windows during which the mapping is active
+	// +kubebuilder:validation:MinItems=1
+	// +required
+	Windows []ActiveWindow `json:"windows"`
+
+	// TimeZone of the cron expressions as IANA name (e.g. Europe/Zurich), defaults to UTC
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+type ActiveWindow struct {
+	// Start opens the window, a cron expression in the format minute hour day-of-month month day-of-week
+	// +required
+	Start string `json:"start"`
+
+	// Duration the window stays open
+	// +required
+	Duration metav1.Duration `json:"duration"`
+}
+
+// ProxyProtocolVersion is the version of the PROXY protocol header
+// +kubebuilder:validation:Enum=v1;v2
+type ProxyProtocolVersion string
+
+const (
+	// ProxyProtocolV1 is the human readable header
+	ProxyProtocolV1 ProxyProtocolVersion = "v1"
+	// ProxyProtocolV2 is the binary header
+	ProxyProtocolV2 ProxyProtocolVersion = "v2"
+)
+
+type ProxyProtocol struct {
+	// Version of the header sent to the backend, defaults to v1.
+	// Headers received from downstream are accepted in both versions.
+	// +optional
+	Version ProxyProtocolVersion `json:"version,omitempty"`
+
+	// Downstream expects a PROXY protocol header from the clients of the frontend, usually a load balancer.
+	// Defaults to the behaviour of the provider: ingress-nginx expects a header, envoy and tcpmap-proxy do not.
+	// +optional
+	Downstream *bool `json:"downstream,omitempty"`
+
+	// Upstream sends a PROXY protocol header to the backend
+	// +optional
+	Upstream bool `json:"upstream,omitempty"`
+}
+
+type Limits struct {
+	// MaxConnections limits the concurrent connections of a single client address
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxConnections int32 `json:"maxConnections,omitempty"`
+
+	// ConnectionRate limits the new connections per second of a single client address
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	ConnectionRate int32 `json:"connectionRate,omitempty"`
+
+	// ConnectTimeout is the timeout for establishing a connection to the backend
+	// +optional
+	ConnectTimeout *metav1.Duration `json:"connectTimeout,omitempty"`
+
+	// IdleTimeout closes connections without any data transferred in either direction for the given duration
+	// +optional
+	IdleTimeout *metav1.Duration `json:"idleTimeout,omitempty"`
+}
+
+// TLSMode defines how TLS is handled at the frontend
+// +kubebuilder:validation:Enum=Terminate;Passthrough
+type TLSMode string
+
+const (
+	// TLSTerminate terminates TLS at the frontend and forwards plain TCP to the backend
+	TLSTerminate TLSMode = "Terminate"
+	// TLSPassthrough forwards TLS connections to the backend as they are
+	TLSPassthrough TLSMode = "Passthrough"
+)
+
+type TLS struct {
+	// Mode defaults to Terminate
+	// +kubebuilder:default=Terminate
+	// +optional
+	Mode TLSMode `json:"mode,omitempty"`
+
+	// SecretRef references a secret of type kubernetes.io/tls in the namespace of the mapping.
+	// Required to terminate TLS.
+	// +optional
+	SecretRef *LocalObjectReference `json:"secretRef,omitempty"`
+
+	// Hostname routes connections by the server name indication (SNI) of the TLS client hello.
+	// All mappings of a frontend service with a hostname share a single port. Requires the Passthrough mode.
+	// Wildcards in the format *.example.com are supported.
+	// +optional
+	Hostname string `json:"hostname,omitempty"`
+}
+
+type LocalObjectReference struct {
+	// +required
+	Name string `json:"name"`
 }
 
 type TCPConfigMap struct {
@@ -43,14 +225,79 @@ type TCPConfigMap struct {
 }
 
 type BackendService struct {
+	// Name of the backend service, required unless an external backend is specified
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Port of the backend service, required unless an external backend is specified
+	// +optional
+	Port intstr.IntOrString `json:"port,omitempty"`
+
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// KubeConfig references a kubeconfig of a remote cluster the backend service lives in.
+	// The endpoints of the remote service are mirrored into a selector-less service in the namespace
+	// of the mapping which is then registered as backend.
+	// +optional
+	KubeConfig *KubeConfig `json:"kubeConfig,omitempty"`
+
+	// External is a backend outside of the cluster, e.g. a managed database or a virtual machine.
+	// The controller creates a service in the namespace of the mapping pointing to it which is then registered as backend.
+	// Name and port of the backend service are ignored.
+	// +optional
+	External *ExternalBackend `json:"external,omitempty"`
+
+	// Weighted splits the connections between multiple backend services, e.g. to shift traffic gradually.
+	// The controller creates a service in the namespace of the mapping aggregating their endpoints which is then registered as backend.
+	// Name and port of the backend service are ignored.
+	// +optional
+	Weighted []WeightedBackend `json:"weighted,omitempty"`
+}
+
+type WeightedBackend struct {
+	// Name of the backend service
 	// +required
 	Name string `json:"name"`
 
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// Port of the backend service
 	// +required
 	Port intstr.IntOrString `json:"port"`
 
+	// Weight of the backend relative to the other backends, defaults to 1.
+	// A backend with a weight of 0 receives no new connections.
+	// +kubebuilder:validation:Minimum=0
 	// +optional
-	Namespace string `json:"namespace,omitempty"`
+	Weight *int32 `json:"weight,omitempty"`
+}
+
+type ExternalBackend struct {
+	// Host is the DNS name or IP address of the backend
+	// +required
+	Host string `json:"host"`
+
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +required
+	Port int32 `json:"port"`
+}
+
+type KubeConfig struct {
+	// SecretRef references a secret in the namespace of the mapping holding the kubeconfig
+	// +required
+	SecretRef SecretKeyReference `json:"secretRef"`
+}
+
+type SecretKeyReference struct {
+	// +required
+	Name string `json:"name"`
+
+	// Key of the secret holding the kubeconfig, defaults to value or value.yaml
+	// +optional
+	Key string `json:"key,omitempty"`
 }
 
 type FrontendService struct {
@@ -75,10 +322,87 @@ type TCPIngressMappingStatus struct {
 
 	// +optional
 	ElectedPort int32 `json:"electedPort,omitempty"`
+
+	// ReadyEndpoints is the number of ready endpoints of the backend service port
+	// +optional
+	ReadyEndpoints int32 `json:"readyEndpoints,omitempty"`
+
+	// PlannedChanges lists the changes to the frontend service and tcp configmap
+	// which would have been applied if the controller was not running in dry-run mode
+	// +optional
+	PlannedChanges []string `json:"plannedChanges,omitempty"`
+
+	// PortHistory records the latest changes of the elected port, the most recent one last.
+	// At most MaxPortHistory entries are kept.
+	// +optional
+	PortHistory []PortHistoryEntry `json:"portHistory,omitempty"`
+
+	// Backends reports the current weights of weighted backends
+	// +optional
+	Backends []BackendStatus `json:"backends,omitempty"`
+
+	// ExpiresAt is the time the mapping expires derived from ttl and expiresAt
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// Connection is the secret or configmap the connection details have been written to
+	// +optional
+	Connection *ConnectionTarget `json:"connection,omitempty"`
+}
+
+type BackendStatus struct {
+	// Name of the backend service as namespace/name
+	Name string `json:"name"`
+
+	// Weight is the configured weight
+	Weight int32 `json:"weight"`
+
+	// ReadyEndpoints is the number of ready endpoints of the backend service port
+	ReadyEndpoints int32 `json:"readyEndpoints"`
+
+	// Percent is the share of new connections currently routed to the backend
+	Percent int32 `json:"percent"`
+}
+
+// PortChangeReason is the reason of a port change
+// +kubebuilder:validation:Enum=Elected;Reissued;Released;Adopted
+type PortChangeReason string
+
+const (
+	// PortElected is recorded once a new port has been elected and registered
+	PortElected PortChangeReason = "Elected"
+	// PortReissued is recorded once a port held down for the mapping has been re-issued
+	PortReissued PortChangeReason = "Reissued"
+	// PortReleased is recorded once the port has been released while the mapping is deleted
+	PortReleased PortChangeReason = "Released"
+	// PortAdopted is recorded once a port still registered for the mapping has been adopted after the status was lost
+	PortAdopted PortChangeReason = "Adopted"
+)
+
+// MaxPortHistory is the maximum number of entries in the port history
+const MaxPortHistory = 10
+
+// PortHistoryEntry is a change of the elected port
+type PortHistoryEntry struct {
+	// Port is the elected or released port
+	Port int32 `json:"port"`
+
+	// Reason of the change
+	Reason PortChangeReason `json:"reason"`
+
+	// Message is a human readable description of the change
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// Time of the change
+	Time metav1.Time `json:"time"`
 }
 
 const (
 	ReadyCondition                    = "Ready"
+	BackendAvailableCondition         = "BackendAvailable"
+	ReachableCondition                = "Reachable"
+	SuspendedCondition                = "Suspended"
 	FrontendServiceNotFoundReason     = "FrontendServiceNotFound"
 	BackendServiceNotFoundReason      = "BackendServiceNotFound"
 	TCPConfigMapNotFoundReason        = "TCPConfigMapNotFound"
@@ -87,6 +411,32 @@ const (
 	BackendPortNotFoundReason         = "BackendPortNotFound"
 	NoPortElectedReason               = "NoPortElected"
 	PortReadyReason                   = "PortReady"
+	EndpointsReadyReason              = "EndpointsReady"
+	NoReadyEndpointsReason            = "NoReadyEndpoints"
+	BackendUnavailableReason          = "BackendUnavailable"
+	ProbeSucceededReason              = "ProbeSucceeded"
+	ProbeFailedReason                 = "ProbeFailed"
+	DryRunReason                      = "DryRun"
+	FieldManagerConflictReason        = "FieldManagerConflict"
+	ShardMismatchReason               = "ShardMismatch"
+	RemoteBackendFailedReason         = "RemoteBackendFailed"
+	ExternalBackendFailedReason       = "ExternalBackendFailed"
+	TLSUnsupportedReason              = "TLSUnsupported"
+	TLSSecretNotFoundReason           = "TLSSecretNotFound"
+	SNIHostnameConflictReason         = "SNIHostnameConflict"
+	LimitsUnsupportedReason           = "LimitsUnsupported"
+	ProxyProtocolUnsupportedReason    = "ProxyProtocolUnsupported"
+	WeightedBackendFailedReason       = "WeightedBackendFailed"
+	SnippetPendingReason              = "SnippetPending"
+	SuspendedReason                   = "Suspended"
+	OutsideScheduleReason             = "OutsideSchedule"
+	ResumedReason                     = "Resumed"
+	InvalidScheduleReason             = "InvalidSchedule"
+	ExpiringReason                    = "Expiring"
+	ExpiredReason                     = "Expired"
+	ExpiryPolicyUnsupportedReason     = "ExpiryPolicyUnsupported"
+	ConnectionWriteFailedReason       = "ConnectionWriteFailed"
+	ConnectionPendingReason           = "ConnectionPending"
 )
 
 // ConditionalResource is a resource with conditions
@@ -121,6 +471,58 @@ func TCPIngressMappingReady(clone TCPIngressMapping, reason, message string) TCP
 	return clone
 }
 
+// TCPIngressMappingBackendAvailable
+func TCPIngressMappingBackendAvailable(clone TCPIngressMapping, reason, message string) TCPIngressMapping {
+	setResourceCondition(&clone, BackendAvailableCondition, metav1.ConditionTrue, reason, message)
+	return clone
+}
+
+// TCPIngressMappingBackendUnavailable
+func TCPIngressMappingBackendUnavailable(clone TCPIngressMapping, reason, message string) TCPIngressMapping {
+	setResourceCondition(&clone, BackendAvailableCondition, metav1.ConditionFalse, reason, message)
+	return clone
+}
+
+// TCPIngressMappingReachable
+func TCPIngressMappingReachable(clone TCPIngressMapping, reason, message string) TCPIngressMapping {
+	setResourceCondition(&clone, ReachableCondition, metav1.ConditionTrue, reason, message)
+	return clone
+}
+
+// TCPIngressMappingUnreachable
+func TCPIngressMappingUnreachable(clone TCPIngressMapping, reason, message string) TCPIngressMapping {
+	setResourceCondition(&clone, ReachableCondition, metav1.ConditionFalse, reason, message)
+	return clone
+}
+
+// TCPIngressMappingSuspended
+func TCPIngressMappingSuspended(clone TCPIngressMapping, reason, message string) TCPIngressMapping {
+	setResourceCondition(&clone, SuspendedCondition, metav1.ConditionTrue, reason, message)
+	return clone
+}
+
+// TCPIngressMappingResumed
+func TCPIngressMappingResumed(clone TCPIngressMapping, reason, message string) TCPIngressMapping {
+	setResourceCondition(&clone, SuspendedCondition, metav1.ConditionFalse, reason, message)
+	return clone
+}
+
+// TCPIngressMappingPortChanged records a port change in the port history
+func TCPIngressMappingPortChanged(clone TCPIngressMapping, port int32, reason PortChangeReason, message string) TCPIngressMapping {
+	clone.Status.PortHistory = append(clone.Status.PortHistory, PortHistoryEntry{
+		Port:    port,
+		Reason:  reason,
+		Message: message,
+		Time:    metav1.Now(),
+	})
+
+	if len(clone.Status.PortHistory) > MaxPortHistory {
+		clone.Status.PortHistory = clone.Status.PortHistory[len(clone.Status.PortHistory)-MaxPortHistory:]
+	}
+
+	return clone
+}
+
 // GetStatusConditions returns a pointer to the Status.Conditions slice
 func (in *TCPIngressMapping) GetStatusConditions() *[]metav1.Condition {
 	return &in.Status.Conditions
@@ -132,6 +534,9 @@ func (in *TCPIngressMapping) GetStatusConditions() *[]metav1.Condition {
 // +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status",description=""
 // +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].message",description=""
 // +kubebuilder:printcolumn:name="Port",type="integer",JSONPath=".status.electedPort",description=""
+// +kubebuilder:printcolumn:name="Endpoints",type="integer",JSONPath=".status.readyEndpoints",description="",priority=1
+// +kubebuilder:printcolumn:name="Suspended",type="string",JSONPath=".status.conditions[?(@.type==\"Suspended\")].status",description="",priority=1
+// +kubebuilder:printcolumn:name="Expires",type="date",JSONPath=".status.expiresAt",description="",priority=1
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description=""
 
 // TCPIngressMapping is the Schema for the TCPIngressMappings API
@@ -0,0 +1,249 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+var errInconsistent = errors.New("mapping is inconsistent")
+
+// doctor collects the results of the checks of a mapping
+type doctor struct {
+	o      *options
+	failed bool
+}
+
+func (d *doctor) ok(format string, args ...interface{}) {
+	fmt.Fprintf(d.o.out, "[ok]   %s\n", fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) fail(format string, args ...interface{}) {
+	d.failed = true
+	fmt.Fprintf(d.o.out, "[fail] %s\n", fmt.Sprintf(format, args...))
+}
+
+func newDoctorCmd(o *options) *cobra.Command {
+	return &cobra.Command{
+		Use:   "doctor <mapping>",
+		Short: "Cross-check a TCPIngressMapping against the tcp configmap, frontend service and backend",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tcpmap := infrav1beta1.TCPIngressMapping{}
+			if err := o.client.Get(cmd.Context(), client.ObjectKey{Namespace: o.namespace, Name: args[0]}, &tcpmap); err != nil {
+				return err
+			}
+
+			d := &doctor{o: o}
+			d.check(cmd.Context(), tcpmap)
+
+			if d.failed {
+				return errInconsistent
+			}
+
+			return nil
+		},
+	}
+}
+
+func (d *doctor) check(ctx context.Context, tcpmap infrav1beta1.TCPIngressMapping) {
+	if cond := apimeta.FindStatusCondition(tcpmap.Status.Conditions, infrav1beta1.ReadyCondition); cond == nil {
+		d.fail("mapping has no Ready condition")
+	} else if cond.Status != "True" {
+		d.fail("mapping is not ready: %s: %s", cond.Reason, cond.Message)
+	} else {
+		d.ok("mapping is ready")
+	}
+
+	backendPort, hasBackendPort := d.checkBackend(ctx, tcpmap)
+	if tcpmap.Status.ElectedPort == 0 {
+		d.fail("mapping has no elected port")
+		return
+	}
+
+	switch {
+	case tcpservices.RoutesBySNI(tcpmap):
+		d.ok("port %d is routed by SNI using a stream snippet, no tcp configmap entry expected", tcpmap.Status.ElectedPort)
+	case tcpservices.ServedBySnippet(tcpmap):
+		d.ok("port %d is served by a stream snippet, no tcp configmap entry expected", tcpmap.Status.ElectedPort)
+	default:
+		d.checkConfigMap(ctx, tcpmap, backendPort, hasBackendPort)
+	}
+
+	d.checkFrontend(ctx, tcpmap)
+}
+
+// checkBackend verifies the backend service, port and endpoints and returns the resolved backend port
+func (d *doctor) checkBackend(ctx context.Context, tcpmap infrav1beta1.TCPIngressMapping) (v1.ServicePort, bool) {
+	key := tcpservices.BackendServiceKey(tcpmap)
+	svc := v1.Service{}
+	if err := d.o.client.Get(ctx, key, &svc); err != nil {
+		d.fail("backend service %s: %s", key, err)
+		return v1.ServicePort{}, false
+	}
+
+	d.ok("backend service %s exists", key)
+
+	backendPort := tcpservices.BackendPort(tcpmap)
+	port, ok := findBackendPort(svc, backendPort)
+	if !ok {
+		d.fail("backend service %s has no port %s", key, backendPort.String())
+		return port, false
+	}
+
+	d.ok("backend service %s has port %s (%d)", key, backendPort.String(), port.Port)
+
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		d.ok("backend service %s points to external name %s", key, svc.Spec.ExternalName)
+		return port, true
+	}
+
+	var slices discoveryv1.EndpointSliceList
+	if err := d.o.client.List(ctx, &slices, client.InNamespace(key.Namespace), client.MatchingLabels{
+		discoveryv1.LabelServiceName: key.Name,
+	}); err != nil {
+		d.fail("failed to list endpoints of backend service %s: %s", key, err)
+		return port, true
+	}
+
+	ready := 0
+	for _, slice := range slices.Items {
+		for _, p := range slice.Ports {
+			if p.Name == nil || *p.Name != port.Name {
+				continue
+			}
+
+			for _, endpoint := range slice.Endpoints {
+				if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+					ready++
+				}
+			}
+		}
+	}
+
+	if ready == 0 {
+		d.fail("backend service %s has no ready endpoints for port %d", key, port.Port)
+	} else {
+		d.ok("backend service %s has %d ready endpoints for port %d", key, ready, port.Port)
+	}
+
+	return port, true
+}
+
+func (d *doctor) checkConfigMap(ctx context.Context, tcpmap infrav1beta1.TCPIngressMapping, backendPort v1.ServicePort, hasBackendPort bool) {
+	key, err := d.o.tcpConfigMapKey(tcpmap)
+	if err != nil {
+		d.fail("%s", err)
+		return
+	}
+
+	cm := v1.ConfigMap{}
+	if err := d.o.client.Get(ctx, key, &cm); err != nil {
+		d.fail("tcp configmap %s: %s", key, err)
+		return
+	}
+
+	port := strconv.Itoa(int(tcpmap.Status.ElectedPort))
+	value, ok := cm.Data[port]
+	if !ok {
+		d.fail("tcp configmap %s has no entry for port %s", key, port)
+		return
+	}
+
+	entry, err := tcpservices.ParseEntry(value)
+	if err != nil {
+		d.fail("tcp configmap %s entry %s: %s", key, port, err)
+		return
+	}
+
+	backend := tcpservices.BackendServiceKey(tcpmap)
+	if entry.Backend() != backend.String() {
+		d.fail("tcp configmap %s entry %s points to %s instead of %s", key, port, entry.Backend(), backend)
+		return
+	}
+
+	if hasBackendPort && entry.Port != strconv.Itoa(int(backendPort.Port)) {
+		d.fail("tcp configmap %s entry %s points to port %s instead of %d", key, port, entry.Port, backendPort.Port)
+		return
+	}
+
+	d.ok("tcp configmap %s entry %s=%s", key, port, value)
+}
+
+func (d *doctor) checkFrontend(ctx context.Context, tcpmap infrav1beta1.TCPIngressMapping) {
+	key, err := d.o.frontendServiceKey(tcpmap)
+	if err != nil {
+		d.fail("%s", err)
+		return
+	}
+
+	svc := v1.Service{}
+	if err := d.o.client.Get(ctx, key, &svc); err != nil {
+		d.fail("frontend service %s: %s", key, err)
+		return
+	}
+
+	for _, p := range svc.Spec.Ports {
+		if p.Port != tcpmap.Status.ElectedPort {
+			continue
+		}
+
+		switch {
+		case p.Protocol != v1.ProtocolTCP:
+			d.fail("frontend service %s port %d uses protocol %s", key, p.Port, p.Protocol)
+		case p.TargetPort.IntValue() != int(p.Port):
+			d.fail("frontend service %s port %d targets %s instead of %d", key, p.Port, p.TargetPort.String(), p.Port)
+		case p.Name != frontendPortName(tcpmap):
+			d.fail("frontend service %s port %d is named %s instead of %s", key, p.Port, p.Name, frontendPortName(tcpmap))
+		default:
+			d.ok("frontend service %s has port %d", key, p.Port)
+		}
+
+		if host := externalAddress(svc); host != "" {
+			d.ok("frontend service %s is exposed at %s", key, host)
+		} else if svc.Spec.Type == v1.ServiceTypeLoadBalancer {
+			d.fail("frontend service %s has no load balancer address", key)
+		}
+
+		return
+	}
+
+	d.fail("frontend service %s has no port %d", key, tcpmap.Status.ElectedPort)
+}
+
+func findBackendPort(svc v1.Service, port intstr.IntOrString) (v1.ServicePort, bool) {
+	for _, v := range svc.Spec.Ports {
+		if v.Name == port.String() || int(v.Port) == port.IntValue() {
+			return v, true
+		}
+	}
+
+	return v1.ServicePort{}, false
+}
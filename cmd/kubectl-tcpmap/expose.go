@@ -0,0 +1,109 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+func newExposeCmd(o *options) *cobra.Command {
+	var (
+		port      string
+		name      string
+		frontend  string
+		configMap string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "expose <service> --port <port>",
+		Short: "Create a TCPIngressMapping for a service port",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if port == "" {
+				return errors.New("--port is required")
+			}
+
+			svc := v1.Service{}
+			if err := o.client.Get(cmd.Context(), client.ObjectKey{Namespace: o.namespace, Name: args[0]}, &svc); err != nil {
+				return err
+			}
+
+			backendPort := intstr.Parse(port)
+			if _, ok := findBackendPort(svc, backendPort); !ok {
+				return fmt.Errorf("service %s/%s has no port %s", svc.Namespace, svc.Name, port)
+			}
+
+			if name == "" {
+				name = strings.ToLower(fmt.Sprintf("%s-%s", svc.Name, port))
+			}
+
+			tcpmap := infrav1beta1.TCPIngressMapping{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: o.namespace,
+				},
+				Spec: infrav1beta1.TCPIngressMappingSpec{
+					BackendService: infrav1beta1.BackendService{
+						Name: svc.Name,
+						Port: backendPort,
+					},
+				},
+			}
+
+			if frontend != "" {
+				key := tcpservices.ParseRef(o.namespace, frontend)
+				tcpmap.Spec.FrontendService = &infrav1beta1.FrontendService{
+					Name:      key.Name,
+					Namespace: key.Namespace,
+				}
+			}
+
+			if configMap != "" {
+				key := tcpservices.ParseRef(o.namespace, configMap)
+				tcpmap.Spec.TCPConfigMap = &infrav1beta1.TCPConfigMap{
+					Name:      key.Name,
+					Namespace: key.Namespace,
+				}
+			}
+
+			if err := o.client.Create(cmd.Context(), &tcpmap); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(o.out, "tcpingressmapping.networking.infra.doodle.com/%s created\n", tcpmap.Name)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&port, "port", "", "The service port (name or number) to expose.")
+	cmd.Flags().StringVar(&name, "name", "", "The name of the TCPIngressMapping. Defaults to <service>-<port>.")
+	cmd.Flags().StringVar(&frontend, "frontend", "", "The frontend service (namespace/name). Ignored by a controller having a default frontend service.")
+	cmd.Flags().StringVar(&configMap, "tcp-configmap", "", "The tcp configmap (namespace/name). Ignored by a controller having a default tcp configmap.")
+
+	return cmd
+}
@@ -0,0 +1,112 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+func newFreePortsCmd(o *options) *cobra.Command {
+	var (
+		minPort   int32
+		maxPort   int32
+		configMap string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "free-ports <frontend-service>",
+		Short: "Show the port ranges which are still available on a frontend service",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			used := make(map[int32]struct{})
+
+			svc := v1.Service{}
+			if err := o.client.Get(cmd.Context(), tcpservices.ParseRef(o.namespace, args[0]), &svc); err != nil {
+				return err
+			}
+
+			for _, p := range svc.Spec.Ports {
+				used[p.Port] = struct{}{}
+			}
+
+			if configMap == "" {
+				configMap = o.tcpConfigMap
+			}
+
+			if configMap != "" {
+				cm := v1.ConfigMap{}
+				if err := o.client.Get(cmd.Context(), tcpservices.ParseRef(svc.Namespace, configMap), &cm); err != nil {
+					return err
+				}
+
+				for k := range cm.Data {
+					if p, err := tcpservices.ParsePort(k); err == nil {
+						used[p] = struct{}{}
+					}
+				}
+			}
+
+			for _, r := range freeRanges(used, minPort, maxPort) {
+				if r[0] == r[1] {
+					fmt.Fprintf(o.out, "%d\n", r[0])
+				} else {
+					fmt.Fprintf(o.out, "%d-%d\n", r[0], r[1])
+				}
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().Int32Var(&minPort, "min-port", 1025, "The lowest port of the pool.")
+	cmd.Flags().Int32Var(&maxPort, "max-port", 65535, "The highest port of the pool.")
+	cmd.Flags().StringVar(&configMap, "tcp-configmap", "", "The tcp configmap (namespace/name) of the frontend. Falls back to --tcp-services-configmap.")
+
+	return cmd
+}
+
+// freeRanges returns the ranges of ports within [min, max] which are not used
+func freeRanges(used map[int32]struct{}, min, max int32) [][2]int32 {
+	var ranges [][2]int32
+	start := int32(-1)
+
+	for p := min; p <= max; p++ {
+		if _, ok := used[p]; ok {
+			if start != -1 {
+				ranges = append(ranges, [2]int32{start, p - 1})
+				start = -1
+			}
+
+			continue
+		}
+
+		if start == -1 {
+			start = p
+		}
+	}
+
+	if start != -1 {
+		ranges = append(ranges, [2]int32{start, max})
+	}
+
+	return ranges
+}
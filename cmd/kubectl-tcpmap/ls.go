@@ -0,0 +1,109 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func newLsCmd(o *options) *cobra.Command {
+	var allNamespaces bool
+
+	cmd := &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List TCPIngressMappings including their frontend and external address",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var opts []client.ListOption
+			if !allNamespaces {
+				opts = append(opts, client.InNamespace(o.namespace))
+			}
+
+			var list infrav1beta1.TCPIngressMappingList
+			if err := o.client.List(cmd.Context(), &list, opts...); err != nil {
+				return err
+			}
+
+			frontends := make(map[client.ObjectKey]*v1.Service)
+			w := tabwriter.NewWriter(o.out, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "NAMESPACE\tNAME\tFRONTEND\tPORT\tADDRESS\tREADY\tREASON")
+
+			for _, tcpmap := range list.Items {
+				frontend := "<unknown>"
+				address := "<none>"
+
+				if key, err := o.frontendServiceKey(tcpmap); err == nil {
+					frontend = key.String()
+
+					svc, ok := frontends[key]
+					if !ok {
+						svc = &v1.Service{}
+						if err := o.client.Get(cmd.Context(), key, svc); err != nil {
+							svc = nil
+						}
+
+						frontends[key] = svc
+					}
+
+					if svc != nil && tcpmap.Status.ElectedPort != 0 {
+						if host := externalAddress(*svc); host != "" {
+							address = net.JoinHostPort(host, strconv.Itoa(int(tcpmap.Status.ElectedPort)))
+						}
+					}
+				}
+
+				ready, reason := "Unknown", ""
+				if cond := apimeta.FindStatusCondition(tcpmap.Status.Conditions, infrav1beta1.ReadyCondition); cond != nil {
+					ready, reason = string(cond.Status), cond.Reason
+				}
+
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", tcpmap.Namespace, tcpmap.Name, frontend, tcpmap.Status.ElectedPort, address, ready, reason)
+			}
+
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().BoolVarP(&allNamespaces, "all-namespaces", "A", false, "List mappings across all namespaces.")
+	return cmd
+}
+
+// externalAddress returns the load balancer address of a service
+func externalAddress(svc v1.Service) string {
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			return ingress.IP
+		}
+
+		if ingress.Hostname != "" {
+			return ingress.Hostname
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,126 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = infrav1beta1.AddToScheme(scheme)
+}
+
+// options are shared between all sub commands
+type options struct {
+	configFlags     *genericclioptions.ConfigFlags
+	frontendService string
+	tcpConfigMap    string
+	client          client.Client
+	namespace       string
+	out             io.Writer
+}
+
+func main() {
+	o := &options{
+		configFlags: genericclioptions.NewConfigFlags(true),
+		out:         os.Stdout,
+	}
+
+	cmd := &cobra.Command{
+		Use:          "kubectl-tcpmap",
+		Short:        "Manage and diagnose TCPIngressMappings",
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return o.init()
+		},
+	}
+
+	o.configFlags.AddFlags(cmd.PersistentFlags())
+	cmd.PersistentFlags().StringVar(&o.frontendService, "frontend-service", "", "The default frontend service (namespace/name) of the controller. Takes precedence over spec.frontendService like in the controller.")
+	cmd.PersistentFlags().StringVar(&o.tcpConfigMap, "tcp-services-configmap", "", "The default tcp configmap (namespace/name) of the controller. Takes precedence over spec.tcpConfigMap like in the controller.")
+
+	cmd.AddCommand(
+		newExposeCmd(o),
+		newLsCmd(o),
+		newFreePortsCmd(o),
+		newDoctorCmd(o),
+	)
+
+	if err := cmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func (o *options) init() error {
+	cfg, err := o.configFlags.ToRESTConfig()
+	if err != nil {
+		return err
+	}
+
+	o.client, err = client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+
+	o.namespace, _, err = o.configFlags.ToRawKubeConfigLoader().Namespace()
+	return err
+}
+
+// frontendServiceKey returns the frontend service of a mapping
+func (o *options) frontendServiceKey(tcpmap infrav1beta1.TCPIngressMapping) (client.ObjectKey, error) {
+	key, ok := tcpservices.FrontendServiceKey(tcpmap, o.frontendService)
+	if !ok {
+		return key, fmt.Errorf("mapping %s/%s has no frontendService and no --frontend-service was given", tcpmap.Namespace, tcpmap.Name)
+	}
+
+	return key, nil
+}
+
+// tcpConfigMapKey returns the tcp configmap of a mapping
+func (o *options) tcpConfigMapKey(tcpmap infrav1beta1.TCPIngressMapping) (client.ObjectKey, error) {
+	key, ok := tcpservices.TCPConfigMapKey(tcpmap, o.tcpConfigMap)
+	if !ok {
+		return key, fmt.Errorf("mapping %s/%s has no tcpConfigMap and no --tcp-services-configmap was given", tcpmap.Namespace, tcpmap.Name)
+	}
+
+	return key, nil
+}
+
+// frontendPortName returns the name of the port on the frontend service of a mapping
+func frontendPortName(tcpmap infrav1beta1.TCPIngressMapping) string {
+	if tcpservices.RoutesBySNI(tcpmap) {
+		return tcpservices.SNIPortName
+	}
+
+	key := tcpservices.BackendServiceKey(tcpmap)
+	return tcpservices.PortName(key.Namespace, key.Name)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func TestKeyPrecedence(t *testing.T) {
+	mapping := func(frontend *infrav1beta1.FrontendService, cm *infrav1beta1.TCPConfigMap) infrav1beta1.TCPIngressMapping {
+		tcpmap := infrav1beta1.TCPIngressMapping{}
+		tcpmap.Namespace = "default"
+		tcpmap.Name = "db"
+		tcpmap.Spec.FrontendService = frontend
+		tcpmap.Spec.TCPConfigMap = cm
+		return tcpmap
+	}
+
+	tests := []struct {
+		name      string
+		o         options
+		tcpmap    infrav1beta1.TCPIngressMapping
+		frontend  client.ObjectKey
+		configMap client.ObjectKey
+		err       bool
+	}{
+		{
+			name:      "spec",
+			tcpmap:    mapping(&infrav1beta1.FrontendService{Name: "nginx"}, &infrav1beta1.TCPConfigMap{Namespace: "ingress", Name: "tcp"}),
+			frontend:  client.ObjectKey{Namespace: "default", Name: "nginx"},
+			configMap: client.ObjectKey{Namespace: "ingress", Name: "tcp"},
+		},
+		{
+			name:      "flags take precedence over the spec",
+			o:         options{frontendService: "ingress/controller", tcpConfigMap: "ingress/tcp-services"},
+			tcpmap:    mapping(&infrav1beta1.FrontendService{Name: "nginx"}, &infrav1beta1.TCPConfigMap{Namespace: "ingress", Name: "tcp"}),
+			frontend:  client.ObjectKey{Namespace: "ingress", Name: "controller"},
+			configMap: client.ObjectKey{Namespace: "ingress", Name: "tcp-services"},
+		},
+		{
+			name:      "flags without namespace",
+			o:         options{frontendService: "controller", tcpConfigMap: "tcp-services"},
+			tcpmap:    mapping(nil, nil),
+			frontend:  client.ObjectKey{Namespace: "default", Name: "controller"},
+			configMap: client.ObjectKey{Namespace: "default", Name: "tcp-services"},
+		},
+		{
+			name:   "neither",
+			tcpmap: mapping(nil, nil),
+			err:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frontend, err := test.o.frontendServiceKey(test.tcpmap)
+			if (err != nil) != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+
+			configMap, err := test.o.tcpConfigMapKey(test.tcpmap)
+			if (err != nil) != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+
+			if frontend != test.frontend {
+				t.Errorf("expected frontend service %s, got %s", test.frontend, frontend)
+			}
+
+			if configMap != test.configMap {
+				t.Errorf("expected tcp configmap %s, got %s", test.configMap, configMap)
+			}
+		})
+	}
+}
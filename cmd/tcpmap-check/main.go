@@ -0,0 +1,139 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/DoodleScheduling/tcpmap-controller/internal/checker"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+var (
+	minPort         int32
+	maxPort         int32
+	tcpConfigMap    string
+	frontendService string
+	namespace       string
+	output          string
+	strategy        string
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: tcpmap-check [flags] <file|directory|->...\n\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Int32Var(&minPort, "min-port", 1025, "The lowest port of the pool.")
+	flag.Int32Var(&maxPort, "max-port", 65535, "The highest port of the pool.")
+	flag.StringVar(&tcpConfigMap, "tcp-services-configmap", "", "The default tcp configmap (namespace/name) of the controller.")
+	flag.StringVar(&frontendService, "frontend-service", "", "The default frontend service (namespace/name) of the controller.")
+	flag.StringVarP(&namespace, "namespace", "n", "default", "The namespace of manifests without a namespace.")
+	flag.StringVar(&strategy, "election-strategy", string(tcpservices.ElectionLowest), "The election strategy of the controller. One of 'Lowest', 'Random' or 'HashedStable'.")
+	flag.StringVarP(&output, "output", "o", "text", "The output format. One of 'text' or 'json'.")
+	flag.Parse()
+
+	if flag.NArg() == 0 || (output != "text" && output != "json") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := checker.New(checker.Options{
+		MinPort:          minPort,
+		MaxPort:          maxPort,
+		FrontendService:  frontendService,
+		TCPConfigMap:     tcpConfigMap,
+		Namespace:        namespace,
+		ElectionStrategy: tcpservices.ElectionStrategy(strategy),
+	})
+
+	for _, path := range flag.Args() {
+		if err := load(c, path); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			os.Exit(2)
+		}
+	}
+
+	findings := c.Check()
+
+	switch output {
+	case "json":
+		if findings == nil {
+			findings = []checker.Finding{}
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(findings); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	default:
+		for _, f := range findings {
+			fmt.Println(f.String())
+		}
+	}
+
+	if len(findings) > 0 {
+		os.Exit(1)
+	}
+}
+
+// load reads manifests from stdin, a file or all yaml and json files within a directory
+func load(c *checker.Checker, path string) error {
+	if path == "-" {
+		return c.Load(os.Stdin)
+	}
+
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		switch filepath.Ext(p) {
+		case ".yaml", ".yml", ".json":
+		default:
+			if p != path {
+				return nil
+			}
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		if err := c.Load(f); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,129 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fluxcd/pkg/runtime/logger"
+	flag "github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+
+	infrav1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/controllers"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/proxy"
+)
+
+var (
+	scheme   = runtime.NewScheme()
+	setupLog = ctrl.Log.WithName("setup")
+)
+
+func init() {
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = infrav1beta1.AddToScheme(scheme)
+}
+
+var (
+	service                 string
+	frontendService         string
+	listenAddress           string
+	proxyProtocol           string
+	drainTimeout            time.Duration
+	metricsAddr             string
+	healthAddr              string
+	gracefulShutdownTimeout time.Duration
+	logOptions              logger.Options
+)
+
+func main() {
+	flag.StringVar(&service, "service", "", "The frontend service (namespace/name) of this proxy. Only mappings published on this service are served.")
+	flag.StringVar(&frontendService, "frontend-service", "", "The default frontend service (namespace/name) of the controller. Like in the controller it takes precedence over the mapping spec.")
+	flag.StringVar(&listenAddress, "listen-address", "", "The address the elected ports are bound to. All interfaces if empty.")
+	flag.StringVar(&proxyProtocol, "proxy-protocol", "", "Send a PROXY protocol header to the backends. One of 'v1', 'v2' or empty to send none.")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "The duration given to the connections of a removed port before they are closed.")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":9556",
+		"The address the metric endpoint binds to.")
+	flag.StringVar(&healthAddr, "health-addr", ":9557",
+		"The address the health endpoint binds to.")
+	flag.DurationVar(&gracefulShutdownTimeout, "graceful-shutdown-timeout", 600*time.Second,
+		"The duration given to the proxy to drain the ports before forcibly stopping.")
+
+	logOptions.BindFlags(flag.CommandLine)
+
+	flag.Parse()
+	logger.SetLogger(logger.NewLogger(logOptions))
+
+	if service == "" {
+		setupLog.Error(fmt.Errorf("--service is required"), "unable to configure proxy")
+		os.Exit(1)
+	}
+
+	switch proxy.ProxyProtocol(proxyProtocol) {
+	case proxy.ProxyProtocolNone, proxy.ProxyProtocolV1, proxy.ProxyProtocolV2:
+	default:
+		setupLog.Error(fmt.Errorf("invalid value %q", proxyProtocol), "unable to configure PROXY protocol")
+		os.Exit(1)
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		Scheme:                  scheme,
+		MetricsBindAddress:      metricsAddr,
+		HealthProbeBindAddress:  healthAddr,
+		GracefulShutdownTimeout: &gracefulShutdownTimeout,
+	})
+	if err != nil {
+		setupLog.Error(err, "unable to start manager")
+		os.Exit(1)
+	}
+
+	if err = mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
+		setupLog.Error(err, "Could not add liveness probe")
+		os.Exit(1)
+	}
+
+	if err = mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+		setupLog.Error(err, "Could not add readiness probe")
+		os.Exit(1)
+	}
+
+	proxyReconciler := &controllers.ProxyReconciler{
+		Log:             ctrl.Log.WithName("controllers").WithName("Proxy"),
+		Service:         service,
+		FrontendService: frontendService,
+		ProxyProtocol:   proxy.ProxyProtocol(proxyProtocol),
+		Proxy:           proxy.New(listenAddress, drainTimeout, ctrl.Log.WithName("proxy")),
+		Client:          mgr.GetClient(),
+	}
+
+	if err = proxyReconciler.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Proxy")
+		os.Exit(1)
+	}
+
+	setupLog.Info("starting proxy")
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		setupLog.Error(err, "problem running manager")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,509 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package checker verifies tcp services configmaps, frontend services and TCPIngressMappings
+// from manifests without access to a cluster.
+package checker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// FindingType classifies a finding
+type FindingType string
+
+const (
+	// DuplicatePort is reported if a port is used more than once within a pool
+	DuplicatePort FindingType = "DuplicatePort"
+	// MissingFrontendPort is reported if a tcp services entry has no port on the frontend service
+	MissingFrontendPort FindingType = "MissingFrontendPort"
+	// MissingEntry is reported if a frontend service port within the pool has no tcp services entry
+	MissingEntry FindingType = "MissingEntry"
+	// UnknownBackend is reported if a backend service or its port is not part of the manifests
+	UnknownBackend FindingType = "UnknownBackend"
+	// PortOutOfRange is reported if a port is outside the pool range
+	PortOutOfRange FindingType = "PortOutOfRange"
+	// InvalidEntry is reported if a tcp services key or value can not be parsed
+	InvalidEntry FindingType = "InvalidEntry"
+	// NoPortAvailable is reported if no port could be elected for a mapping
+	NoPortAvailable FindingType = "NoPortAvailable"
+)
+
+// Finding is a single inconsistency
+type Finding struct {
+	Type    FindingType `json:"type"`
+	Object  string      `json:"object"`
+	Port    int32       `json:"port,omitempty"`
+	Message string      `json:"message"`
+}
+
+func (f Finding) String() string {
+	if f.Port != 0 {
+		return fmt.Sprintf("%s: %s port %d: %s", f.Type, f.Object, f.Port, f.Message)
+	}
+
+	return fmt.Sprintf("%s: %s: %s", f.Type, f.Object, f.Message)
+}
+
+// Options configure the checker the same way the controller is configured
+type Options struct {
+	// MinPort is the lowest port of the pool
+	MinPort int32
+	// MaxPort is the highest port of the pool
+	MaxPort int32
+	// FrontendService is the default frontend service (namespace/name or name)
+	FrontendService string
+	// TCPConfigMap is the default tcp configmap (namespace/name or name)
+	TCPConfigMap string
+	// Namespace is used for manifests without a namespace
+	Namespace string
+	// ElectionStrategy is used to simulate the port election
+	ElectionStrategy tcpservices.ElectionStrategy
+}
+
+// Checker holds the manifests to check
+type Checker struct {
+	opts       Options
+	decoder    runtime.Decoder
+	services   map[types.NamespacedName]v1.Service
+	configMaps map[types.NamespacedName]v1.ConfigMap
+	mappings   []v1beta1.TCPIngressMapping
+	// duplicates are found while adding objects
+	duplicates []Finding
+	findings   []Finding
+}
+
+// pool is a frontend service together with its tcp configmap
+type pool struct {
+	frontend  types.NamespacedName
+	configMap types.NamespacedName
+}
+
+// New returns a new checker
+func New(opts Options) *Checker {
+	if opts.MinPort == 0 {
+		opts.MinPort = tcpservices.DefaultMinPort
+	}
+
+	if opts.MaxPort == 0 {
+		opts.MaxPort = tcpservices.DefaultMaxPort
+	}
+
+	if opts.Namespace == "" {
+		opts.Namespace = "default"
+	}
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	return &Checker{
+		opts:       opts,
+		decoder:    serializer.NewCodecFactory(scheme).UniversalDeserializer(),
+		services:   make(map[types.NamespacedName]v1.Service),
+		configMaps: make(map[types.NamespacedName]v1.ConfigMap),
+	}
+}
+
+// Load reads a stream of YAML or JSON manifests.
+// Documents of kinds other than Service, ConfigMap and TCPIngressMapping are ignored.
+func (c *Checker) Load(r io.Reader) error {
+	reader := yaml.NewYAMLReader(bufio.NewReader(r))
+
+	for {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var typeMeta metav1.TypeMeta
+		if err := yaml.Unmarshal(doc, &typeMeta); err != nil {
+			return err
+		}
+
+		switch typeMeta.GroupVersionKind() {
+		case v1.SchemeGroupVersion.WithKind("Service"), v1.SchemeGroupVersion.WithKind("ConfigMap"), v1beta1.GroupVersion.WithKind("TCPIngressMapping"):
+		default:
+			continue
+		}
+
+		obj, _, err := c.decoder.Decode(doc, nil, nil)
+
+		if err != nil {
+			return err
+		}
+
+		c.Add(obj)
+	}
+}
+
+// Add adds an object to the checker.
+// ConfigMaps which are added more than once are merged.
+func (c *Checker) Add(obj runtime.Object) {
+	switch o := obj.(type) {
+	case *v1.Service:
+		c.defaultNamespace(&o.ObjectMeta.Namespace)
+		c.services[types.NamespacedName{Namespace: o.Namespace, Name: o.Name}] = *o
+	case *v1.ConfigMap:
+		c.defaultNamespace(&o.ObjectMeta.Namespace)
+		key := types.NamespacedName{Namespace: o.Namespace, Name: o.Name}
+		existing, ok := c.configMaps[key]
+		if !ok {
+			c.configMaps[key] = *o
+			return
+		}
+
+		if existing.Data == nil {
+			existing.Data = make(map[string]string)
+		}
+
+		for k, v := range o.Data {
+			if _, ok := existing.Data[k]; ok {
+				c.duplicates = append(c.duplicates, Finding{
+					Type:    DuplicatePort,
+					Object:  configMapObject(key),
+					Message: fmt.Sprintf("key %s is defined in more than one manifest", k),
+				})
+			}
+
+			existing.Data[k] = v
+		}
+
+		c.configMaps[key] = existing
+	case *v1beta1.TCPIngressMapping:
+		c.defaultNamespace(&o.ObjectMeta.Namespace)
+		c.mappings = append(c.mappings, *o)
+	}
+}
+
+func (c *Checker) defaultNamespace(ns *string) {
+	if *ns == "" {
+		*ns = c.opts.Namespace
+	}
+}
+
+// Check returns all findings ordered by object and port
+func (c *Checker) Check() []Finding {
+	c.findings = append([]Finding{}, c.duplicates...)
+	for _, p := range c.pools() {
+		c.checkPool(p)
+	}
+
+	c.checkMappings()
+
+	findings := c.findings
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Object != findings[j].Object {
+			return findings[i].Object < findings[j].Object
+		}
+
+		return findings[i].Port < findings[j].Port
+	})
+
+	return findings
+}
+
+// pools returns the pools referenced by the defaults and all mappings
+func (c *Checker) pools() []pool {
+	seen := make(map[pool]struct{})
+	var pools []pool
+
+	add := func(p pool) {
+		if _, ok := seen[p]; ok {
+			return
+		}
+
+		seen[p] = struct{}{}
+		pools = append(pools, p)
+	}
+
+	if c.opts.FrontendService != "" && c.opts.TCPConfigMap != "" {
+		add(pool{
+			frontend:  tcpservices.ParseRef(c.opts.Namespace, c.opts.FrontendService),
+			configMap: tcpservices.ParseRef(c.opts.Namespace, c.opts.TCPConfigMap),
+		})
+	}
+
+	for _, tcpmap := range c.mappings {
+		if p, ok := c.poolOf(tcpmap); ok {
+			add(p)
+		}
+	}
+
+	return pools
+}
+
+func (c *Checker) poolOf(tcpmap v1beta1.TCPIngressMapping) (pool, bool) {
+	frontend, ok := tcpservices.FrontendServiceKey(tcpmap, c.opts.FrontendService)
+	if !ok {
+		return pool{}, false
+	}
+
+	cm, ok := tcpservices.TCPConfigMapKey(tcpmap, c.opts.TCPConfigMap)
+	if !ok {
+		return pool{}, false
+	}
+
+	return pool{frontend: frontend, configMap: cm}, true
+}
+
+// checkPool verifies a tcp configmap against its frontend service and the backends
+func (c *Checker) checkPool(p pool) {
+	cm, hasConfigMap := c.configMaps[p.configMap]
+	svc, hasFrontend := c.services[p.frontend]
+	cmObject := configMapObject(p.configMap)
+	svcObject := serviceObject(p.frontend)
+
+	frontendPorts := make(map[int32]struct{})
+	if hasFrontend {
+		for _, port := range svc.Spec.Ports {
+			if _, ok := frontendPorts[port.Port]; ok {
+				c.report(DuplicatePort, svcObject, port.Port, "port is defined more than once")
+			}
+
+			frontendPorts[port.Port] = struct{}{}
+		}
+	}
+
+	if !hasConfigMap {
+		return
+	}
+
+	entries := make(map[int32]string)
+	for _, key := range sortedKeys(cm.Data) {
+		value := cm.Data[key]
+		port, err := tcpservices.ParsePort(key)
+		if err != nil {
+			c.report(InvalidEntry, cmObject, 0, err.Error())
+			continue
+		}
+
+		if other, ok := entries[port]; ok {
+			c.report(DuplicatePort, cmObject, port, fmt.Sprintf("port is used by key %s and %s", other, key))
+			continue
+		}
+
+		entries[port] = key
+
+		if port < c.opts.MinPort || port > c.opts.MaxPort {
+			c.report(PortOutOfRange, cmObject, port, fmt.Sprintf("port is outside of the pool %d-%d", c.opts.MinPort, c.opts.MaxPort))
+		}
+
+		entry, err := tcpservices.ParseEntry(value)
+		if err != nil {
+			c.report(InvalidEntry, cmObject, port, err.Error())
+			continue
+		}
+
+		c.checkBackend(cmObject, port, types.NamespacedName{Namespace: entry.Namespace, Name: entry.Service}, intstr.Parse(entry.Port))
+
+		if _, ok := frontendPorts[port]; hasFrontend && !ok {
+			c.report(MissingFrontendPort, cmObject, port, fmt.Sprintf("frontend service %s has no port %d", p.frontend, port))
+		}
+	}
+
+	if !hasFrontend {
+		return
+	}
+
+	snippets := c.snippetPorts(p)
+	for _, port := range svc.Spec.Ports {
+		if port.Port < c.opts.MinPort || port.Port > c.opts.MaxPort {
+			continue
+		}
+
+		// Ports of mappings terminating TLS, routed by SNI or limiting connections are served by a stream snippet instead
+		if _, ok := snippets[port.Port]; ok {
+			continue
+		}
+
+		if _, ok := entries[port.Port]; !ok {
+			c.report(MissingEntry, svcObject, port.Port, fmt.Sprintf("tcp configmap %s has no entry for port %d", p.configMap, port.Port))
+		}
+	}
+}
+
+// snippetPorts returns the elected ports of the mappings of a pool which are served by a stream snippet
+func (c *Checker) snippetPorts(p pool) map[int32]struct{} {
+	ports := make(map[int32]struct{})
+	for _, tcpmap := range c.mappings {
+		if tcpmap.Status.ElectedPort == 0 || !tcpservices.ServedBySnippet(tcpmap) && !tcpservices.RoutesBySNI(tcpmap) {
+			continue
+		}
+
+		if q, ok := c.poolOf(tcpmap); ok && q == p {
+			ports[tcpmap.Status.ElectedPort] = struct{}{}
+		}
+	}
+
+	return ports
+}
+
+// checkMappings verifies the mappings and simulates the port election for mappings without an elected port
+func (c *Checker) checkMappings() {
+	elected := make(map[pool]map[int32]string)
+	shared := make(map[pool]map[int32]bool)
+	var pending []v1beta1.TCPIngressMapping
+
+	for _, tcpmap := range c.mappings {
+		object := mappingObject(tcpmap)
+		backend := tcpservices.BackendServiceKey(tcpmap)
+
+		// Services of remote and external backends are created by the controller at runtime
+		if !tcpservices.IsMirrored(tcpmap) {
+			c.checkBackend(object, tcpmap.Status.ElectedPort, backend, tcpmap.Spec.BackendService.Port)
+		}
+
+		for _, weighted := range tcpmap.Spec.BackendService.Weighted {
+			c.checkBackend(object, tcpmap.Status.ElectedPort, tcpservices.WeightedBackendKey(tcpmap, weighted), weighted.Port)
+		}
+
+		p, ok := c.poolOf(tcpmap)
+		if !ok {
+			continue
+		}
+
+		port := tcpmap.Status.ElectedPort
+		if port == 0 {
+			pending = append(pending, tcpmap)
+			continue
+		}
+
+		if port < c.opts.MinPort || port > c.opts.MaxPort {
+			c.report(PortOutOfRange, object, port, fmt.Sprintf("elected port is outside of the pool %d-%d", c.opts.MinPort, c.opts.MaxPort))
+		}
+
+		if elected[p] == nil {
+			elected[p] = make(map[int32]string)
+			shared[p] = make(map[int32]bool)
+		}
+
+		// Mappings routed by SNI share their port
+		sni := tcpservices.RoutesBySNI(tcpmap)
+		if other, ok := elected[p][port]; ok && !(sni && shared[p][port]) {
+			c.report(DuplicatePort, object, port, fmt.Sprintf("port is also elected by %s", other))
+			continue
+		}
+
+		elected[p][port] = object
+		if sni {
+			shared[p][port] = true
+			continue
+		}
+
+		cm, ok := c.configMaps[p.configMap]
+		if !ok {
+			continue
+		}
+
+		value, ok := cm.Data[strconv.Itoa(int(port))]
+		if !ok {
+			continue
+		}
+
+		if entry, err := tcpservices.ParseEntry(value); err == nil && entry.Backend() != backend.String() {
+			c.report(DuplicatePort, object, port, fmt.Sprintf("port is used by %s in tcp configmap %s", entry.Backend(), p.configMap))
+		}
+	}
+
+	used := make(map[pool][]int32)
+	for _, tcpmap := range pending {
+		p, _ := c.poolOf(tcpmap)
+		if _, ok := used[p]; !ok {
+			used[p] = tcpservices.UsedPorts(c.services[p.frontend], c.configMaps[p.configMap])
+			for port := range elected[p] {
+				used[p] = append(used[p], port)
+			}
+		}
+
+		port := tcpservices.ElectPort(used[p], c.opts.MinPort, c.opts.MaxPort, c.opts.ElectionStrategy, tcpservices.ParseRef(tcpmap.Namespace, tcpmap.Name).String())
+		if port == 0 {
+			c.report(NoPortAvailable, mappingObject(tcpmap), 0, fmt.Sprintf("no free port left in the pool %d-%d", c.opts.MinPort, c.opts.MaxPort))
+			continue
+		}
+
+		used[p] = append(used[p], port)
+	}
+}
+
+// checkBackend verifies that a backend service and its port are part of the manifests
+func (c *Checker) checkBackend(object string, port int32, backend types.NamespacedName, backendPort intstr.IntOrString) {
+	svc, ok := c.services[backend]
+	if !ok {
+		c.report(UnknownBackend, object, port, fmt.Sprintf("backend service %s not found", backend))
+		return
+	}
+
+	for _, p := range svc.Spec.Ports {
+		if p.Name == backendPort.String() || int(p.Port) == backendPort.IntValue() {
+			return
+		}
+	}
+
+	c.report(UnknownBackend, object, port, fmt.Sprintf("backend service %s has no port %s", backend, backendPort.String()))
+}
+
+func (c *Checker) report(t FindingType, object string, port int32, msg string) {
+	c.findings = append(c.findings, Finding{
+		Type:    t,
+		Object:  object,
+		Port:    port,
+		Message: msg,
+	})
+}
+
+func sortedKeys(data map[string]string) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func configMapObject(key types.NamespacedName) string {
+	return fmt.Sprintf("ConfigMap/%s", key)
+}
+
+func serviceObject(key types.NamespacedName) string {
+	return fmt.Sprintf("Service/%s", key)
+}
+
+func mappingObject(tcpmap v1beta1.TCPIngressMapping) string {
+	return fmt.Sprintf("TCPIngressMapping/%s/%s", tcpmap.Namespace, tcpmap.Name)
+}
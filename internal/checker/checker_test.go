@@ -0,0 +1,320 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checker
+
+import (
+	"strings"
+	"testing"
+)
+
+const manifests = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: ingress-nginx
+  namespace: ingress
+spec:
+  ports:
+  - name: http
+    port: 80
+  - name: default-db
+    port: 2000
+  - name: default-cache
+    port: 2001
+  - name: stale
+    port: 2002
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: tcp-services
+  namespace: ingress
+data:
+  "2000": default/db:5432
+  "2001": default/cache:6379
+  "2003": default/missing:80
+  "80": default/db:5432
+  "abc": default/db:5432
+  "2004": invalid
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: db
+spec:
+  ports:
+  - name: postgres
+    port: 5432
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: cache
+spec:
+  ports:
+  - name: redis
+    port: 6380
+---
+apiVersion: networking.infra.doodle.com/v1beta1
+kind: TCPIngressMapping
+metadata:
+  name: db
+spec:
+  backendService:
+    name: db
+    port: postgres
+status:
+  electedPort: 2000
+---
+apiVersion: networking.infra.doodle.com/v1beta1
+kind: TCPIngressMapping
+metadata:
+  name: db-copy
+spec:
+  backendService:
+    name: db
+    port: 5432
+status:
+  electedPort: 2001
+---
+apiVersion: networking.infra.doodle.com/v1beta1
+kind: TCPIngressMapping
+metadata:
+  name: pending
+spec:
+  backendService:
+    name: db
+    port: 5432
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: ignored
+`
+
+func TestCheck(t *testing.T) {
+	c := New(Options{
+		MinPort:         2000,
+		MaxPort:         2004,
+		FrontendService: "ingress/ingress-nginx",
+		TCPConfigMap:    "ingress/tcp-services",
+	})
+
+	if err := c.Load(strings.NewReader(manifests)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, f := range c.Check() {
+		got = append(got, f.String())
+	}
+
+	expected := []string{
+		`InvalidEntry: ConfigMap/ingress/tcp-services: invalid port "abc"`,
+		`PortOutOfRange: ConfigMap/ingress/tcp-services port 80: port is outside of the pool 2000-2004`,
+		`UnknownBackend: ConfigMap/ingress/tcp-services port 2001: backend service default/cache has no port 6379`,
+		`UnknownBackend: ConfigMap/ingress/tcp-services port 2003: backend service default/missing not found`,
+		`MissingFrontendPort: ConfigMap/ingress/tcp-services port 2003: frontend service ingress/ingress-nginx has no port 2003`,
+		`InvalidEntry: ConfigMap/ingress/tcp-services port 2004: invalid tcp services entry: "invalid"`,
+		`MissingEntry: Service/ingress/ingress-nginx port 2002: tcp configmap ingress/tcp-services has no entry for port 2002`,
+		`DuplicatePort: TCPIngressMapping/default/db-copy port 2001: port is used by default/cache in tcp configmap ingress/tcp-services`,
+		`NoPortAvailable: TCPIngressMapping/default/pending: no free port left in the pool 2000-2004`,
+	}
+
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected findings:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestCheckElection(t *testing.T) {
+	c := New(Options{
+		MinPort:         2000,
+		MaxPort:         2001,
+		FrontendService: "ingress/ingress-nginx",
+		TCPConfigMap:    "ingress/tcp-services",
+	})
+
+	if err := c.Load(strings.NewReader(`
+apiVersion: v1
+kind: Service
+metadata:
+  name: db
+spec:
+  ports:
+  - port: 5432
+---
+apiVersion: networking.infra.doodle.com/v1beta1
+kind: TCPIngressMapping
+metadata:
+  name: a
+spec:
+  backendService:
+    name: db
+    port: 5432
+---
+apiVersion: networking.infra.doodle.com/v1beta1
+kind: TCPIngressMapping
+metadata:
+  name: b
+spec:
+  backendService:
+    name: db
+    port: 5432
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if findings := c.Check(); len(findings) != 0 {
+		t.Errorf("expected no findings, got %v", findings)
+	}
+}
+
+func TestCheckTLS(t *testing.T) {
+	c := New(Options{
+		MinPort:         2000,
+		MaxPort:         2001,
+		FrontendService: "ingress/ingress-nginx",
+		TCPConfigMap:    "ingress/tcp-services",
+	})
+
+	if err := c.Load(strings.NewReader(`
+apiVersion: v1
+kind: Service
+metadata:
+  name: ingress-nginx
+  namespace: ingress
+spec:
+  ports:
+  - name: default-db
+    port: 2000
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: tcp-services
+  namespace: ingress
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: db
+spec:
+  ports:
+  - port: 5432
+---
+apiVersion: networking.infra.doodle.com/v1beta1
+kind: TCPIngressMapping
+metadata:
+  name: db
+spec:
+  backendService:
+    name: db
+    port: 5432
+  tls:
+    secretRef:
+      name: db-tls
+status:
+  electedPort: 2000
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if findings := c.Check(); len(findings) != 0 {
+		t.Errorf("expected no findings for a port terminating TLS, got %v", findings)
+	}
+}
+
+func TestCheckSNI(t *testing.T) {
+	c := New(Options{
+		MinPort:         2000,
+		MaxPort:         2001,
+		FrontendService: "ingress/ingress-nginx",
+		TCPConfigMap:    "ingress/tcp-services",
+	})
+
+	if err := c.Load(strings.NewReader(`
+apiVersion: v1
+kind: Service
+metadata:
+  name: ingress-nginx
+  namespace: ingress
+spec:
+  ports:
+  - name: tcpmap-sni
+    port: 2000
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: tcp-services
+  namespace: ingress
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: db
+spec:
+  ports:
+  - port: 5432
+---
+apiVersion: networking.infra.doodle.com/v1beta1
+kind: TCPIngressMapping
+metadata:
+  name: a
+spec:
+  backendService:
+    name: db
+    port: 5432
+  tls:
+    mode: Passthrough
+    hostname: a.example.com
+status:
+  electedPort: 2000
+---
+apiVersion: networking.infra.doodle.com/v1beta1
+kind: TCPIngressMapping
+metadata:
+  name: b
+spec:
+  backendService:
+    name: db
+    port: 5432
+  tls:
+    mode: Passthrough
+    hostname: b.example.com
+status:
+  electedPort: 2000
+---
+apiVersion: networking.infra.doodle.com/v1beta1
+kind: TCPIngressMapping
+metadata:
+  name: c
+spec:
+  backendService:
+    name: db
+    port: 5432
+status:
+  electedPort: 2000
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	findings := c.Check()
+	if len(findings) != 1 || findings[0].Type != DuplicatePort || findings[0].Object != "TCPIngressMapping/default/c" {
+		t.Errorf("expected a single duplicate port of the mapping not routed by SNI, got %v", findings)
+	}
+}
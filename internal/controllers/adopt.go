@@ -0,0 +1,112 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// adoptPort returns the port which is still registered for the mapping or 0.
+// A port is owned by the mapping if it is managed by the field manager of the mapping.
+// Ports registered by previous versions of the controller are matched by the port name
+// on the frontend service and the backend reference in the tcp configmap.
+func adoptPort(tcpmap v1beta1.TCPIngressMapping, svc v1.Service, cm v1.ConfigMap, backendPort int32) int32 {
+	manager := fieldManagerFor(tcpmap)
+
+	for _, port := range managedPorts(svc.ManagedFields, manager, "f:spec", "f:ports") {
+		if _, ok := findServicePort(svc, port); ok {
+			return port
+		}
+	}
+
+	for _, port := range managedPorts(cm.ManagedFields, manager, "f:data") {
+		if _, ok := cm.Data[strconv.Itoa(int(port))]; ok {
+			return port
+		}
+	}
+
+	name := frontendPortName(tcpmap)
+	for _, p := range svc.Spec.Ports {
+		if p.Name != name {
+			continue
+		}
+
+		if cm.Name == "" {
+			return p.Port
+		}
+
+		entry, err := tcpservices.ParseEntry(cm.Data[strconv.Itoa(int(p.Port))])
+		if err == nil && entry.Backend() == backendReference(tcpmap) && entry.Port == strconv.Itoa(int(backendPort)) {
+			return p.Port
+		}
+	}
+
+	return 0
+}
+
+// managedPorts returns the ports found in the fields applied by the field manager at the given path.
+// Service ports are keyed by port and protocol (k:{"port":1025,"protocol":"TCP"}), configmap data by its key (f:1025).
+func managedPorts(managedFields []metav1.ManagedFieldsEntry, manager string, path ...string) []int32 {
+	var ports []int32
+
+	for _, entry := range managedFields {
+		if entry.Manager != manager || entry.Operation != metav1.ManagedFieldsOperationApply || entry.FieldsV1 == nil {
+			continue
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+
+		for _, p := range path {
+			fields, _ = fields[p].(map[string]interface{})
+		}
+
+		for key := range fields {
+			switch {
+			case strings.HasPrefix(key, "k:"):
+				var k struct {
+					Port int32 `json:"port"`
+				}
+
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(key, "k:")), &k); err == nil && k.Port != 0 {
+					ports = append(ports, k.Port)
+				}
+			case strings.HasPrefix(key, "f:"):
+				if port, err := tcpservices.ParsePort(strings.TrimPrefix(key, "f:")); err == nil {
+					ports = append(ports, port)
+				}
+			}
+		}
+	}
+
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i] < ports[j]
+	})
+
+	return ports
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func TestAdoptPort(t *testing.T) {
+	tcpmap := v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Spec: v1beta1.TCPIngressMappingSpec{
+			BackendService: v1beta1.BackendService{Name: "postgres", Port: intstr.FromInt(5432)},
+		},
+	}
+
+	svc := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "frontend"},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Name: "other-service", Port: 1025},
+				{Name: "default-postgres", Port: 1026},
+				{Name: "default-postgres", Port: 1027},
+			},
+		},
+	}
+
+	cm := v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "tcp-services"},
+		Data: map[string]string{
+			"1025": "other/service:80:PROXY",
+			"1026": "default/postgres:5433:PROXY",
+			"1027": "default/postgres:5432:PROXY",
+		},
+	}
+
+	if port := adoptPort(tcpmap, svc, cm, 5432); port != 1027 {
+		t.Errorf("expected port 1027 to be adopted by port name and backend reference, got %d", port)
+	}
+
+	if port := adoptPort(tcpmap, svc, cm, 8080); port != 0 {
+		t.Errorf("expected no port to be adopted for another backend port, got %d", port)
+	}
+
+	svc.ManagedFields = []metav1.ManagedFieldsEntry{
+		{
+			Manager:   fieldManagerFor(tcpmap),
+			Operation: metav1.ManagedFieldsOperationApply,
+			FieldsV1:  &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:ports":{"k:{\"port\":1025,\"protocol\":\"TCP\"}":{".":{},"f:name":{}}}}}`)},
+		},
+		{
+			Manager:   "tcpmap-controller/default/other",
+			Operation: metav1.ManagedFieldsOperationApply,
+			FieldsV1:  &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:ports":{"k:{\"port\":1026,\"protocol\":\"TCP\"}":{}}}}`)},
+		},
+	}
+
+	if port := adoptPort(tcpmap, svc, cm, 8080); port != 1025 {
+		t.Errorf("expected port 1025 to be adopted by its field manager, got %d", port)
+	}
+
+	svc.ManagedFields = nil
+	cm.ManagedFields = []metav1.ManagedFieldsEntry{
+		{
+			Manager:   fieldManagerFor(tcpmap),
+			Operation: metav1.ManagedFieldsOperationApply,
+			FieldsV1:  &metav1.FieldsV1{Raw: []byte(`{"f:data":{"f:1026":{}}}`)},
+		},
+	}
+
+	if port := adoptPort(tcpmap, svc, cm, 8080); port != 1026 {
+		t.Errorf("expected port 1026 to be adopted by its field manager, got %d", port)
+	}
+}
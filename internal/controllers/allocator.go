@@ -0,0 +1,133 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// pendingTTL is the period after which an elected port which never showed up
+// on the frontend service or in the tcp configmap can be elected again
+const pendingTTL = time.Minute
+
+// portAllocator keeps a bitmap of the used ports of each pool (frontend service and tcp configmap).
+// The bitmaps are built from the objects of the informer cache and only rebuilt for the object which changed.
+// Elected ports are reserved until they are observed in the cache, hence concurrent reconciles never elect the same port.
+type portAllocator struct {
+	mu    sync.Mutex
+	pools map[poolKey]*portPool
+}
+
+type poolKey struct {
+	frontend  types.NamespacedName
+	configMap types.NamespacedName
+}
+
+type portPool struct {
+	serviceVersion   string
+	configMapVersion string
+	service          tcpservices.PortSet
+	configMap        tcpservices.PortSet
+	pending          map[int32]time.Time
+}
+
+// elect calls elect with the ports used by the pool and reserves the returned port
+func (a *portAllocator) elect(svc v1.Service, cm v1.ConfigMap, elect func(used *tcpservices.PortSet) int32) int32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.pools == nil {
+		a.pools = make(map[poolKey]*portPool)
+	}
+
+	key := poolKeyOf(svc, cm)
+	pool, ok := a.pools[key]
+	if !ok {
+		pool = &portPool{pending: make(map[int32]time.Time)}
+		a.pools[key] = pool
+	}
+
+	now := time.Now()
+	pool.observe(svc, cm, now)
+
+	used := pool.service
+	used.Union(&pool.configMap)
+	for port := range pool.pending {
+		used.Add(port)
+	}
+
+	port := elect(&used)
+	if port != 0 {
+		pool.pending[port] = now
+	}
+
+	return port
+}
+
+// release frees a reserved port
+func (a *portAllocator) release(svc v1.Service, cm v1.ConfigMap, port int32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if pool, ok := a.pools[poolKeyOf(svc, cm)]; ok {
+		delete(pool.pending, port)
+	}
+}
+
+// observe updates the bitmaps of the objects which changed and drops reservations
+// which are either observed in the cache or expired
+func (p *portPool) observe(svc v1.Service, cm v1.ConfigMap, now time.Time) {
+	if svc.ResourceVersion == "" || svc.ResourceVersion != p.serviceVersion {
+		p.service.Reset()
+		for _, port := range svc.Spec.Ports {
+			p.service.Add(port.Port)
+		}
+
+		p.serviceVersion = svc.ResourceVersion
+	}
+
+	if cm.ResourceVersion == "" || cm.ResourceVersion != p.configMapVersion {
+		p.configMap.Reset()
+		for k := range cm.Data {
+			if port, err := tcpservices.ParsePort(k); err == nil {
+				p.configMap.Add(port)
+			}
+		}
+
+		p.configMapVersion = cm.ResourceVersion
+	}
+
+	for port, at := range p.pending {
+		observed := p.service.Has(port) && (cm.Name == "" || p.configMap.Has(port))
+		if observed || now.Sub(at) > pendingTTL {
+			delete(p.pending, port)
+		}
+	}
+}
+
+func poolKeyOf(svc v1.Service, cm v1.ConfigMap) poolKey {
+	return poolKey{
+		frontend:  objectKey(&svc),
+		configMap: objectKey(&cm),
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// pool returns a frontend service and tcp configmap with n ports allocated starting at 1025
+func pool(n int) (v1.Service, v1.ConfigMap) {
+	svc := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "frontend", ResourceVersion: "1"},
+	}
+
+	cm := v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "tcp-services", ResourceVersion: "1"},
+		Data:       make(map[string]string, n),
+	}
+
+	for i := 0; i < n; i++ {
+		port := int32(1025 + i)
+		svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Port: port})
+		cm.Data[strconv.Itoa(int(port))] = fmt.Sprintf("default/backend-%d:5432", i)
+	}
+
+	return svc, cm
+}
+
+func lowest(used *tcpservices.PortSet) int32 {
+	return used.Elect(1025, 65535, tcpservices.ElectionLowest, "")
+}
+
+func TestPortAllocatorReservesPorts(t *testing.T) {
+	svc, cm := pool(10)
+	var a portAllocator
+
+	if port := a.elect(svc, cm, lowest); port != 1035 {
+		t.Fatalf("expected port 1035, got %d", port)
+	}
+
+	if port := a.elect(svc, cm, lowest); port != 1036 {
+		t.Fatalf("expected reserved port 1035 to be skipped, got %d", port)
+	}
+
+	a.release(svc, cm, 1035)
+	if port := a.elect(svc, cm, lowest); port != 1035 {
+		t.Fatalf("expected released port 1035, got %d", port)
+	}
+
+	// The port shows up in the cache, the reservation is dropped
+	svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Port: 1035})
+	svc.ResourceVersion = "2"
+	cm.Data["1035"] = "default/other:5432"
+	cm.ResourceVersion = "2"
+
+	if port := a.elect(svc, cm, lowest); port != 1037 {
+		t.Fatalf("expected port 1037, got %d", port)
+	}
+
+	// A removed port is available again once the cache has been updated
+	svc.Spec.Ports = svc.Spec.Ports[1:]
+	svc.ResourceVersion = "3"
+	delete(cm.Data, "1025")
+	cm.ResourceVersion = "3"
+
+	if port := a.elect(svc, cm, lowest); port != 1025 {
+		t.Fatalf("expected removed port 1025, got %d", port)
+	}
+}
+
+func TestPortAllocatorConcurrentElections(t *testing.T) {
+	svc, cm := pool(100)
+	var a portAllocator
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	elected := make(map[int32]struct{})
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			port := a.elect(svc, cm, lowest)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := elected[port]; ok {
+				t.Errorf("port %d elected twice", port)
+			}
+
+			elected[port] = struct{}{}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func benchmarkElectPort(b *testing.B, n int) {
+	svc, cm := pool(n)
+	tcpmap := v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+	r := &TCPIngressMappingReconciler{Log: logr.Discard(), MinPort: 1025, MaxPort: 65535, ElectionStrategy: tcpservices.ElectionHashedStable}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		port, _, _ := r.electPort(tcpmap, svc, cm)
+		r.ports.release(svc, cm, port)
+	}
+}
+
+func BenchmarkElectPort100(b *testing.B) {
+	benchmarkElectPort(b, 100)
+}
+
+func BenchmarkElectPort1k(b *testing.B) {
+	benchmarkElectPort(b, 1000)
+}
+
+func BenchmarkElectPort10k(b *testing.B) {
+	benchmarkElectPort(b, 10000)
+}
+
+// BenchmarkElectPort10kLowest elects the lowest free port which is located after 10k allocated ports
+func BenchmarkElectPort10kLowest(b *testing.B) {
+	svc, cm := pool(10000)
+	tcpmap := v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+	r := &TCPIngressMappingReconciler{Log: logr.Discard(), MinPort: 1025, MaxPort: 65535}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		port, _, _ := r.electPort(tcpmap, svc, cm)
+		r.ports.release(svc, cm, port)
+	}
+}
+
+// BenchmarkElectPort10kChanged rebuilds the bitmaps on every election as the objects changed in the cache
+func BenchmarkElectPort10kChanged(b *testing.B) {
+	svc, cm := pool(10000)
+	tcpmap := v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+	r := &TCPIngressMappingReconciler{Log: logr.Discard(), MinPort: 1025, MaxPort: 65535}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		svc.ResourceVersion = strconv.Itoa(i)
+		cm.ResourceVersion = strconv.Itoa(i)
+		port, _, _ := r.electPort(tcpmap, svc, cm)
+		r.ports.release(svc, cm, port)
+	}
+}
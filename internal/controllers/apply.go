@@ -0,0 +1,179 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+const (
+	// fieldManager is the prefix of the server-side apply field manager used for each mapping
+	fieldManager = "tcpmap-controller"
+
+	// maxFieldManagerLength is the maximum length of a field manager accepted by the api server
+	maxFieldManagerLength = 128
+)
+
+// fieldManagerFor returns the field manager for a mapping.
+// Each mapping uses its own field manager so it owns only its own service ports and configmap keys.
+func fieldManagerFor(tcpmap v1beta1.TCPIngressMapping) string {
+	m := fmt.Sprintf("%s/%s/%s", fieldManager, tcpmap.Namespace, tcpmap.Name)
+	if len(m) <= maxFieldManagerLength {
+		return m
+	}
+
+	return fmt.Sprintf("%s/%x", fieldManager, sha256.Sum256([]byte(m)))
+}
+
+// applyFrontendPorts declares the ports owned by the mapping on the frontend service.
+// Ports previously owned by the mapping which are not declared anymore are removed.
+func (r *TCPIngressMappingReconciler) applyFrontendPorts(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, svc *v1.Service, ports ...*corev1ac.ServicePortApplyConfiguration) error {
+	cfg := corev1ac.Service(svc.Name, svc.Namespace)
+	if len(ports) > 0 {
+		cfg.WithSpec(corev1ac.ServiceSpec().WithPorts(ports...))
+	}
+
+	return r.apply(ctx, tcpmap, svc, &v1.Service{}, cfg, func(latest, applied client.Object) []string {
+		return diffServicePorts(*latest.(*v1.Service), *applied.(*v1.Service))
+	})
+}
+
+// applyConfigMapData declares the keys owned by the mapping in the tcp configmap.
+// Keys previously owned by the mapping which are not declared anymore are removed.
+func (r *TCPIngressMappingReconciler) applyConfigMapData(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, cm *v1.ConfigMap, data map[string]string) error {
+	cfg := corev1ac.ConfigMap(cm.Name, cm.Namespace)
+	if len(data) > 0 {
+		cfg.WithData(data)
+	}
+
+	return r.apply(ctx, tcpmap, cm, &v1.ConfigMap{}, cfg, func(latest, applied client.Object) []string {
+		return diffConfigMapData(*latest.(*v1.ConfigMap), *applied.(*v1.ConfigMap))
+	})
+}
+
+// applySecretData declares the keys owned by the mapping in a secret.
+// Keys previously owned by the mapping which are not declared anymore are removed.
+func (r *TCPIngressMappingReconciler) applySecretData(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, secret *v1.Secret, data map[string][]byte) error {
+	cfg := corev1ac.Secret(secret.Name, secret.Namespace)
+	if len(data) > 0 {
+		cfg.WithData(data)
+	}
+
+	return r.apply(ctx, tcpmap, secret, &v1.Secret{}, cfg, func(latest, applied client.Object) []string {
+		return diffSecretKeys(*latest.(*v1.Secret), *applied.(*v1.Secret))
+	})
+}
+
+// apply sends an apply configuration using the field manager of the mapping.
+// In dry-run mode the apply is only validated by the api server and the resulting changes are recorded.
+func (r *TCPIngressMappingReconciler) apply(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, obj, latest client.Object, cfg interface{}, diff func(latest, applied client.Object) []string) error {
+	if err := guardShard(obj, r.Shard); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	patch := client.RawPatch(types.ApplyPatchType, data)
+	owner := client.FieldOwner(fieldManagerFor(*tcpmap))
+
+	if !r.DryRun {
+		return r.Client.Patch(ctx, obj, patch, owner)
+	}
+
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(obj), latest); err != nil {
+		return err
+	}
+
+	if err := r.Client.Patch(ctx, obj, patch, owner, client.DryRunAll); err != nil {
+		return err
+	}
+
+	r.recordPlan(tcpmap, diff(latest, obj))
+	return nil
+}
+
+// removeUnmanagedFrontendPort removes a port from the frontend service which is not owned by the field manager of the mapping.
+// This is the case for ports which have been registered by previous versions of the controller.
+func (r *TCPIngressMappingReconciler) removeUnmanagedFrontendPort(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, svc *v1.Service, port int32, name string) error {
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(svc), svc); err != nil {
+		return err
+	}
+
+	latest := svc.DeepCopy()
+	var ports []v1.ServicePort
+	for _, p := range svc.Spec.Ports {
+		if p.Port == port && p.Name == name {
+			continue
+		}
+
+		ports = append(ports, p)
+	}
+
+	if len(ports) == len(svc.Spec.Ports) {
+		return nil
+	}
+
+	svc.Spec.Ports = ports
+	return r.patch(ctx, tcpmap, svc, client.MergeFromWithOptions(latest, client.MergeFromWithOptimisticLock{}), diffServicePorts(*latest, *svc))
+}
+
+// removeUnmanagedConfigMapKey removes a key pointing to the given backend from the tcp configmap which is not owned by the field manager of the mapping.
+// This is the case for keys which have been registered by previous versions of the controller.
+func (r *TCPIngressMappingReconciler) removeUnmanagedConfigMapKey(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, cm *v1.ConfigMap, key, backend string) error {
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(cm), cm); err != nil {
+		return err
+	}
+
+	if v, ok := cm.Data[key]; !ok || !strings.HasPrefix(v, backend+":") {
+		return nil
+	}
+
+	latest := cm.DeepCopy()
+	delete(cm.Data, key)
+	return r.patch(ctx, tcpmap, cm, client.MergeFromWithOptions(latest, client.MergeFromWithOptimisticLock{}), diffConfigMapData(*latest, *cm))
+}
+
+func (r *TCPIngressMappingReconciler) patch(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, obj client.Object, patch client.Patch, changes []string) error {
+	if err := guardShard(obj, r.Shard); err != nil {
+		return err
+	}
+
+	if !r.DryRun {
+		return r.Client.Patch(ctx, obj, patch, client.FieldOwner(fieldManagerFor(*tcpmap)))
+	}
+
+	if err := r.Client.Patch(ctx, obj, patch, client.FieldOwner(fieldManagerFor(*tcpmap)), client.DryRunAll); err != nil {
+		return err
+	}
+
+	r.recordPlan(tcpmap, changes)
+	return nil
+}
@@ -0,0 +1,409 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+// appliedPatch is a server-side apply patch captured by the fake client which does not support them
+type appliedPatch struct {
+	kind    string
+	manager string
+	data    []byte
+}
+
+// captureApply records server-side apply patches instead of applying them, conflict decides whether the api server reports a conflict
+func captureApply(applied *[]appliedPatch, conflict func(obj client.Object) bool) interceptor.Funcs {
+	return interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			if patch.Type() != types.ApplyPatchType {
+				return c.Patch(ctx, obj, patch, opts...)
+			}
+
+			patchOpts := &client.PatchOptions{}
+			patchOpts.ApplyOptions(opts)
+
+			data, err := patch.Data(obj)
+			if err != nil {
+				return err
+			}
+
+			kind := kindOf(obj)
+			*applied = append(*applied, appliedPatch{kind: kind, manager: patchOpts.FieldManager, data: data})
+
+			if conflict != nil && conflict(obj) {
+				return kerrors.NewConflict(schema.GroupResource{Resource: strings.ToLower(kind) + "s"}, obj.GetName(), errors.New(`conflict with "tcpmap-controller/default/other"`))
+			}
+
+			return nil
+		},
+	}
+}
+
+func kindOf(obj client.Object) string {
+	switch obj.(type) {
+	case *v1.Service:
+		return "Service"
+	case *v1.ConfigMap:
+		return "ConfigMap"
+	case *v1.Secret:
+		return "Secret"
+	}
+
+	return ""
+}
+
+func TestFieldManagerFor(t *testing.T) {
+	tcpmap := v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+	if m := fieldManagerFor(tcpmap); m != "tcpmap-controller/default/db" {
+		t.Errorf("expected field manager tcpmap-controller/default/db, got %s", m)
+	}
+
+	long := v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: strings.Repeat("n", 63), Name: strings.Repeat("a", 63)}}
+	other := v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: strings.Repeat("n", 63), Name: strings.Repeat("b", 63)}}
+
+	m := fieldManagerFor(long)
+	if len(m) > maxFieldManagerLength || !strings.HasPrefix(m, fieldManager+"/") {
+		t.Errorf("expected a hashed field manager of at most %d characters, got %s", maxFieldManagerLength, m)
+	}
+
+	if m != fieldManagerFor(long) {
+		t.Error("expected the field manager to be stable")
+	}
+
+	if m == fieldManagerFor(other) {
+		t.Error("expected distinct field managers for distinct mappings")
+	}
+}
+
+func TestApplyFrontendPorts(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	var applied []appliedPatch
+	c := fake.NewClientBuilder().WithScheme(scheme).WithInterceptorFuncs(captureApply(&applied, nil)).Build()
+	r := &TCPIngressMappingReconciler{Client: c}
+
+	tcpmap := &v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "nginx"}}
+
+	port := corev1ac.ServicePort().WithName("default-db").WithPort(1024).WithTargetPort(intstr.FromInt(1024)).WithProtocol(v1.ProtocolTCP)
+	if err := r.applyFrontendPorts(context.TODO(), tcpmap, svc, port); err != nil {
+		t.Fatal(err)
+	}
+
+	// Releasing applies no ports at all, the api server removes the ones owned by the field manager
+	if err := r.applyFrontendPorts(context.TODO(), tcpmap, svc); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != 2 {
+		t.Fatalf("expected 2 applied patches, got %d", len(applied))
+	}
+
+	for _, patch := range applied {
+		if patch.manager != fieldManagerFor(*tcpmap) {
+			t.Errorf("expected field manager %s, got %s", fieldManagerFor(*tcpmap), patch.manager)
+		}
+	}
+
+	var declared, released v1.Service
+	if err := json.Unmarshal(applied[0].data, &declared); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(applied[1].data, &released); err != nil {
+		t.Fatal(err)
+	}
+
+	if declared.Name != "nginx" || declared.Namespace != "ingress" || len(declared.Spec.Ports) != 1 || declared.Spec.Ports[0].Port != 1024 || declared.Spec.Ports[0].Name != "default-db" {
+		t.Errorf("expected port 1024 to be declared on ingress/nginx, got %s", applied[0].data)
+	}
+
+	if len(released.Spec.Ports) != 0 {
+		t.Errorf("expected no ports to be declared, got %s", applied[1].data)
+	}
+}
+
+func TestRemoveUnmanagedFrontendPort(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "nginx"},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80},
+				{Name: "default-db", Port: 1024},
+				{Name: "default-redis", Port: 1025},
+			},
+		},
+	}
+
+	var patches []string
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(svc).WithInterceptorFuncs(interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			data, _ := patch.Data(obj)
+			patches = append(patches, string(data))
+			return c.Patch(ctx, obj, patch, opts...)
+		},
+	}).Build()
+
+	r := &TCPIngressMappingReconciler{Client: c}
+	tcpmap := &v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+
+	// A port with the same number registered for another backend is kept
+	if err := r.removeUnmanagedFrontendPort(context.TODO(), tcpmap, svc.DeepCopy(), 1025, "default-db"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(patches) != 0 {
+		t.Fatalf("expected no patch without a matching port, got %v", patches)
+	}
+
+	// The service is fetched again, hence a stale revision is not an issue
+	if err := r.removeUnmanagedFrontendPort(context.TODO(), tcpmap, svc.DeepCopy(), 1024, "default-db"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(patches) != 1 || !strings.Contains(patches[0], `"resourceVersion"`) {
+		t.Fatalf("expected a single merge patch with an optimistic lock, got %v", patches)
+	}
+
+	var latest v1.Service
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(svc), &latest); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(latest.Spec.Ports) != 2 || latest.Spec.Ports[0].Port != 80 || latest.Spec.Ports[1].Port != 1025 {
+		t.Errorf("expected only port 1024 to be removed, got %v", latest.Spec.Ports)
+	}
+}
+
+func TestRemoveUnmanagedConfigMapKey(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "tcp-services"},
+		Data: map[string]string{
+			"1024": "default/db:5432:PROXY",
+			"1025": "default/redis:6379",
+		},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cm).Build()
+	r := &TCPIngressMappingReconciler{Client: c}
+	tcpmap := &v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+
+	// A key pointing to another backend is kept
+	if err := r.removeUnmanagedConfigMapKey(context.TODO(), tcpmap, cm.DeepCopy(), "1025", "default/db"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.removeUnmanagedConfigMapKey(context.TODO(), tcpmap, cm.DeepCopy(), "1024", "default/db"); err != nil {
+		t.Fatal(err)
+	}
+
+	var latest v1.ConfigMap
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(cm), &latest); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := latest.Data["1024"]; ok || latest.Data["1025"] != "default/redis:6379" {
+		t.Errorf("expected only key 1024 to be removed, got %v", latest.Data)
+	}
+}
+
+func TestManagedBy(t *testing.T) {
+	managedFields := []metav1.ManagedFieldsEntry{
+		{Manager: "tcpmap-controller/default/db", Operation: metav1.ManagedFieldsOperationUpdate},
+		{Manager: "tcpmap-controller/default/redis", Operation: metav1.ManagedFieldsOperationApply},
+	}
+
+	if managedBy(managedFields, "tcpmap-controller/default/db") {
+		t.Error("expected fields updated without server-side apply not to be managed")
+	}
+
+	if !managedBy(managedFields, "tcpmap-controller/default/redis") {
+		t.Error("expected applied fields to be managed")
+	}
+
+	if managedBy(managedFields, "tcpmap-controller/default/mq") {
+		t.Error("expected fields of another manager not to be managed")
+	}
+}
+
+// publishFixture returns the objects a mapping of default/db is published with on ingress/nginx
+func publishFixture(tcpmap *v1beta1.TCPIngressMapping, frontendPorts []v1.ServicePort, data map[string]string) []client.Object {
+	postgres := "postgres"
+	return []client.Object{
+		tcpmap,
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "postgres", Port: 5432}}},
+		},
+		endpointSlice("db-1", "db", &postgres, nil),
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "nginx"},
+			Spec:       v1.ServiceSpec{Ports: frontendPorts},
+		},
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "tcp-services"},
+			Data:       data,
+		},
+	}
+}
+
+func TestReconcileAdoptsLegacyEntry(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	tcpmap := &v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Spec: v1beta1.TCPIngressMappingSpec{
+			BackendService: v1beta1.BackendService{Name: "db", Port: intstr.FromString("postgres")},
+		},
+	}
+
+	// Registered by a previous version of the controller without server-side apply
+	objects := publishFixture(tcpmap,
+		[]v1.ServicePort{{Name: "default-db", Port: 1030, TargetPort: intstr.FromInt(1030), Protocol: v1.ProtocolTCP}},
+		map[string]string{"1030": "default/db:5432"},
+	)
+
+	var applied []appliedPatch
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).WithInterceptorFuncs(captureApply(&applied, nil)).Build()
+	r := &TCPIngressMappingReconciler{
+		Client:          c,
+		Recorder:        record.NewFakeRecorder(10),
+		FrontendService: "ingress/nginx",
+		TCPConfigMap:    "ingress/tcp-services",
+		MinPort:         1024,
+		MaxPort:         2048,
+	}
+
+	adopted, _, err := r.reconcile(context.TODO(), *tcpmap, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if adopted.Status.ElectedPort != 1030 {
+		t.Fatalf("expected port 1030 to be adopted, got %d", adopted.Status.ElectedPort)
+	}
+
+	if history := adopted.Status.PortHistory; len(history) != 1 || history[0].Reason != v1beta1.PortAdopted {
+		t.Errorf("expected the adoption in the port history, got %v", history)
+	}
+
+	// The legacy entries are taken over by the field manager of the mapping
+	var service, configMap bool
+	for _, patch := range applied {
+		if patch.manager != fieldManagerFor(*tcpmap) {
+			t.Errorf("expected field manager %s, got %s", fieldManagerFor(*tcpmap), patch.manager)
+		}
+
+		switch patch.kind {
+		case "Service":
+			service = strings.Contains(string(patch.data), `"port":1030`)
+		case "ConfigMap":
+			configMap = strings.Contains(string(patch.data), `"1030":"default/db:5432`)
+		}
+	}
+
+	if !service || !configMap {
+		t.Errorf("expected port 1030 to be applied to the frontend service and the tcp configmap, got %v", applied)
+	}
+}
+
+func TestReconcileFieldManagerConflict(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	tcpmap := &v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Spec: v1beta1.TCPIngressMappingSpec{
+			BackendService: v1beta1.BackendService{Name: "db", Port: intstr.FromString("postgres")},
+		},
+		Status: v1beta1.TCPIngressMappingStatus{ElectedPort: 1030},
+	}
+
+	tests := []struct {
+		name string
+		kind string
+	}{
+		{name: "frontend service", kind: "Service"},
+		{name: "tcp configmap", kind: "ConfigMap"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var applied []appliedPatch
+			c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(publishFixture(tcpmap.DeepCopy(), nil, nil)...).
+				WithInterceptorFuncs(captureApply(&applied, func(obj client.Object) bool {
+					return kindOf(obj) == test.kind
+				})).Build()
+
+			r := &TCPIngressMappingReconciler{
+				Client:          c,
+				Recorder:        record.NewFakeRecorder(10),
+				FrontendService: "ingress/nginx",
+				TCPConfigMap:    "ingress/tcp-services",
+				MinPort:         1024,
+				MaxPort:         2048,
+			}
+
+			conflicted, result, err := r.reconcile(context.TODO(), *tcpmap, logr.Discard())
+			if err != nil {
+				t.Fatalf("expected a conflict not to be returned as error, got %v", err)
+			}
+
+			if !result.Requeue {
+				t.Error("expected the mapping to be requeued")
+			}
+
+			if ready := apimeta.FindStatusCondition(conflicted.Status.Conditions, v1beta1.ReadyCondition); ready == nil || ready.Reason != v1beta1.FieldManagerConflictReason {
+				t.Errorf("expected the Ready reason %s, got %v", v1beta1.FieldManagerConflictReason, ready)
+			}
+		})
+	}
+}
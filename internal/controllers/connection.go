@@ -0,0 +1,217 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// ConnectionLabel is set on the secrets and configmaps holding the connection details of a mapping
+const ConnectionLabel = "tcpmap.infra.doodle.com/connection"
+
+// Keys of the connection details
+const (
+	ConnectionHostKey       = "host"
+	ConnectionPortKey       = "port"
+	ConnectionProtocolKey   = "protocol"
+	ConnectionServerNameKey = "serverName"
+	ConnectionCAKey         = "ca.crt"
+)
+
+// connectionTargetKind returns the kind of object the connection details of a mapping are written to
+func connectionTargetKind(target v1beta1.ConnectionTarget) v1beta1.ConnectionTargetKind {
+	if target.Kind == "" {
+		return v1beta1.ConnectionTargetSecret
+	}
+
+	return target.Kind
+}
+
+// externalAddress returns the address of a frontend service reachable from outside of the cluster, empty while it is pending
+func externalAddress(svc v1.Service) string {
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			return ingress.IP
+		}
+
+		if ingress.Hostname != "" {
+			return ingress.Hostname
+		}
+	}
+
+	if len(svc.Spec.ExternalIPs) > 0 {
+		return svc.Spec.ExternalIPs[0]
+	}
+
+	return ""
+}
+
+// connectionHost returns the host clients connect to, the in-cluster address of the frontend service unless it is exposed
+// by a load balancer or external IPs. Empty is returned while the load balancer is pending.
+func (r *TCPIngressMappingReconciler) connectionHost(svc v1.Service) string {
+	if host := externalAddress(svc); host != "" || svc.Spec.Type == v1.ServiceTypeLoadBalancer {
+		return host
+	}
+
+	return fmt.Sprintf("%s.%s.svc.%s", svc.Name, svc.Namespace, r.clusterDomain())
+}
+
+// connectionDetails returns how clients reach the published port of a mapping.
+// The CA is taken from the ca.crt key of the TLS secret if TLS is terminated at the frontend.
+func (r *TCPIngressMappingReconciler) connectionDetails(ctx context.Context, tcpmap v1beta1.TCPIngressMapping, frontendService v1.Service, port int32) (map[string]string, error) {
+	data := map[string]string{
+		ConnectionHostKey:     r.connectionHost(frontendService),
+		ConnectionPortKey:     strconv.Itoa(int(port)),
+		ConnectionProtocolKey: "tcp",
+	}
+
+	if tcpmap.Spec.TLS == nil {
+		return data, nil
+	}
+
+	data[ConnectionProtocolKey] = "tls"
+	if tcpmap.Spec.TLS.Hostname != "" {
+		data[ConnectionServerNameKey] = tcpmap.Spec.TLS.Hostname
+	}
+
+	if tcpservices.TerminatesTLS(tcpmap) && tcpmap.Spec.TLS.SecretRef != nil {
+		var secret v1.Secret
+		key := types.NamespacedName{Namespace: tcpmap.Namespace, Name: tcpmap.Spec.TLS.SecretRef.Name}
+		if err := r.Client.Get(ctx, key, &secret); err != nil {
+			return nil, err
+		}
+
+		if ca, ok := secret.Data[ConnectionCAKey]; ok {
+			data[ConnectionCAKey] = string(ca)
+		}
+	}
+
+	return data, nil
+}
+
+// writeConnection creates or updates the secret or configmap holding the connection details of a mapping.
+// The object previously written for the mapping is removed if it is not the target anymore.
+// False is returned while the load balancer of the frontend service is pending, nothing is written until then.
+func (r *TCPIngressMappingReconciler) writeConnection(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, frontendService v1.Service, port int32) (bool, error) {
+	target := tcpmap.Spec.WriteConnectionTo
+	if target != nil {
+		data, err := r.connectionDetails(ctx, *tcpmap, frontendService, port)
+		if err != nil {
+			return false, err
+		}
+
+		if data[ConnectionHostKey] == "" {
+			return false, nil
+		}
+
+		meta := metav1.ObjectMeta{Namespace: tcpmap.Namespace, Name: target.Name}
+		var obj client.Object
+		var mutateData func()
+
+		switch connectionTargetKind(*target) {
+		case v1beta1.ConnectionTargetConfigMap:
+			cm := &v1.ConfigMap{ObjectMeta: meta}
+			obj, mutateData = cm, func() {
+				cm.Data = data
+			}
+		default:
+			secret := &v1.Secret{ObjectMeta: meta}
+			obj, mutateData = secret, func() {
+				secret.Type = v1.SecretTypeOpaque
+				secret.StringData = nil
+				secret.Data = make(map[string][]byte, len(data))
+				for k, v := range data {
+					secret.Data[k] = []byte(v)
+				}
+			}
+		}
+
+		mutate := func() error {
+			if obj.GetResourceVersion() != "" && !metav1.IsControlledBy(obj, tcpmap) {
+				return fmt.Errorf("%s %s/%s exists but is not owned by the mapping", connectionTargetKind(*target), meta.Namespace, meta.Name)
+			}
+
+			labels := obj.GetLabels()
+			if labels == nil {
+				labels = make(map[string]string)
+			}
+
+			labels[ConnectionLabel] = tcpmap.Name
+			obj.SetLabels(labels)
+			mutateData()
+			return controllerutil.SetControllerReference(tcpmap, obj, r.Scheme)
+		}
+
+		if r.DryRun {
+			r.recordPlan(tcpmap, []string{fmt.Sprintf("%s %s/%s: write connection details %s:%s", connectionTargetKind(*target), meta.Namespace, meta.Name, data[ConnectionHostKey], data[ConnectionPortKey])})
+			return true, mutate()
+		}
+
+		if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, obj, mutate); err != nil {
+			return false, err
+		}
+	}
+
+	if err := r.removeConnection(ctx, tcpmap, target); err != nil {
+		return false, err
+	}
+
+	if !r.DryRun {
+		tcpmap.Status.Connection = target.DeepCopy()
+	}
+
+	return true, nil
+}
+
+// removeConnection deletes the object the connection details of a mapping have been written to unless it is still the target
+func (r *TCPIngressMappingReconciler) removeConnection(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, target *v1beta1.ConnectionTarget) error {
+	written := tcpmap.Status.Connection
+	if written == nil || r.DryRun {
+		return nil
+	}
+
+	if target != nil && connectionTargetKind(*target) == connectionTargetKind(*written) && target.Name == written.Name {
+		return nil
+	}
+
+	var obj client.Object = &v1.Secret{}
+	if connectionTargetKind(*written) == v1beta1.ConnectionTargetConfigMap {
+		obj = &v1.ConfigMap{}
+	}
+
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: tcpmap.Namespace, Name: written.Name}, obj); client.IgnoreNotFound(err) != nil {
+		return err
+	} else if err == nil && metav1.IsControlledBy(obj, tcpmap) {
+		if err := r.Client.Delete(ctx, obj); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	tcpmap.Status.Connection = nil
+	return nil
+}
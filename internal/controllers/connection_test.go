@@ -0,0 +1,179 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func TestWriteConnection(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	tcpmap := &v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db", UID: "uid"},
+		Spec: v1beta1.TCPIngressMappingSpec{
+			TLS:               &v1beta1.TLS{Mode: v1beta1.TLSTerminate, SecretRef: &v1beta1.LocalObjectReference{Name: "tls"}},
+			WriteConnectionTo: &v1beta1.ConnectionTarget{Name: "db-connection"},
+		},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		tcpmap,
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tls"},
+			Data:       map[string][]byte{v1.TLSCertKey: []byte("crt"), v1.TLSPrivateKeyKey: []byte("key"), ConnectionCAKey: []byte("ca")},
+		},
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foreign"},
+		},
+	).Build()
+
+	r := &TCPIngressMappingReconciler{Client: c, Scheme: scheme}
+	frontend := v1.Service{
+		Status: v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "203.0.113.10"}}}},
+	}
+
+	// Nothing is written while the load balancer is pending
+	if written, err := r.writeConnection(context.TODO(), tcpmap, v1.Service{Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, ClusterIP: "10.0.0.1"}}, 1025); err != nil || written {
+		t.Fatalf("expected no connection details without an external address, got %v, %v", written, err)
+	}
+
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "db-connection"}, &v1.Secret{}); !kerrors.IsNotFound(err) {
+		t.Errorf("expected no secret while pending, got %v", err)
+	}
+
+	if _, err := r.writeConnection(context.TODO(), tcpmap, frontend, 1025); err != nil {
+		t.Fatal(err)
+	}
+
+	if tcpmap.Status.Connection == nil || tcpmap.Status.Connection.Name != "db-connection" {
+		t.Errorf("expected the written secret in the status, got %v", tcpmap.Status.Connection)
+	}
+
+	var secret v1.Secret
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "db-connection"}, &secret); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"host": "203.0.113.10", "port": "1025", "protocol": "tls", "ca.crt": "ca"}
+	for k, v := range expected {
+		if string(secret.Data[k]) != v {
+			t.Errorf("expected %s=%q, got %q", k, v, secret.Data[k])
+		}
+	}
+
+	if !metav1.IsControlledBy(&secret, tcpmap) {
+		t.Error("expected the secret to be owned by the mapping")
+	}
+
+	// Switching to a configmap removes the secret written before
+	tcpmap.Spec.TLS = nil
+	tcpmap.Spec.WriteConnectionTo = &v1beta1.ConnectionTarget{Kind: v1beta1.ConnectionTargetConfigMap, Name: "db-connection"}
+	if _, err := r.writeConnection(context.TODO(), tcpmap, frontend, 1026); err != nil {
+		t.Fatal(err)
+	}
+
+	var cm v1.ConfigMap
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "db-connection"}, &cm); err != nil {
+		t.Fatal(err)
+	}
+
+	if cm.Data["port"] != "1026" || cm.Data["protocol"] != "tcp" {
+		t.Errorf("expected the connection details in the configmap, got %v", cm.Data)
+	}
+
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "db-connection"}, &v1.Secret{}); !kerrors.IsNotFound(err) {
+		t.Errorf("expected the secret to be removed, got %v", err)
+	}
+
+	// Objects which are not owned by the mapping are never overwritten
+	tcpmap.Spec.WriteConnectionTo.Name = "foreign"
+	if _, err := r.writeConnection(context.TODO(), tcpmap, frontend, 1026); err == nil {
+		t.Error("expected an error writing to a configmap not owned by the mapping")
+	}
+
+	// Unsetting the target removes the configmap written before
+	tcpmap.Spec.WriteConnectionTo = nil
+	if _, err := r.writeConnection(context.TODO(), tcpmap, frontend, 1026); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "db-connection"}, &v1.ConfigMap{}); !kerrors.IsNotFound(err) {
+		t.Errorf("expected the configmap to be removed, got %v", err)
+	}
+
+	if tcpmap.Status.Connection != nil {
+		t.Errorf("expected no connection in the status, got %v", tcpmap.Status.Connection)
+	}
+}
+
+func TestConnectionHost(t *testing.T) {
+	r := &TCPIngressMappingReconciler{}
+	meta := metav1.ObjectMeta{Namespace: "ingress", Name: "nginx"}
+
+	tests := []struct {
+		name     string
+		svc      v1.Service
+		expected string
+	}{
+		{
+			name:     "load balancer",
+			svc:      v1.Service{ObjectMeta: meta, Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer}, Status: v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{Hostname: "lb.example.com"}}}}},
+			expected: "lb.example.com",
+		},
+		{
+			name: "pending load balancer",
+			svc:  v1.Service{ObjectMeta: meta, Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer}},
+		},
+		{
+			name:     "external ip",
+			svc:      v1.Service{ObjectMeta: meta, Spec: v1.ServiceSpec{Type: v1.ServiceTypeNodePort, ExternalIPs: []string{"203.0.113.10"}}},
+			expected: "203.0.113.10",
+		},
+		{
+			name:     "node port",
+			svc:      v1.Service{ObjectMeta: meta, Spec: v1.ServiceSpec{Type: v1.ServiceTypeNodePort}},
+			expected: "nginx.ingress.svc.cluster.local",
+		},
+		{
+			name:     "cluster ip",
+			svc:      v1.Service{ObjectMeta: meta},
+			expected: "nginx.ingress.svc.cluster.local",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if host := r.connectionHost(test.svc); host != test.expected {
+				t.Errorf("expected host %q, got %q", test.expected, host)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+// recordPlan records changes which have been validated using a server-side dry-run
+// in the status of the mapping instead of applying them
+func (r *TCPIngressMappingReconciler) recordPlan(tcpmap *v1beta1.TCPIngressMapping, changes []string) {
+	if len(changes) == 0 {
+		return
+	}
+
+	tcpmap.Status.PlannedChanges = append(tcpmap.Status.PlannedChanges, changes...)
+	r.Log.Info("dry-run, changes not applied", "namespace", tcpmap.Namespace, "name", tcpmap.Name, "changes", changes)
+	r.Recorder.Event(tcpmap, v1.EventTypeNormal, v1beta1.DryRunEventReason, strings.Join(changes, "; "))
+}
+
+// diffServicePorts returns a human readable list of the port changes between two revisions of a service
+func diffServicePorts(latest, desired v1.Service) []string {
+	key := fmt.Sprintf("Service %s/%s", desired.Namespace, desired.Name)
+	var changes []string
+
+	for _, port := range latest.Spec.Ports {
+		if p, ok := findServicePort(desired, port.Port); !ok {
+			changes = append(changes, fmt.Sprintf("%s: remove port %d/%s (%s)", key, port.Port, port.Protocol, port.Name))
+		} else if p.Name != port.Name || p.TargetPort != port.TargetPort || p.Protocol != port.Protocol {
+			changes = append(changes, fmt.Sprintf("%s: change port %d/%s (%s) to %d/%s (%s) targeting %s", key, port.Port, port.Protocol, port.Name, p.Port, p.Protocol, p.Name, p.TargetPort.String()))
+		}
+	}
+
+	for _, port := range desired.Spec.Ports {
+		if _, ok := findServicePort(latest, port.Port); !ok {
+			changes = append(changes, fmt.Sprintf("%s: add port %d/%s (%s) targeting %s", key, port.Port, port.Protocol, port.Name, port.TargetPort.String()))
+		}
+	}
+
+	return changes
+}
+
+// diffConfigMapData returns a human readable list of the data changes between two revisions of a configmap
+func diffConfigMapData(latest, desired v1.ConfigMap) []string {
+	key := fmt.Sprintf("ConfigMap %s/%s", desired.Namespace, desired.Name)
+	var changes []string
+
+	for k, v := range latest.Data {
+		if d, ok := desired.Data[k]; !ok {
+			changes = append(changes, fmt.Sprintf("%s: remove %s=%s", key, k, v))
+		} else if d != v {
+			changes = append(changes, fmt.Sprintf("%s: change %s=%s to %s", key, k, v, d))
+		}
+	}
+
+	for k, v := range desired.Data {
+		if _, ok := latest.Data[k]; !ok {
+			changes = append(changes, fmt.Sprintf("%s: add %s=%s", key, k, v))
+		}
+	}
+
+	sort.Strings(changes)
+	return changes
+}
+
+// diffSecretKeys returns a human readable list of the keys changed between two revisions of a secret, the values are never included
+func diffSecretKeys(latest, desired v1.Secret) []string {
+	key := fmt.Sprintf("Secret %s/%s", desired.Namespace, desired.Name)
+	var changes []string
+
+	for k, v := range latest.Data {
+		if d, ok := desired.Data[k]; !ok {
+			changes = append(changes, fmt.Sprintf("%s: remove %s", key, k))
+		} else if string(d) != string(v) {
+			changes = append(changes, fmt.Sprintf("%s: change %s", key, k))
+		}
+	}
+
+	for k := range desired.Data {
+		if _, ok := latest.Data[k]; !ok {
+			changes = append(changes, fmt.Sprintf("%s: add %s", key, k))
+		}
+	}
+
+	sort.Strings(changes)
+	return changes
+}
+
+func findServicePort(svc v1.Service, port int32) (v1.ServicePort, bool) {
+	for _, v := range svc.Spec.Ports {
+		if v.Port == port {
+			return v, true
+		}
+	}
+
+	return v1.ServicePort{}, false
+}
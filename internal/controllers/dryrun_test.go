@@ -0,0 +1,287 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func TestDiffServicePorts(t *testing.T) {
+	port := func(port int32, name string, target int) v1.ServicePort {
+		return v1.ServicePort{Name: name, Port: port, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(target)}
+	}
+
+	service := func(ports ...v1.ServicePort) v1.Service {
+		return v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "nginx"},
+			Spec:       v1.ServiceSpec{Ports: ports},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		latest  v1.Service
+		desired v1.Service
+		changes []string
+	}{
+		{
+			name:    "unchanged",
+			latest:  service(port(80, "http", 80)),
+			desired: service(port(80, "http", 80)),
+		},
+		{
+			name:    "add",
+			latest:  service(port(80, "http", 80)),
+			desired: service(port(80, "http", 80), port(1024, "tcpmap-1024", 1024)),
+			changes: []string{"Service ingress/nginx: add port 1024/TCP (tcpmap-1024) targeting 1024"},
+		},
+		{
+			name:    "remove",
+			latest:  service(port(80, "http", 80), port(1024, "tcpmap-1024", 1024)),
+			desired: service(port(80, "http", 80)),
+			changes: []string{"Service ingress/nginx: remove port 1024/TCP (tcpmap-1024)"},
+		},
+		{
+			name:    "change",
+			latest:  service(port(1024, "tcpmap-1024", 1024)),
+			desired: service(port(1024, "tcpmap-sni", 1025)),
+			changes: []string{"Service ingress/nginx: change port 1024/TCP (tcpmap-1024) to 1024/TCP (tcpmap-sni) targeting 1025"},
+		},
+		{
+			name:    "removals and changes before additions",
+			latest:  service(port(1024, "a", 1024), port(1025, "b", 1025)),
+			desired: service(port(1026, "c", 1026), port(1025, "b", 1026)),
+			changes: []string{
+				"Service ingress/nginx: remove port 1024/TCP (a)",
+				"Service ingress/nginx: change port 1025/TCP (b) to 1025/TCP (b) targeting 1026",
+				"Service ingress/nginx: add port 1026/TCP (c) targeting 1026",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if changes := diffServicePorts(test.latest, test.desired); !reflect.DeepEqual(changes, test.changes) {
+				t.Errorf("expected changes %q, got %q", test.changes, changes)
+			}
+		})
+	}
+}
+
+func TestDiffConfigMapData(t *testing.T) {
+	configMap := func(data map[string]string) v1.ConfigMap {
+		return v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "tcp-services"},
+			Data:       data,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		latest  v1.ConfigMap
+		desired v1.ConfigMap
+		changes []string
+	}{
+		{
+			name:    "unchanged",
+			latest:  configMap(map[string]string{"1024": "default/db:5432"}),
+			desired: configMap(map[string]string{"1024": "default/db:5432"}),
+		},
+		{
+			name:    "sorted",
+			latest:  configMap(map[string]string{"1024": "default/db:5432", "1025": "default/redis:6379"}),
+			desired: configMap(map[string]string{"1025": "default/redis:6380", "1026": "default/mq:5672"}),
+			changes: []string{
+				"ConfigMap ingress/tcp-services: add 1026=default/mq:5672",
+				"ConfigMap ingress/tcp-services: change 1025=default/redis:6379 to default/redis:6380",
+				"ConfigMap ingress/tcp-services: remove 1024=default/db:5432",
+			},
+		},
+		{
+			name:    "from empty",
+			latest:  configMap(nil),
+			desired: configMap(map[string]string{"1024": "default/db:5432"}),
+			changes: []string{"ConfigMap ingress/tcp-services: add 1024=default/db:5432"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if changes := diffConfigMapData(test.latest, test.desired); !reflect.DeepEqual(changes, test.changes) {
+				t.Errorf("expected changes %q, got %q", test.changes, changes)
+			}
+		})
+	}
+}
+
+func TestDiffSecretKeys(t *testing.T) {
+	latest := v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "tls"},
+		Data:       map[string][]byte{"a.crt": []byte("a"), "b.crt": []byte("b")},
+	}
+
+	desired := v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "tls"},
+		Data:       map[string][]byte{"b.crt": []byte("secret"), "c.crt": []byte("c")},
+	}
+
+	expected := []string{
+		"Secret ingress/tls: add c.crt",
+		"Secret ingress/tls: change b.crt",
+		"Secret ingress/tls: remove a.crt",
+	}
+
+	if changes := diffSecretKeys(latest, desired); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %q without values, got %q", expected, changes)
+	}
+}
+
+func TestRecordPlan(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	r := &TCPIngressMappingReconciler{Recorder: recorder}
+	tcpmap := &v1beta1.TCPIngressMapping{}
+
+	r.recordPlan(tcpmap, nil)
+	if len(tcpmap.Status.PlannedChanges) != 0 || len(recorder.Events) != 0 {
+		t.Fatal("expected nothing to be recorded without changes")
+	}
+
+	r.recordPlan(tcpmap, []string{"a", "b"})
+	r.recordPlan(tcpmap, []string{"c"})
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(tcpmap.Status.PlannedChanges, expected) {
+		t.Errorf("expected planned changes %q, got %q", expected, tcpmap.Status.PlannedChanges)
+	}
+
+	if event := <-recorder.Events; event != "Normal "+v1beta1.DryRunEventReason+" a; b" {
+		t.Errorf("unexpected event %q", event)
+	}
+}
+
+func TestPatchDryRun(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "tcp-services"},
+		Data:       map[string]string{"1024": "default/db:5432"},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cm).Build()
+	r := &TCPIngressMappingReconciler{Client: c, Recorder: record.NewFakeRecorder(10), DryRun: true}
+	tcpmap := &v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+
+	if err := r.removeUnmanagedConfigMapKey(context.TODO(), tcpmap, cm.DeepCopy(), "1024", "default/db"); err != nil {
+		t.Fatal(err)
+	}
+
+	var latest v1.ConfigMap
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(cm), &latest); err != nil {
+		t.Fatal(err)
+	}
+
+	if latest.Data["1024"] != "default/db:5432" {
+		t.Errorf("expected the configmap to be unchanged in dry-run mode, got %v", latest.Data)
+	}
+
+	if expected := []string{"ConfigMap ingress/tcp-services: remove 1024=default/db:5432"}; !reflect.DeepEqual(tcpmap.Status.PlannedChanges, expected) {
+		t.Errorf("expected planned changes %q, got %q", expected, tcpmap.Status.PlannedChanges)
+	}
+}
+
+func TestReconcileDeleteDryRun(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	now := metav1.Now()
+	tcpmap := &v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db", Finalizers: []string{finalizer}, DeletionTimestamp: &now},
+		Spec: v1beta1.TCPIngressMappingSpec{
+			BackendService: v1beta1.BackendService{Name: "db", Port: intstr.FromInt(5432)},
+		},
+		Status: v1beta1.TCPIngressMappingStatus{ElectedPort: 1030},
+	}
+
+	// The port has been published by a controller running without --dry-run
+	frontend := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "nginx"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: frontendPortName(*tcpmap), Port: 1030, TargetPort: intstr.FromInt(1030), Protocol: v1.ProtocolTCP}}},
+	}
+
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "tcp-services"},
+		Data:       map[string]string{"1030": "default/db:5432"},
+	}
+
+	var applied []appliedPatch
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(tcpmap, frontend, cm).WithStatusSubresource(tcpmap).
+		WithInterceptorFuncs(captureApply(&applied, nil)).Build()
+
+	r := &TCPIngressMappingReconciler{
+		Client:          c,
+		Log:             logr.Discard(),
+		Recorder:        record.NewFakeRecorder(10),
+		FrontendService: "ingress/nginx",
+		TCPConfigMap:    "ingress/tcp-services",
+		DryRun:          true,
+	}
+
+	if _, err := r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(tcpmap)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var terminating v1beta1.TCPIngressMapping
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(tcpmap), &terminating); err != nil {
+		t.Fatalf("expected the mapping to be kept terminating, got %v", err)
+	}
+
+	if !containsString(terminating.Finalizers, finalizer) {
+		t.Error("expected the finalizer to be kept as the port has not been released")
+	}
+
+	expected := []string{
+		"Service ingress/nginx: remove port 1030/TCP (" + frontendPortName(*tcpmap) + ")",
+		"ConfigMap ingress/tcp-services: remove 1030=default/db:5432",
+	}
+
+	if !reflect.DeepEqual(terminating.Status.PlannedChanges, expected) {
+		t.Errorf("expected the planned cleanup %q in the status, got %q", expected, terminating.Status.PlannedChanges)
+	}
+
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(cm), cm); err != nil {
+		t.Fatal(err)
+	}
+
+	if cm.Data["1030"] != "default/db:5432" {
+		t.Errorf("expected the tcp configmap to be unchanged, got %v", cm.Data)
+	}
+}
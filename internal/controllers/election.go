@@ -0,0 +1,63 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// electPort elects a port which is neither used, held down, reserved for a suspended mapping nor the stream status port using the election strategy.
+// A port held down for the same mapping is re-issued if enabled.
+// If no port is available the duration until the next held down port expires is returned.
+func (r *TCPIngressMappingReconciler) electPort(tcpmap v1beta1.TCPIngressMapping, svc v1.Service, cm v1.ConfigMap) (port int32, reissued bool, retry time.Duration) {
+	held, next := heldPorts(parseReleasedPorts(svc.Annotations[ReleasedPortsAnnotation]), r.holdDown(svc), time.Now())
+
+	port = r.ports.elect(svc, cm, func(used *tcpservices.PortSet) int32 {
+		for _, h := range held {
+			if r.ReissueReleasedPorts && h.Mapping == objectKey(&tcpmap) && !used.Has(h.Port) {
+				reissued = true
+				return h.Port
+			}
+		}
+
+		for _, h := range held {
+			used.Add(h.Port)
+		}
+
+		for _, port := range parseSuspendedPorts(svc.Annotations[SuspendedPortsAnnotation]) {
+			used.Add(port)
+		}
+
+		// The status server of the stream snippets listens on the ingress-nginx pods as well
+		if r.IngressNginxConfigMap != "" && r.StreamStatusPort != 0 {
+			used.Add(r.StreamStatusPort)
+		}
+
+		return used.Elect(r.MinPort, r.MaxPort, r.ElectionStrategy, objectKey(&tcpmap).String())
+	})
+
+	if port == 0 {
+		return 0, false, next
+	}
+
+	return port, reissued, 0
+}
@@ -0,0 +1,182 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+// DefaultExpiryWarning is the time before the expiry of a mapping at which a warning is emitted
+const DefaultExpiryWarning = 15 * time.Minute
+
+var (
+	mappingExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tcpmap_mapping_expiry_timestamp_seconds",
+			Help: "Time at which a mapping expires, only mappings with a ttl or expiresAt are reported.",
+		},
+		[]string{"namespace", "name", "policy"},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(mappingExpiry)
+}
+
+// expiresAt returns the time a mapping expires, the earlier of ttl and expiresAt
+func expiresAt(tcpmap v1beta1.TCPIngressMapping) (time.Time, bool) {
+	var expiry time.Time
+	if tcpmap.Spec.TTL != nil && !tcpmap.CreationTimestamp.IsZero() {
+		expiry = tcpmap.CreationTimestamp.Add(tcpmap.Spec.TTL.Duration)
+	}
+
+	if tcpmap.Spec.ExpiresAt != nil && (expiry.IsZero() || tcpmap.Spec.ExpiresAt.Time.Before(expiry)) {
+		expiry = tcpmap.Spec.ExpiresAt.Time
+	}
+
+	return expiry, !expiry.IsZero()
+}
+
+// expiryPolicy returns the expiry policy of a mapping
+func expiryPolicy(tcpmap v1beta1.TCPIngressMapping) v1beta1.ExpiryPolicy {
+	if tcpmap.Spec.ExpiryPolicy == "" {
+		return v1beta1.ExpiryUnpublish
+	}
+
+	return tcpmap.Spec.ExpiryPolicy
+}
+
+// recordExpiry reports the expiry of a mapping as metric
+func recordExpiry(tcpmap v1beta1.TCPIngressMapping) {
+	forgetExpiry(objectKey(&tcpmap))
+	if expiry, ok := expiresAt(tcpmap); ok {
+		mappingExpiry.WithLabelValues(tcpmap.Namespace, tcpmap.Name, string(expiryPolicy(tcpmap))).Set(float64(expiry.Unix()))
+	}
+}
+
+// forgetExpiry removes the expiry metric of a mapping
+func forgetExpiry(key types.NamespacedName) {
+	mappingExpiry.DeletePartialMatch(prometheus.Labels{"namespace": key.Namespace, "name": key.Name})
+}
+
+// validateExpiry rejects the Delete policy on mappings controlled by another object like an annotated service.
+// The controller of the mapping would recreate it with a new creation timestamp, restarting the ttl forever.
+func validateExpiry(tcpmap v1beta1.TCPIngressMapping) (string, string) {
+	if _, ok := expiresAt(tcpmap); !ok || expiryPolicy(tcpmap) != v1beta1.ExpiryDelete {
+		return "", ""
+	}
+
+	if owner := metav1.GetControllerOf(&tcpmap); owner != nil {
+		return v1beta1.ExpiryPolicyUnsupportedReason, fmt.Sprintf("The Delete expiry policy is unsupported for a mapping controlled by %s %s, use Unpublish instead", owner.Kind, owner.Name)
+	}
+
+	return "", ""
+}
+
+// nextExpiryCheck returns the duration until the expiry warning or the expiry of a mapping is due, 0 if none is pending
+func (r *TCPIngressMappingReconciler) nextExpiryCheck(tcpmap v1beta1.TCPIngressMapping, now time.Time) time.Duration {
+	expiry, ok := expiresAt(tcpmap)
+	if !ok || !now.Before(expiry) {
+		return 0
+	}
+
+	if warning := expiry.Add(-r.ExpiryWarning); now.Before(warning) {
+		return warning.Sub(now)
+	}
+
+	return expiry.Sub(now)
+}
+
+// checkExpiry records the expiry in the status and warns about a mapping expiring within the expiry warning period.
+// It returns true if the mapping is expired.
+func (r *TCPIngressMappingReconciler) checkExpiry(tcpmap *v1beta1.TCPIngressMapping, now time.Time) bool {
+	expiry, ok := expiresAt(*tcpmap)
+	if !ok {
+		tcpmap.Status.ExpiresAt = nil
+		return false
+	}
+
+	tcpmap.Status.ExpiresAt = &metav1.Time{Time: expiry}
+	if !now.Before(expiry) {
+		return true
+	}
+
+	// The message does not change, hence repeated warnings are aggregated by the event recorder
+	if expiry.Sub(now) <= r.ExpiryWarning {
+		r.Recorder.Eventf(tcpmap, v1.EventTypeWarning, v1beta1.ExpiringReason, "Mapping expires at %s (%s)", expiry.UTC().Format(time.RFC3339), expiryPolicy(*tcpmap))
+	}
+
+	return false
+}
+
+// expire tears down an expired mapping according to its expiry policy.
+// Unpublished mappings release their port like a deleted mapping but are kept until ttl or expiresAt are changed.
+func (r *TCPIngressMappingReconciler) expire(ctx context.Context, tcpmap v1beta1.TCPIngressMapping, logger logr.Logger) (v1beta1.TCPIngressMapping, ctrl.Result, error) {
+	msg := fmt.Sprintf("Mapping expired at %s", tcpmap.Status.ExpiresAt.UTC().Format(time.RFC3339))
+
+	if expiryPolicy(tcpmap) == v1beta1.ExpiryDelete {
+		if r.DryRun {
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.ExpiredReason, msg+", deletion skipped in dry-run mode"), ctrl.Result{}, nil
+		}
+
+		logger.Info("deleting expired mapping")
+		r.Recorder.Event(&tcpmap, v1.EventTypeNormal, v1beta1.ExpiredReason, msg+", deleting")
+		if err := r.Delete(ctx, &tcpmap); client.IgnoreNotFound(err) != nil {
+			return tcpmap, ctrl.Result{}, err
+		}
+
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.ExpiredReason, msg), ctrl.Result{}, nil
+	}
+
+	// Nothing left to tear down
+	if ready := apimeta.FindStatusCondition(tcpmap.Status.Conditions, v1beta1.ReadyCondition); ready != nil &&
+		ready.Reason == v1beta1.ExpiredReason && tcpmap.Status.ElectedPort == 0 {
+		return tcpmap, ctrl.Result{}, nil
+	}
+
+	tcpmap, result, err := r.cleanup(ctx, tcpmap)
+	if err != nil {
+		return tcpmap, result, err
+	}
+
+	// The connection details point to the released port
+	if err := r.removeConnection(ctx, &tcpmap, nil); err != nil {
+		return tcpmap, ctrl.Result{}, err
+	}
+
+	if !r.DryRun {
+		tcpmap.Status.ElectedPort = 0
+	}
+
+	logger.Info("unpublished expired mapping")
+	r.Recorder.Event(&tcpmap, v1.EventTypeNormal, v1beta1.ExpiredReason, msg+", unpublished")
+	return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.ExpiredReason, msg), ctrl.Result{}, nil
+}
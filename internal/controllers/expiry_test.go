@@ -0,0 +1,174 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func TestExpiresAt(t *testing.T) {
+	created := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	mapping := func(ttl time.Duration, at time.Time) v1beta1.TCPIngressMapping {
+		tcpmap := v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.Time{Time: created}}}
+		if ttl > 0 {
+			tcpmap.Spec.TTL = &metav1.Duration{Duration: ttl}
+		}
+
+		if !at.IsZero() {
+			tcpmap.Spec.ExpiresAt = &metav1.Time{Time: at}
+		}
+
+		return tcpmap
+	}
+
+	tests := []struct {
+		name   string
+		tcpmap v1beta1.TCPIngressMapping
+		expiry time.Time
+	}{
+		{name: "no expiry", tcpmap: mapping(0, time.Time{})},
+		{name: "ttl", tcpmap: mapping(time.Hour, time.Time{}), expiry: created.Add(time.Hour)},
+		{name: "expiresAt", tcpmap: mapping(0, created.Add(time.Minute)), expiry: created.Add(time.Minute)},
+		{name: "ttl first", tcpmap: mapping(time.Hour, created.Add(2*time.Hour)), expiry: created.Add(time.Hour)},
+		{name: "expiresAt first", tcpmap: mapping(time.Hour, created.Add(time.Minute)), expiry: created.Add(time.Minute)},
+	}
+
+	for _, test := range tests {
+		expiry, ok := expiresAt(test.tcpmap)
+		if ok != !test.expiry.IsZero() || !expiry.Equal(test.expiry) {
+			t.Errorf("%s: expected expiry %s, got %s (%t)", test.name, test.expiry, expiry, ok)
+		}
+	}
+}
+
+func TestCheckExpiry(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	recorder := record.NewFakeRecorder(10)
+	r := &TCPIngressMappingReconciler{Recorder: recorder, ExpiryWarning: 15 * time.Minute}
+
+	tcpmap := v1beta1.TCPIngressMapping{
+		Spec: v1beta1.TCPIngressMappingSpec{ExpiresAt: &metav1.Time{Time: now.Add(time.Hour)}},
+	}
+
+	if r.checkExpiry(&tcpmap, now) || tcpmap.Status.ExpiresAt == nil || len(recorder.Events) != 0 {
+		t.Errorf("expected the expiry to be reported without warning, got status %v and %d events", tcpmap.Status.ExpiresAt, len(recorder.Events))
+	}
+
+	if next := r.nextExpiryCheck(tcpmap, now); next != 45*time.Minute {
+		t.Errorf("expected the warning to be due in 45m, got %s", next)
+	}
+
+	if r.checkExpiry(&tcpmap, now.Add(50*time.Minute)) || len(recorder.Events) != 1 {
+		t.Errorf("expected a warning shortly before the expiry, got %d events", len(recorder.Events))
+	}
+
+	if next := r.nextExpiryCheck(tcpmap, now.Add(50*time.Minute)); next != 10*time.Minute {
+		t.Errorf("expected the expiry to be due in 10m, got %s", next)
+	}
+
+	if !r.checkExpiry(&tcpmap, now.Add(time.Hour)) || r.nextExpiryCheck(tcpmap, now.Add(time.Hour)) != 0 {
+		t.Error("expected the mapping to be expired")
+	}
+
+	tcpmap.Spec.ExpiresAt = nil
+	if r.checkExpiry(&tcpmap, now) || tcpmap.Status.ExpiresAt != nil {
+		t.Error("expected the expiry to be removed from the status")
+	}
+}
+
+func TestValidateExpiry(t *testing.T) {
+	controlled := metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{{Kind: "Service", Name: "postgres", Controller: &[]bool{true}[0]}}}
+	ttl := &metav1.Duration{Duration: time.Hour}
+
+	tests := []struct {
+		name   string
+		tcpmap v1beta1.TCPIngressMapping
+		reason string
+	}{
+		{name: "delete", tcpmap: v1beta1.TCPIngressMapping{Spec: v1beta1.TCPIngressMappingSpec{TTL: ttl, ExpiryPolicy: v1beta1.ExpiryDelete}}},
+		{name: "controlled unpublish", tcpmap: v1beta1.TCPIngressMapping{ObjectMeta: controlled, Spec: v1beta1.TCPIngressMappingSpec{TTL: ttl}}},
+		{name: "controlled without expiry", tcpmap: v1beta1.TCPIngressMapping{ObjectMeta: controlled, Spec: v1beta1.TCPIngressMappingSpec{ExpiryPolicy: v1beta1.ExpiryDelete}}},
+		{name: "controlled delete", tcpmap: v1beta1.TCPIngressMapping{ObjectMeta: controlled, Spec: v1beta1.TCPIngressMappingSpec{TTL: ttl, ExpiryPolicy: v1beta1.ExpiryDelete}}, reason: v1beta1.ExpiryPolicyUnsupportedReason},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.tcpmap.CreationTimestamp = metav1.Now()
+			if reason, _ := validateExpiry(test.tcpmap); reason != test.reason {
+				t.Errorf("expected reason %q, got %q", test.reason, reason)
+			}
+		})
+	}
+}
+
+func TestExpireDelete(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	tcpmap := &v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Spec: v1beta1.TCPIngressMappingSpec{
+			ExpiresAt:    &metav1.Time{Time: time.Now().Add(-time.Minute)},
+			ExpiryPolicy: v1beta1.ExpiryDelete,
+		},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(tcpmap).Build()
+	r := &TCPIngressMappingReconciler{Client: c, Recorder: record.NewFakeRecorder(10)}
+
+	if !r.checkExpiry(tcpmap, time.Now()) {
+		t.Fatal("expected the mapping to be expired")
+	}
+
+	r.DryRun = true
+	if _, _, err := r.expire(context.TODO(), *tcpmap, logr.Discard()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(tcpmap), &v1beta1.TCPIngressMapping{}); err != nil {
+		t.Errorf("expected the mapping to be kept in dry-run mode: %v", err)
+	}
+
+	r.DryRun = false
+	expired, _, err := r.expire(context.TODO(), *tcpmap, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(tcpmap), &v1beta1.TCPIngressMapping{}); !kerrors.IsNotFound(err) {
+		t.Errorf("expected the mapping to be deleted, got %v", err)
+	}
+
+	if ready := expired.Status.Conditions; len(ready) != 1 || ready[0].Reason != v1beta1.ExpiredReason {
+		t.Errorf("expected the Expired reason, got %v", ready)
+	}
+}
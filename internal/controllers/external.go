@@ -0,0 +1,85 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+// externalPortName is the name of the port of a service pointing to an external backend
+const externalPortName = "tcp"
+
+// mirrorExternalBackend creates or updates the service pointing to the external backend of a mapping.
+// A DNS name results in an ExternalName service while an IP address results in a selector-less service with an EndpointSlice.
+func (r *TCPIngressMappingReconciler) mirrorExternalBackend(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping) (v1.Service, error) {
+	external := tcpmap.Spec.BackendService.External
+	ports := []v1.ServicePort{
+		{
+			Name:       externalPortName,
+			Protocol:   v1.ProtocolTCP,
+			Port:       external.Port,
+			TargetPort: intstr.FromInt(int(external.Port)),
+		},
+	}
+
+	ip := net.ParseIP(external.Host)
+	if ip == nil {
+		return r.mirrorBackend(ctx, tcpmap, external.Host, ports, nil)
+	}
+
+	return r.mirrorBackend(ctx, tcpmap, "", ports, []discoveryv1.EndpointSlice{externalEndpointSlice(ip, external.Port)})
+}
+
+// externalEndpointSlice returns an endpointslice with a single ready endpoint
+func externalEndpointSlice(ip net.IP, port int32) discoveryv1.EndpointSlice {
+	addressType := discoveryv1.AddressTypeIPv4
+	if ip.To4() == nil {
+		addressType = discoveryv1.AddressTypeIPv6
+	}
+
+	name := externalPortName
+	protocol := v1.ProtocolTCP
+	ready := true
+
+	return discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "external",
+		},
+		AddressType: addressType,
+		Endpoints: []discoveryv1.Endpoint{
+			{
+				Addresses:  []string{ip.String()},
+				Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+			},
+		},
+		Ports: []discoveryv1.EndpointPort{
+			{
+				Name:     &name,
+				Protocol: &protocol,
+				Port:     &port,
+			},
+		},
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func TestMirrorExternalBackend(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	tcpmap := &v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "rds", UID: "uid"},
+		Spec: v1beta1.TCPIngressMappingSpec{
+			BackendService: v1beta1.BackendService{
+				External: &v1beta1.ExternalBackend{Host: "10.0.0.10", Port: 5432},
+			},
+		},
+	}
+
+	hub := fake.NewClientBuilder().WithScheme(scheme).WithObjects(tcpmap).Build()
+	r := &TCPIngressMappingReconciler{Client: hub, Scheme: scheme}
+
+	countSlices := func() int {
+		t.Helper()
+
+		var slices discoveryv1.EndpointSliceList
+		if err := hub.List(context.TODO(), &slices, client.InNamespace("default")); err != nil {
+			t.Fatal(err)
+		}
+
+		return len(slices.Items)
+	}
+
+	svc, err := r.mirrorExternalBackend(context.TODO(), tcpmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if svc.Spec.Type != v1.ServiceTypeClusterIP || len(svc.Spec.Ports) != 1 || svc.Spec.Ports[0].Port != 5432 {
+		t.Errorf("expected a selector-less service with port 5432, got %#v", svc.Spec)
+	}
+
+	ready, err := r.countReadyEndpoints(context.TODO(), svc, svc.Spec.Ports[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ready != 1 {
+		t.Errorf("expected the external address as ready endpoint, got %d", ready)
+	}
+
+	// Switching to a DNS name results in an ExternalName service without endpointslices
+	tcpmap.Spec.BackendService.External.Host = "db.example.com"
+	svc, err = r.mirrorExternalBackend(context.TODO(), tcpmap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if svc.Spec.Type != v1.ServiceTypeExternalName || svc.Spec.ExternalName != "db.example.com" {
+		t.Errorf("expected an ExternalName service pointing to db.example.com, got %#v", svc.Spec)
+	}
+
+	if n := countSlices(); n != 0 {
+		t.Errorf("expected the endpointslice of the address to be removed, got %d slices", n)
+	}
+
+	ready, err = r.countReadyEndpoints(context.TODO(), svc, svc.Spec.Ports[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ready != 1 {
+		t.Errorf("expected the external name as ready endpoint, got %d", ready)
+	}
+}
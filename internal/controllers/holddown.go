@@ -0,0 +1,183 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+const (
+	// ReleasedPortsAnnotation is written by the controller on the frontend service and holds the ports
+	// released within the hold-down period in the format port=namespace/name@release time,...
+	ReleasedPortsAnnotation = "tcpmap.infra.doodle.com/released-ports"
+
+	// HoldDownAnnotation optionally overrides the hold-down period (e.g. 10m) of a frontend service
+	HoldDownAnnotation = "tcpmap.infra.doodle.com/hold-down"
+)
+
+// releasedPort is a port which has been released by a deleted mapping
+type releasedPort struct {
+	Port       int32
+	Mapping    types.NamespacedName
+	ReleasedAt time.Time
+}
+
+// parseReleasedPorts parses the released ports annotation, invalid items are ignored
+func parseReleasedPorts(value string) []releasedPort {
+	var released []releasedPort
+	for _, item := range strings.Split(value, ",") {
+		port, rest, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+
+		mapping, at, ok := strings.Cut(rest, "@")
+		if !ok {
+			continue
+		}
+
+		p, err := tcpservices.ParsePort(port)
+		if err != nil {
+			continue
+		}
+
+		releasedAt, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			continue
+		}
+
+		released = append(released, releasedPort{
+			Port:       p,
+			Mapping:    tcpservices.ParseRef("", mapping),
+			ReleasedAt: releasedAt,
+		})
+	}
+
+	return released
+}
+
+// formatReleasedPorts formats released ports as annotation value ordered by port
+func formatReleasedPorts(released []releasedPort) string {
+	sort.Slice(released, func(i, j int) bool {
+		return released[i].Port < released[j].Port
+	})
+
+	var items []string
+	for _, r := range released {
+		items = append(items, fmt.Sprintf("%d=%s@%s", r.Port, r.Mapping, r.ReleasedAt.UTC().Format(time.RFC3339)))
+	}
+
+	return strings.Join(items, ",")
+}
+
+// heldPorts returns the released ports which are still within the hold-down period
+// and the duration until the first of them expires
+func heldPorts(released []releasedPort, holdDown time.Duration, now time.Time) ([]releasedPort, time.Duration) {
+	var held []releasedPort
+	var next time.Duration
+
+	for _, r := range released {
+		remaining := r.ReleasedAt.Add(holdDown).Sub(now)
+		if remaining <= 0 {
+			continue
+		}
+
+		if next == 0 || remaining < next {
+			next = remaining
+		}
+
+		held = append(held, r)
+	}
+
+	return held, next
+}
+
+// holdDown returns the hold-down period of a frontend service
+func (r *TCPIngressMappingReconciler) holdDown(svc v1.Service) time.Duration {
+	if v, ok := svc.Annotations[HoldDownAnnotation]; ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+
+		r.Log.Info("ignoring invalid hold-down annotation", "namespace", svc.Namespace, "name", svc.Name, "value", v)
+	}
+
+	return r.HoldDown
+}
+
+// holdDownPort records a port released by the mapping on the frontend service.
+// Records which are not held down anymore are removed at the same time.
+func (r *TCPIngressMappingReconciler) holdDownPort(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, svc *v1.Service, port int32) error {
+	return r.updateReleasedPorts(ctx, tcpmap, svc, port, func(held []releasedPort) []releasedPort {
+		return append(held, releasedPort{
+			Port:       port,
+			Mapping:    objectKey(tcpmap),
+			ReleasedAt: time.Now(),
+		})
+	})
+}
+
+// forgetReleasedPort removes the record of a port which has been re-issued
+func (r *TCPIngressMappingReconciler) forgetReleasedPort(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, svc *v1.Service, port int32) error {
+	return r.updateReleasedPorts(ctx, tcpmap, svc, port, func(held []releasedPort) []releasedPort {
+		return held
+	})
+}
+
+func (r *TCPIngressMappingReconciler) updateReleasedPorts(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, svc *v1.Service, port int32, update func(held []releasedPort) []releasedPort) error {
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(svc), svc); err != nil {
+		return err
+	}
+
+	held, _ := heldPorts(parseReleasedPorts(svc.Annotations[ReleasedPortsAnnotation]), r.holdDown(*svc), time.Now())
+	var others []releasedPort
+	for _, h := range held {
+		if h.Port != port {
+			others = append(others, h)
+		}
+	}
+
+	value := formatReleasedPorts(update(others))
+	if value == svc.Annotations[ReleasedPortsAnnotation] {
+		return nil
+	}
+
+	latest := svc.DeepCopy()
+	if value == "" {
+		delete(svc.Annotations, ReleasedPortsAnnotation)
+	} else {
+		if svc.Annotations == nil {
+			svc.Annotations = make(map[string]string)
+		}
+
+		svc.Annotations[ReleasedPortsAnnotation] = value
+	}
+
+	change := fmt.Sprintf("Service %s/%s: set annotation %s=%s", svc.Namespace, svc.Name, ReleasedPortsAnnotation, value)
+	return r.patch(ctx, tcpmap, svc, client.MergeFromWithOptions(latest, client.MergeFromWithOptimisticLock{}), []string{change})
+}
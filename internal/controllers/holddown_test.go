@@ -0,0 +1,106 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func TestReleasedPortsRoundTrip(t *testing.T) {
+	value := "1025=default/db@2023-01-01T10:00:00Z,1030=other/cache@2023-01-01T11:00:00Z"
+	released := parseReleasedPorts(value + ",invalid,1031=default/x@yesterday")
+
+	if len(released) != 2 {
+		t.Fatalf("expected 2 released ports, got %v", released)
+	}
+
+	if released[1].Mapping.Namespace != "other" || released[1].Mapping.Name != "cache" {
+		t.Errorf("unexpected mapping %s", released[1].Mapping)
+	}
+
+	if formatted := formatReleasedPorts(released); formatted != value {
+		t.Errorf("expected %q, got %q", value, formatted)
+	}
+}
+
+func TestHeldPorts(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	released := []releasedPort{
+		{Port: 1025, ReleasedAt: now.Add(-time.Hour)},
+		{Port: 1026, ReleasedAt: now.Add(-5 * time.Minute)},
+		{Port: 1027, ReleasedAt: now.Add(-8 * time.Minute)},
+	}
+
+	held, next := heldPorts(released, 10*time.Minute, now)
+	if len(held) != 2 || held[0].Port != 1026 || held[1].Port != 1027 {
+		t.Errorf("unexpected held ports %v", held)
+	}
+
+	if next != 2*time.Minute {
+		t.Errorf("expected next expiry in 2m, got %s", next)
+	}
+}
+
+func TestElectPort(t *testing.T) {
+	released := formatReleasedPorts([]releasedPort{
+		{Port: 1025, Mapping: objectKey(&metav1.ObjectMeta{Namespace: "default", Name: "db"}), ReleasedAt: time.Now()},
+		{Port: 1026, Mapping: objectKey(&metav1.ObjectMeta{Namespace: "default", Name: "old"}), ReleasedAt: time.Now().Add(-time.Hour)},
+	})
+
+	svc := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{ReleasedPortsAnnotation: released},
+		},
+	}
+
+	tcpmap := v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+	r := &TCPIngressMappingReconciler{Log: logr.Discard(), MinPort: 1025, MaxPort: 1026, HoldDown: 10 * time.Minute}
+
+	// Elected ports are reserved until they show up on the frontend service, free them again between the elections
+	elect := func() (int32, bool, time.Duration) {
+		port, reissued, retry := r.electPort(tcpmap, svc, v1.ConfigMap{})
+		r.ports.release(svc, v1.ConfigMap{}, port)
+		return port, reissued, retry
+	}
+
+	if port, reissued, _ := elect(); port != 1026 || reissued {
+		t.Errorf("expected port 1026 to be elected, got %d (reissued=%v)", port, reissued)
+	}
+
+	r.ReissueReleasedPorts = true
+	if port, reissued, _ := elect(); port != 1025 || !reissued {
+		t.Errorf("expected port 1025 to be re-issued, got %d (reissued=%v)", port, reissued)
+	}
+
+	r.MaxPort = 1025
+	r.ReissueReleasedPorts = false
+	if port, _, retry := elect(); port != 0 || retry <= 0 || retry > 10*time.Minute {
+		t.Errorf("expected no port until the hold-down expires, got %d (retry=%s)", port, retry)
+	}
+
+	svc.Annotations[HoldDownAnnotation] = "0s"
+	if port, _, _ := elect(); port != 1025 {
+		t.Errorf("expected port 1025 with the hold-down disabled, got %d", port)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// validateLimits verifies that the limits of a mapping can be enforced by the provider.
+// The tcp services configmap of ingress-nginx has no settings per port, hence limits are rendered into a stream snippet.
+func (r *TCPIngressMappingReconciler) validateLimits(tcpmap v1beta1.TCPIngressMapping) (string, string) {
+	if !tcpservices.HasLimits(tcpmap) {
+		return "", ""
+	}
+
+	// Timeouts are enforced with a resolution of a millisecond at best by all providers
+	for _, timeout := range []*metav1.Duration{tcpmap.Spec.Limits.ConnectTimeout, tcpmap.Spec.Limits.IdleTimeout} {
+		if timeout != nil && timeout.Duration < time.Millisecond {
+			return v1beta1.LimitsUnsupportedReason, "connectTimeout and idleTimeout must be at least 1ms"
+		}
+	}
+
+	switch r.Provider {
+	// Envoy has no limits per client address
+	case ProviderEnvoy:
+		if tcpmap.Spec.Limits.MaxConnections != 0 || tcpmap.Spec.Limits.ConnectionRate != 0 {
+			return v1beta1.LimitsUnsupportedReason, "The envoy provider only supports connectTimeout and idleTimeout"
+		}
+
+		return "", ""
+	case ProviderProxy:
+		if tcpmap.Spec.Limits.ConnectionRate != 0 {
+			return v1beta1.LimitsUnsupportedReason, "The tcpmap-proxy provider can not limit the connection rate"
+		}
+
+		return "", ""
+	}
+
+	switch {
+	case r.StreamSnippetConfigMap == "" || r.IngressNginxConfigMap == "":
+		return v1beta1.LimitsUnsupportedReason, "Limits can not be enforced by the tcp services configmap of ingress-nginx, --stream-snippet-configmap and --ingress-nginx-configmap are required"
+	case tcpservices.RoutesBySNI(tcpmap):
+		return v1beta1.LimitsUnsupportedReason, "Limits are not supported for mappings sharing a port routed by SNI"
+	case tcpmap.Spec.Limits.ConnectionRate != 0:
+		return v1beta1.LimitsUnsupportedReason, "The nginx stream module can not limit the connection rate"
+	}
+
+	return "", ""
+}
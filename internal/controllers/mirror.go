@@ -0,0 +1,182 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+const (
+	// MappingLabel is set on services and endpointslices which mirror the backend of a mapping
+	MappingLabel = "tcpmap.infra.doodle.com/mapping"
+
+	// endpointSliceManager is the value of the managed-by label of mirrored endpointslices
+	endpointSliceManager = "tcpmap-controller"
+)
+
+// mirrorBackend creates or updates a selector-less service owned by the mapping together with
+// the given endpointslices. Endpointslices previously mirrored which are not given anymore are removed.
+// If an external name is given an ExternalName service is created instead.
+// In dry-run mode nothing gets written and the desired service is returned.
+func (r *TCPIngressMappingReconciler) mirrorBackend(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, externalName string, ports []v1.ServicePort, slices []discoveryv1.EndpointSlice) (v1.Service, error) {
+	key := tcpservices.BackendServiceKey(*tcpmap)
+	svc := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      key.Name,
+			Namespace: key.Namespace,
+		},
+	}
+
+	mutate := func() error {
+		if svc.ResourceVersion != "" && !metav1.IsControlledBy(&svc, tcpmap) {
+			return fmt.Errorf("service %s exists but is not owned by the mapping", key)
+		}
+
+		if svc.Labels == nil {
+			svc.Labels = make(map[string]string)
+		}
+
+		svc.Labels[MappingLabel] = tcpmap.Name
+		svc.Spec.Selector = nil
+		svc.Spec.Ports = mirrorServicePorts(ports)
+
+		switch {
+		case externalName != "":
+			svc.Spec.Type = v1.ServiceTypeExternalName
+			svc.Spec.ExternalName = externalName
+			svc.Spec.ClusterIP = ""
+			svc.Spec.ClusterIPs = nil
+			svc.Spec.IPFamilies = nil
+			svc.Spec.IPFamilyPolicy = nil
+		case svc.Spec.Type == v1.ServiceTypeExternalName:
+			svc.Spec.Type = v1.ServiceTypeClusterIP
+			svc.Spec.ExternalName = ""
+		case svc.Spec.Type == "":
+			svc.Spec.Type = v1.ServiceTypeClusterIP
+		}
+
+		return controllerutil.SetControllerReference(tcpmap, &svc, r.Scheme)
+	}
+
+	if r.DryRun {
+		r.recordPlan(tcpmap, []string{fmt.Sprintf("Service %s: mirror backend with %d endpointslices", key, len(slices))})
+		return svc, mutate()
+	}
+
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, &svc, mutate); err != nil {
+		return svc, err
+	}
+
+	desired := make(map[string]struct{}, len(slices))
+	for _, remote := range slices {
+		slice := discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      mirrorEndpointSliceName(key.Name, remote.Name),
+				Namespace: key.Namespace,
+			},
+		}
+
+		desired[slice.Name] = struct{}{}
+		_, err := controllerutil.CreateOrUpdate(ctx, r.Client, &slice, func() error {
+			if slice.Labels == nil {
+				slice.Labels = make(map[string]string)
+			}
+
+			slice.Labels[MappingLabel] = tcpmap.Name
+			slice.Labels[discoveryv1.LabelServiceName] = key.Name
+			slice.Labels[discoveryv1.LabelManagedBy] = endpointSliceManager
+			slice.AddressType = remote.AddressType
+			slice.Endpoints = mirrorEndpoints(remote.Endpoints)
+			slice.Ports = remote.Ports
+			return controllerutil.SetControllerReference(tcpmap, &slice, r.Scheme)
+		})
+
+		if err != nil {
+			return svc, err
+		}
+	}
+
+	var existing discoveryv1.EndpointSliceList
+	if err := r.List(ctx, &existing, client.InNamespace(key.Namespace), client.MatchingLabels{
+		MappingLabel:                 tcpmap.Name,
+		discoveryv1.LabelServiceName: key.Name,
+	}); err != nil {
+		return svc, err
+	}
+
+	for i, slice := range existing.Items {
+		if _, ok := desired[slice.Name]; ok || !metav1.IsControlledBy(&slice, tcpmap) {
+			continue
+		}
+
+		if err := r.Delete(ctx, &existing.Items[i]); client.IgnoreNotFound(err) != nil {
+			return svc, err
+		}
+	}
+
+	return svc, nil
+}
+
+// mirrorServicePorts returns the ports of a mirrored service
+func mirrorServicePorts(ports []v1.ServicePort) []v1.ServicePort {
+	mirrored := make([]v1.ServicePort, 0, len(ports))
+	for _, p := range ports {
+		mirrored = append(mirrored, v1.ServicePort{
+			Name:        p.Name,
+			Protocol:    p.Protocol,
+			AppProtocol: p.AppProtocol,
+			Port:        p.Port,
+			TargetPort:  p.TargetPort,
+		})
+	}
+
+	return mirrored
+}
+
+// mirrorEndpoints returns the endpoints of a mirrored endpointslice.
+// References to pods and nodes are dropped as they only exist within the source cluster.
+func mirrorEndpoints(endpoints []discoveryv1.Endpoint) []discoveryv1.Endpoint {
+	mirrored := make([]discoveryv1.Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		mirrored = append(mirrored, discoveryv1.Endpoint{
+			Addresses:  e.Addresses,
+			Conditions: e.Conditions,
+			Hostname:   e.Hostname,
+			Zone:       e.Zone,
+		})
+	}
+
+	return mirrored
+}
+
+// mirrorEndpointSliceName returns the name of the endpointslice mirroring the given one
+func mirrorEndpointSliceName(service, source string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(source))
+	return fmt.Sprintf("%s-%08x", service, h.Sum32())
+}
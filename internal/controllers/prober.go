@@ -0,0 +1,120 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+var (
+	probeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "tcpmap_probe_duration_seconds",
+			Help:    "Duration of TCP probes against the published frontend port.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+		[]string{"namespace", "name", "result"},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(probeDuration)
+}
+
+// Prober dials a published frontend port to verify it is actually reachable
+type Prober struct {
+	// Timeout for the whole probe including reading the banner
+	Timeout time.Duration
+	// Banner is the expected prefix of the first bytes sent by the backend for mappings not configuring one, ignored if empty
+	Banner string
+	// Interval at which successful mappings are probed again
+	Interval time.Duration
+}
+
+// bannerFor returns the banner expected from the backend of a mapping
+func (p *Prober) bannerFor(tcpmap v1beta1.TCPIngressMapping) string {
+	if tcpmap.Spec.Probe != nil && tcpmap.Spec.Probe.Banner != nil {
+		return *tcpmap.Spec.Probe.Banner
+	}
+
+	return p.Banner
+}
+
+// Probe dials address and verifies the banner if it is not empty.
+// It returns the duration until the connection was established (and the banner was received).
+func (p *Prober) Probe(ctx context.Context, address, expectedBanner string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return time.Since(start), err
+	}
+
+	defer conn.Close()
+
+	if expectedBanner != "" {
+		if deadline, ok := ctx.Deadline(); ok {
+			if err := conn.SetReadDeadline(deadline); err != nil {
+				return time.Since(start), err
+			}
+		}
+
+		banner := make([]byte, len(expectedBanner))
+		if _, err := io.ReadFull(conn, banner); err != nil {
+			return time.Since(start), fmt.Errorf("failed to read banner: %w", err)
+		}
+
+		if string(banner) != expectedBanner {
+			return time.Since(start), fmt.Errorf("unexpected banner %q", banner)
+		}
+	}
+
+	return time.Since(start), nil
+}
+
+// frontendAddress returns the address of the frontend service which is used for probing.
+// The load balancer address is preferred over the cluster ip.
+func frontendAddress(svc v1.Service) string {
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			return ingress.IP
+		}
+
+		if ingress.Hostname != "" {
+			return ingress.Hostname
+		}
+	}
+
+	if svc.Spec.ClusterIP != v1.ClusterIPNone {
+		return svc.Spec.ClusterIP
+	}
+
+	return ""
+}
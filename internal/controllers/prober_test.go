@@ -0,0 +1,115 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func listen(t *testing.T, banner string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			_, _ = conn.Write([]byte(banner))
+			conn.Close()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestProbe(t *testing.T) {
+	addr := listen(t, "")
+	p := &Prober{Timeout: time.Second}
+
+	if _, err := p.Probe(context.TODO(), addr, ""); err != nil {
+		t.Fatalf("expected probe to succeed, got %v", err)
+	}
+}
+
+func TestProbeBanner(t *testing.T) {
+	addr := listen(t, "SSH-2.0-OpenSSH\r\n")
+
+	p := &Prober{Timeout: time.Second}
+	if _, err := p.Probe(context.TODO(), addr, "SSH-2.0"); err != nil {
+		t.Fatalf("expected probe to succeed, got %v", err)
+	}
+
+	if _, err := p.Probe(context.TODO(), addr, "220 "); err == nil {
+		t.Fatal("expected probe to fail due to an unexpected banner")
+	}
+}
+
+func TestBannerFor(t *testing.T) {
+	ssh, empty := "SSH-2.0", ""
+	p := &Prober{Banner: "220 "}
+
+	tests := []struct {
+		name   string
+		probe  *v1beta1.Probe
+		banner string
+	}{
+		{name: "default", banner: "220 "},
+		{name: "default without banner", probe: &v1beta1.Probe{}, banner: "220 "},
+		{name: "mapping", probe: &v1beta1.Probe{Banner: &ssh}, banner: "SSH-2.0"},
+		{name: "disabled", probe: &v1beta1.Probe{Banner: &empty}, banner: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tcpmap := v1beta1.TCPIngressMapping{Spec: v1beta1.TCPIngressMappingSpec{Probe: test.probe}}
+			if banner := p.bannerFor(tcpmap); banner != test.banner {
+				t.Errorf("expected banner %q, got %q", test.banner, banner)
+			}
+		})
+	}
+}
+
+func TestProbeUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := l.Addr().String()
+	l.Close()
+
+	p := &Prober{Timeout: time.Second}
+	if _, err := p.Probe(context.TODO(), addr, ""); err == nil {
+		t.Fatal("expected probe to fail")
+	}
+}
@@ -0,0 +1,34 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+// Provider is the proxy serving the frontend ports of the mappings
+type Provider string
+
+const (
+	// ProviderIngressNginx publishes mappings using the tcp services configmap of ingress-nginx
+	ProviderIngressNginx Provider = "ingress-nginx"
+	// ProviderEnvoy publishes mappings to a fleet of envoy proxies using the embedded xDS server
+	ProviderEnvoy Provider = "envoy"
+	// ProviderProxy publishes mappings to the tcpmap-proxy which watches the mappings itself
+	ProviderProxy Provider = "tcpmap-proxy"
+)
+
+// usesTCPConfigMap reports whether mappings are published using a tcp configmap
+func (r *TCPIngressMappingReconciler) usesTCPConfigMap() bool {
+	return r.Provider != ProviderEnvoy && r.Provider != ProviderProxy
+}
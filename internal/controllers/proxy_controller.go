@@ -0,0 +1,141 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/proxy"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/xds"
+)
+
+// proxyRequest is the single request all changes are collapsed into as the routes are always built from all mappings
+var proxyRequest = reconcile.Request{NamespacedName: types.NamespacedName{Name: "proxy"}}
+
+// ProxyReconciler serves the mappings of the frontend service of the tcpmap-proxy.
+// It only reads from the cache, hence it runs on every replica.
+type ProxyReconciler struct {
+	Log logr.Logger
+	// Service is the frontend service (namespace/name) of this proxy
+	Service string
+	// FrontendService is the default frontend service of the controller
+	FrontendService string
+	// ProxyProtocol is the version of the PROXY protocol header sent to the backends of mappings without PROXY protocol settings
+	ProxyProtocol proxy.ProxyProtocol
+	Proxy         *proxy.Proxy
+	client.Client
+}
+
+// SetupWithManager adding controllers
+func (r *ProxyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.Add(r.Proxy); err != nil {
+		return err
+	}
+
+	enqueue := handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, o client.Object) []reconcile.Request {
+		return []reconcile.Request{proxyRequest}
+	})
+
+	needLeaderElection := false
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("proxy").
+		Watches(&v1beta1.TCPIngressMapping{}, enqueue).
+		Watches(&v1.Service{}, enqueue).
+		Watches(&discoveryv1.EndpointSlice{}, enqueue).
+		WithOptions(controller.Options{MaxConcurrentReconciles: 1, NeedLeaderElection: &needLeaderElection}).
+		Complete(r)
+}
+
+// Reconcile listens on the elected ports of all mappings of the frontend service
+func (r *ProxyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var mappings v1beta1.TCPIngressMappingList
+	if err := r.List(ctx, &mappings); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var routes []proxy.Route
+	for _, tcpmap := range mappings.Items {
+		// Suspended mappings are withdrawn, ports shared by SNI are not supported by the proxy
+		if tcpmap.Status.ElectedPort == 0 || !tcpmap.DeletionTimestamp.IsZero() || isSuspended(tcpmap) || tcpservices.RoutesBySNI(tcpmap) {
+			continue
+		}
+
+		frontend, ok := tcpservices.FrontendServiceKey(tcpmap, r.FrontendService)
+		if !ok || frontend.String() != r.Service {
+			continue
+		}
+
+		mapping, err := resolveMapping(ctx, r.Client, tcpmap)
+		if err != nil {
+			r.Log.Info("skipping mapping without backend", "namespace", tcpmap.Namespace, "name", tcpmap.Name, "error", err.Error())
+			continue
+		}
+
+		route := proxy.Route{
+			Name:           mapping.Name,
+			Port:           mapping.Port,
+			ProxyProtocol:  r.ProxyProtocol,
+			ConnectTimeout: mapping.ConnectTimeout,
+			IdleTimeout:    mapping.IdleTimeout,
+		}
+
+		// The PROXY protocol of the mapping takes precedence over the default of the proxy
+		if tcpmap.Spec.ProxyProtocol != nil {
+			route.ProxyProtocol = proxy.ProxyProtocol(mapping.UpstreamProxyProtocol)
+		}
+
+		if tcpmap.Spec.Limits != nil {
+			route.MaxConnections = tcpmap.Spec.Limits.MaxConnections
+		}
+
+		route.Endpoints = proxyEndpoints(mapping.Endpoints)
+		for _, backend := range mapping.Backends {
+			route.Backends = append(route.Backends, proxy.Backend{
+				Name:      backend.Name,
+				Weight:    int32(backend.Weight),
+				Endpoints: proxyEndpoints(backend.Endpoints),
+			})
+		}
+
+		routes = append(routes, route)
+	}
+
+	return ctrl.Result{}, r.Proxy.Sync(routes)
+}
+
+func proxyEndpoints(endpoints []xds.Endpoint) []string {
+	var addresses []string
+	for _, endpoint := range endpoints {
+		addresses = append(addresses, net.JoinHostPort(endpoint.Address, strconv.Itoa(int(endpoint.Port))))
+	}
+
+	return addresses
+}
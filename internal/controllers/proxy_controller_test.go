@@ -0,0 +1,132 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/proxy"
+)
+
+func TestProxyReconcile(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+
+			_, _ = io.WriteString(conn, "hello")
+			conn.Close()
+		}
+	}()
+
+	freePort := func() int32 {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer ln.Close()
+		return int32(ln.Addr().(*net.TCPAddr).Port)
+	}
+
+	mapping := func(name string, port int32, frontend *v1beta1.FrontendService) *v1beta1.TCPIngressMapping {
+		return &v1beta1.TCPIngressMapping{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec: v1beta1.TCPIngressMappingSpec{
+				BackendService:  v1beta1.BackendService{Name: "echo", Port: intstr.FromInt(7)},
+				FrontendService: frontend,
+			},
+			Status: v1beta1.TCPIngressMappingStatus{ElectedPort: port},
+		}
+	}
+
+	served, other := freePort(), freePort()
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		mapping("served", served, &v1beta1.FrontendService{Namespace: "ingress", Name: "proxy"}),
+		mapping("other", other, &v1beta1.FrontendService{Namespace: "ingress", Name: "other"}),
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "echo"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 7}}},
+		},
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "echo-abc",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "echo"},
+			},
+			Ports:     []discoveryv1.EndpointPort{{Port: pointer.Int32(int32(backend.Addr().(*net.TCPAddr).Port))}},
+			Endpoints: []discoveryv1.Endpoint{{Addresses: []string{"127.0.0.1"}}},
+		},
+	).Build()
+
+	r := &ProxyReconciler{
+		Client:  c,
+		Log:     logr.Discard(),
+		Service: "ingress/proxy",
+		Proxy:   proxy.New("127.0.0.1", time.Second, logr.Discard()),
+	}
+
+	defer r.Proxy.Close()
+
+	if _, err := r.Reconcile(context.TODO(), proxyRequest); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", served))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if b, _ := io.ReadAll(conn); string(b) != "hello" {
+		t.Errorf("expected the connection to be forwarded to the backend, got %q", b)
+	}
+
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", other)); err == nil {
+		t.Error("expected the port of a mapping of another frontend service not to be listened on")
+	}
+}
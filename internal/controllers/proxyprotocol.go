@@ -0,0 +1,76 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// downstreamProxyProtocol reports whether the frontend expects a PROXY protocol header from its clients.
+// The tcp configmap of ingress-nginx always expected one before the setting was introduced, hence it is the default there.
+func downstreamProxyProtocol(tcpmap v1beta1.TCPIngressMapping, provider Provider) bool {
+	if pp := tcpmap.Spec.ProxyProtocol; pp != nil && pp.Downstream != nil {
+		return *pp.Downstream
+	}
+
+	return provider == "" || provider == ProviderIngressNginx
+}
+
+// upstreamProxyProtocol returns the version of the PROXY protocol header sent to the backend, empty if none is sent
+func upstreamProxyProtocol(tcpmap v1beta1.TCPIngressMapping) v1beta1.ProxyProtocolVersion {
+	pp := tcpmap.Spec.ProxyProtocol
+	if pp == nil || !pp.Upstream {
+		return ""
+	}
+
+	if pp.Version == "" {
+		return v1beta1.ProxyProtocolV1
+	}
+
+	return pp.Version
+}
+
+// validateProxyProtocol verifies that the PROXY protocol settings of a mapping can be expressed by the provider
+func (r *TCPIngressMappingReconciler) validateProxyProtocol(tcpmap v1beta1.TCPIngressMapping) (string, string) {
+	if tcpmap.Spec.ProxyProtocol == nil {
+		return "", ""
+	}
+
+	downstream, upstream := downstreamProxyProtocol(tcpmap, r.Provider), upstreamProxyProtocol(tcpmap)
+
+	switch r.Provider {
+	// Envoy decodes both versions using a listener filter and encodes both using a transport socket
+	case ProviderEnvoy:
+		return "", ""
+	case ProviderProxy:
+		if downstream {
+			return v1beta1.ProxyProtocolUnsupportedReason, "The tcpmap-proxy provider can not accept a PROXY protocol header from downstream"
+		}
+
+		return "", ""
+	}
+
+	switch {
+	case upstream == v1beta1.ProxyProtocolV2:
+		return v1beta1.ProxyProtocolUnsupportedReason, "ingress-nginx only sends PROXY protocol v1 headers to the backend"
+	case tcpservices.RoutesBySNI(tcpmap) && upstream != "":
+		return v1beta1.ProxyProtocolUnsupportedReason, "The PROXY protocol can not be sent to the backends of mappings sharing a port routed by SNI"
+	}
+
+	return "", ""
+}
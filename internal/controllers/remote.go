@@ -0,0 +1,218 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	runtimeclient "github.com/fluxcd/pkg/runtime/client"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// kubeConfigKeys are the secret keys looked up for a kubeconfig if no key has been specified
+var kubeConfigKeys = []string{"value", "value.yaml"}
+
+// remoteClients caches the clients of remote clusters by kubeconfig secret
+type remoteClients struct {
+	mu      sync.Mutex
+	clients map[types.NamespacedName]remoteClient
+	// secrets are the kubeconfig secrets referenced by each mapping
+	secrets map[types.NamespacedName]types.NamespacedName
+}
+
+type remoteClient struct {
+	resourceVersion string
+	key             string
+	client          client.Client
+}
+
+// kubeConfigSecretKey returns the kubeconfig secret referenced by a mapping, false if the backend is not in a remote cluster
+func kubeConfigSecretKey(tcpmap v1beta1.TCPIngressMapping) (types.NamespacedName, bool) {
+	if tcpmap.Spec.BackendService.KubeConfig == nil {
+		return types.NamespacedName{}, false
+	}
+
+	return types.NamespacedName{Namespace: tcpmap.Namespace, Name: tcpmap.Spec.BackendService.KubeConfig.SecretRef.Name}, true
+}
+
+// track records the kubeconfig secret referenced by a mapping.
+// The client of a secret which is not referenced by any mapping anymore is dropped.
+func (c *remoteClients) track(tcpmap v1beta1.TCPIngressMapping) {
+	secret, ok := kubeConfigSecretKey(tcpmap)
+	if !ok {
+		c.forget(objectKey(&tcpmap))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous, tracked := c.secrets[objectKey(&tcpmap)]
+	if c.secrets == nil {
+		c.secrets = make(map[types.NamespacedName]types.NamespacedName)
+	}
+
+	c.secrets[objectKey(&tcpmap)] = secret
+	if tracked && previous != secret {
+		c.release(previous)
+	}
+}
+
+// forget removes a deleted mapping or one without a backend in a remote cluster
+func (c *remoteClients) forget(mapping types.NamespacedName) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if previous, ok := c.secrets[mapping]; ok {
+		delete(c.secrets, mapping)
+		c.release(previous)
+	}
+}
+
+// release drops the client of a kubeconfig secret unless it is still referenced by a mapping
+func (c *remoteClients) release(secret types.NamespacedName) {
+	for _, s := range c.secrets {
+		if s == secret {
+			return
+		}
+	}
+
+	delete(c.clients, secret)
+}
+
+// invalidate drops the client of a kubeconfig secret unless it has been created from the given revision
+func (c *remoteClients) invalidate(secret types.NamespacedName, resourceVersion string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.clients[secret]; ok && cached.resourceVersion != resourceVersion {
+		delete(c.clients, secret)
+	}
+}
+
+// mirrorRemoteBackend mirrors the backend service of a mapping from the remote cluster
+// referenced by its kubeconfig secret into the namespace of the mapping
+func (r *TCPIngressMappingReconciler) mirrorRemoteBackend(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping) (v1.Service, error) {
+	remote, err := r.remoteClient(ctx, *tcpmap)
+	if err != nil {
+		return v1.Service{}, err
+	}
+
+	ports, slices, err := fetchBackend(ctx, remote, tcpservices.RemoteBackendServiceKey(*tcpmap))
+	if err != nil {
+		return v1.Service{}, err
+	}
+
+	return r.mirrorBackend(ctx, tcpmap, "", ports, slices)
+}
+
+// remoteClient returns a client for the cluster referenced by the kubeconfig secret of a mapping.
+// Clients are reused until the secret changes.
+func (r *TCPIngressMappingReconciler) remoteClient(ctx context.Context, tcpmap v1beta1.TCPIngressMapping) (client.Client, error) {
+	ref := tcpmap.Spec.BackendService.KubeConfig.SecretRef
+	secretKey := types.NamespacedName{Namespace: tcpmap.Namespace, Name: ref.Name}
+
+	secret := v1.Secret{}
+	if err := r.Client.Get(ctx, secretKey, &secret); err != nil {
+		if kerrors.IsNotFound(err) {
+			r.remotes.invalidate(secretKey, "")
+		}
+
+		return nil, fmt.Errorf("failed to get kubeconfig secret %s: %w", secretKey, err)
+	}
+
+	r.remotes.mu.Lock()
+	defer r.remotes.mu.Unlock()
+
+	if c, ok := r.remotes.clients[secretKey]; ok && c.resourceVersion == secret.ResourceVersion && c.key == ref.Key {
+		return c.client, nil
+	}
+
+	kubeConfig, err := kubeConfigFromSecret(secret, ref.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	restConfig, err := clientcmd.RESTConfigFromKubeConfig(kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig in secret %s: %w", secretKey, err)
+	}
+
+	c, err := client.New(runtimeclient.KubeConfig(restConfig, r.KubeConfigOpts), client.Options{Scheme: r.Scheme})
+	if err != nil {
+		return nil, err
+	}
+
+	if r.remotes.clients == nil {
+		r.remotes.clients = make(map[types.NamespacedName]remoteClient)
+	}
+
+	r.remotes.clients[secretKey] = remoteClient{
+		resourceVersion: secret.ResourceVersion,
+		key:             ref.Key,
+		client:          c,
+	}
+
+	return c, nil
+}
+
+// kubeConfigFromSecret returns the kubeconfig stored in the given key of a secret.
+// Without a key the well known keys value and value.yaml are looked up.
+func kubeConfigFromSecret(secret v1.Secret, key string) ([]byte, error) {
+	if key != "" {
+		if v, ok := secret.Data[key]; ok {
+			return v, nil
+		}
+
+		return nil, fmt.Errorf("secret %s/%s has no key %s", secret.Namespace, secret.Name, key)
+	}
+
+	for _, k := range kubeConfigKeys {
+		if v, ok := secret.Data[k]; ok {
+			return v, nil
+		}
+	}
+
+	return nil, fmt.Errorf("secret %s/%s has none of the keys %v", secret.Namespace, secret.Name, kubeConfigKeys)
+}
+
+// fetchBackend returns the ports and endpointslices of a service
+func fetchBackend(ctx context.Context, c client.Client, key types.NamespacedName) ([]v1.ServicePort, []discoveryv1.EndpointSlice, error) {
+	svc := v1.Service{}
+	if err := c.Get(ctx, key, &svc); err != nil {
+		return nil, nil, fmt.Errorf("failed to get remote service %s: %w", key, err)
+	}
+
+	var slices discoveryv1.EndpointSliceList
+	if err := c.List(ctx, &slices, client.InNamespace(key.Namespace), client.MatchingLabels{
+		discoveryv1.LabelServiceName: key.Name,
+	}); err != nil {
+		return nil, nil, fmt.Errorf("failed to list endpointslices of remote service %s: %w", key, err)
+	}
+
+	return svc.Spec.Ports, slices.Items, nil
+}
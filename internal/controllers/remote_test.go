@@ -0,0 +1,301 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func remoteEndpointSlice(name string, addresses ...string) *discoveryv1.EndpointSlice {
+	portName := "postgres"
+	port := int32(5432)
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "db",
+			Name:      name,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "postgres"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+	}
+
+	for _, address := range addresses {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses: []string{address},
+			TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "db", Name: address},
+		})
+	}
+
+	return slice
+}
+
+func TestMirrorRemoteBackend(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	remote := fake.NewClientBuilder().WithObjects(
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "db", Name: "postgres"},
+			Spec: v1.ServiceSpec{
+				Selector: map[string]string{"app": "postgres"},
+				Ports:    []v1.ServicePort{{Name: "postgres", Port: 5432, TargetPort: intstr.FromInt(5432), Protocol: v1.ProtocolTCP}},
+			},
+		},
+		remoteEndpointSlice("postgres-a", "10.1.0.1", "10.1.0.2"),
+		remoteEndpointSlice("postgres-b", "10.1.0.3"),
+	).Build()
+
+	tcpmap := &v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db", UID: "uid"},
+		Spec: v1beta1.TCPIngressMappingSpec{
+			BackendService: v1beta1.BackendService{
+				Name:       "postgres",
+				Namespace:  "db",
+				Port:       intstr.FromString("postgres"),
+				KubeConfig: &v1beta1.KubeConfig{SecretRef: v1beta1.SecretKeyReference{Name: "spoke"}},
+			},
+		},
+	}
+
+	hub := fake.NewClientBuilder().WithScheme(scheme).WithObjects(tcpmap).Build()
+	r := &TCPIngressMappingReconciler{Client: hub, Scheme: scheme}
+
+	mirror := func() v1.Service {
+		t.Helper()
+
+		ports, slices, err := fetchBackend(context.TODO(), remote, client.ObjectKey{Namespace: "db", Name: "postgres"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		svc, err := r.mirrorBackend(context.TODO(), tcpmap, "", ports, slices)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return svc
+	}
+
+	svc := mirror()
+	if svc.Namespace != "default" || svc.Name != "tcpmap-db" {
+		t.Fatalf("expected mirror service default/tcpmap-db, got %s/%s", svc.Namespace, svc.Name)
+	}
+
+	if svc.Spec.Selector != nil || len(svc.Spec.Ports) != 1 || svc.Spec.Ports[0].Name != "postgres" {
+		t.Errorf("expected a selector-less service with port postgres, got %#v", svc.Spec)
+	}
+
+	if !metav1.IsControlledBy(&svc, tcpmap) {
+		t.Error("expected mirror service to be owned by the mapping")
+	}
+
+	ready, err := r.countReadyEndpoints(context.TODO(), svc, svc.Spec.Ports[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ready != 3 {
+		t.Errorf("expected 3 ready endpoints, got %d", ready)
+	}
+
+	var slices discoveryv1.EndpointSliceList
+	if err := hub.List(context.TODO(), &slices, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, slice := range slices.Items {
+		for _, e := range slice.Endpoints {
+			if e.TargetRef != nil {
+				t.Errorf("expected pod references to be dropped from %s", slice.Name)
+			}
+		}
+	}
+
+	// Slices removed from the remote cluster are removed from the mirror
+	if err := remote.Delete(context.TODO(), remoteEndpointSlice("postgres-b")); err != nil {
+		t.Fatal(err)
+	}
+
+	svc = mirror()
+	ready, err = r.countReadyEndpoints(context.TODO(), svc, svc.Spec.Ports[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ready != 2 {
+		t.Errorf("expected 2 ready endpoints after removing a remote slice, got %d", ready)
+	}
+}
+
+func TestMirrorBackendNotOwned(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	tcpmap := &v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db", UID: "uid"},
+		Spec: v1beta1.TCPIngressMappingSpec{
+			BackendService: v1beta1.BackendService{
+				Name:       "postgres",
+				KubeConfig: &v1beta1.KubeConfig{SecretRef: v1beta1.SecretKeyReference{Name: "spoke"}},
+			},
+		},
+	}
+
+	hub := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tcpmap-db"}},
+	).Build()
+
+	r := &TCPIngressMappingReconciler{Client: hub, Scheme: scheme}
+	if _, err := r.mirrorBackend(context.TODO(), tcpmap, "", nil, nil); err == nil {
+		t.Error("expected an existing service not owned by the mapping to be left untouched")
+	}
+}
+
+func TestKubeConfigFromSecret(t *testing.T) {
+	secret := v1.Secret{Data: map[string][]byte{
+		"value.yaml": []byte("yaml"),
+		"custom":     []byte("custom"),
+	}}
+
+	if v, err := kubeConfigFromSecret(secret, ""); err != nil || string(v) != "yaml" {
+		t.Errorf("expected value.yaml to be used, got %q, %v", v, err)
+	}
+
+	if v, err := kubeConfigFromSecret(secret, "custom"); err != nil || string(v) != "custom" {
+		t.Errorf("expected custom key to be used, got %q, %v", v, err)
+	}
+
+	if _, err := kubeConfigFromSecret(secret, "missing"); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
+
+func TestRemoteClientsEviction(t *testing.T) {
+	mapping := func(name, secret string) v1beta1.TCPIngressMapping {
+		tcpmap := v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+		if secret != "" {
+			tcpmap.Spec.BackendService.KubeConfig = &v1beta1.KubeConfig{SecretRef: v1beta1.SecretKeyReference{Name: secret}}
+		}
+
+		return tcpmap
+	}
+
+	cached := func(c *remoteClients, secret string) bool {
+		_, ok := c.clients[types.NamespacedName{Namespace: "default", Name: secret}]
+		return ok
+	}
+
+	c := &remoteClients{clients: map[types.NamespacedName]remoteClient{
+		{Namespace: "default", Name: "a"}: {resourceVersion: "1"},
+		{Namespace: "default", Name: "b"}: {resourceVersion: "1"},
+	}}
+
+	c.track(mapping("db", "a"))
+	c.track(mapping("redis", "a"))
+
+	// A is still referenced by redis
+	c.track(mapping("db", "b"))
+	if !cached(c, "a") || !cached(c, "b") {
+		t.Fatal("expected the clients of referenced secrets to be kept")
+	}
+
+	// Redis switched to a backend in the local cluster
+	c.track(mapping("redis", ""))
+	if cached(c, "a") {
+		t.Error("expected the client of an unreferenced secret to be dropped")
+	}
+
+	c.invalidate(types.NamespacedName{Namespace: "default", Name: "b"}, "1")
+	if !cached(c, "b") {
+		t.Error("expected the client to be kept for an unchanged secret")
+	}
+
+	c.invalidate(types.NamespacedName{Namespace: "default", Name: "b"}, "2")
+	if cached(c, "b") {
+		t.Error("expected the client of a changed secret to be dropped")
+	}
+
+	c.clients[types.NamespacedName{Namespace: "default", Name: "b"}] = remoteClient{resourceVersion: "2"}
+	c.forget(types.NamespacedName{Namespace: "default", Name: "db"})
+	if cached(c, "b") || len(c.secrets) != 0 {
+		t.Errorf("expected the client of a deleted mapping to be dropped, got %v", c.secrets)
+	}
+}
+
+func TestRequestsForKubeConfigSecretChange(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	tcpmap := &v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Spec: v1beta1.TCPIngressMappingSpec{
+			BackendService: v1beta1.BackendService{
+				KubeConfig: &v1beta1.KubeConfig{SecretRef: v1beta1.SecretKeyReference{Name: "kubeconfig"}},
+			},
+		},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(tcpmap).
+		WithIndex(&v1beta1.TCPIngressMapping{}, tlsSecretIndex, func(o client.Object) []string { return nil }).
+		WithIndex(&v1beta1.TCPIngressMapping{}, kubeConfigSecretIndex, func(o client.Object) []string {
+			if key, ok := kubeConfigSecretKey(*o.(*v1beta1.TCPIngressMapping)); ok {
+				return []string{key.String()}
+			}
+
+			return nil
+		}).Build()
+
+	secretKey := types.NamespacedName{Namespace: "default", Name: "kubeconfig"}
+	r := &TCPIngressMappingReconciler{Client: c}
+	r.remotes.clients = map[types.NamespacedName]remoteClient{secretKey: {resourceVersion: "1"}}
+
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kubeconfig", ResourceVersion: "2"}}
+	reqs := r.requestsForSecretChange(context.TODO(), secret)
+	if len(reqs) != 1 || reqs[0].NamespacedName != objectKey(tcpmap) {
+		t.Errorf("expected the mapping to be enqueued, got %v", reqs)
+	}
+
+	if _, ok := r.remotes.clients[secretKey]; ok {
+		t.Error("expected the client of the changed kubeconfig secret to be dropped")
+	}
+
+	// A deleted secret drops the client once the mapping is reconciled
+	r.remotes.clients[secretKey] = remoteClient{resourceVersion: "2"}
+	if _, err := r.remoteClient(context.TODO(), *tcpmap); err == nil {
+		t.Fatal("expected an error without the kubeconfig secret")
+	}
+
+	if _, ok := r.remotes.clients[secretKey]; ok {
+		t.Error("expected the client of the deleted kubeconfig secret to be dropped")
+	}
+}
@@ -0,0 +1,311 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+const (
+	// ExposeAnnotation holds a comma separated list of service ports (by name or number)
+	// which should be exposed through a TCPIngressMapping
+	ExposeAnnotation = "tcpmap.infra.doodle.com/expose"
+
+	// FrontendServiceAnnotation optionally overrides the frontend service (namespace/name) for generated mappings
+	FrontendServiceAnnotation = "tcpmap.infra.doodle.com/frontend-service"
+
+	// TCPConfigMapAnnotation optionally overrides the tcp configmap (namespace/name) for generated mappings
+	TCPConfigMapAnnotation = "tcpmap.infra.doodle.com/tcp-configmap"
+
+	// ElectedPortsAnnotation is written by the controller and holds the elected port per exposed port
+	// in the format port=electedPort, comma separated
+	ElectedPortsAnnotation = "tcpmap.infra.doodle.com/elected-ports"
+
+	// ServiceLabel is set on TCPIngressMappings generated from an annotated service
+	ServiceLabel = "tcpmap.infra.doodle.com/service"
+)
+
+type ServiceReconciler struct {
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// FrontendService is the default frontend service of the controller
+	FrontendService string
+	// Shard is the value of the shard label of the pools managed by this controller
+	Shard string
+	client.Client
+}
+
+type ServiceReconcilerOptions struct {
+	MaxConcurrentReconciles int
+}
+
+// SetupWithManager adding controllers
+func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager, opts ServiceReconcilerOptions) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("service").
+		For(&v1.Service{}, builder.WithPredicates(exposeAnnotationPredicate())).
+		Owns(&v1beta1.TCPIngressMapping{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: opts.MaxConcurrentReconciles}).
+		Complete(r)
+}
+
+// exposeAnnotationPredicate filters services which are not relevant for this controller.
+// A service which had the expose annotation removed still needs to be reconciled
+// to garbage collect the previously created mappings.
+func exposeAnnotationPredicate() predicate.Funcs {
+	hasAnnotation := func(o client.Object) bool {
+		annotations := o.GetAnnotations()
+		if _, ok := annotations[ExposeAnnotation]; ok {
+			return true
+		}
+
+		_, ok := annotations[ElectedPortsAnnotation]
+		return ok
+	}
+
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return hasAnnotation(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return hasAnnotation(e.ObjectOld) || hasAnnotation(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return false
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return hasAnnotation(e.Object)
+		},
+	}
+}
+
+// Reconcile annotated services
+func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := r.Log.WithValues("Namespace", req.Namespace, "Name", req.NamespacedName)
+	logger.Info("reconciling Service")
+
+	svc := v1.Service{}
+	err := r.Client.Get(ctx, req.NamespacedName, &svc)
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			// Generated mappings are owned by the service and get garbage collected
+			return reconcile.Result{}, nil
+		}
+
+		return reconcile.Result{}, err
+	}
+
+	if !svc.ObjectMeta.DeletionTimestamp.IsZero() {
+		return reconcile.Result{}, nil
+	}
+
+	// Services exposed on a frontend of another shard are left untouched
+	if owned, err := r.ownsService(ctx, svc); err != nil {
+		return reconcile.Result{}, err
+	} else if !owned {
+		logger.V(1).Info("frontend service belongs to another shard, skip Service")
+		return reconcile.Result{}, nil
+	}
+
+	ports := parseExposeAnnotation(svc.GetAnnotations()[ExposeAnnotation])
+	desired := make(map[string]intstr.IntOrString)
+	for _, port := range ports {
+		desired[mappingNameForServicePort(svc, port)] = port
+	}
+
+	var list v1beta1.TCPIngressMappingList
+	if err := r.List(ctx, &list, client.InNamespace(svc.Namespace), client.MatchingLabels{
+		ServiceLabel: svc.Name,
+	}); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	electedPorts := make(map[string]int32)
+	for _, tcpmap := range list.Items {
+		if !metav1.IsControlledBy(&tcpmap, &svc) {
+			continue
+		}
+
+		if _, ok := desired[tcpmap.Name]; ok {
+			continue
+		}
+
+		logger.Info("port is not exposed anymore, remove TCPIngressMapping", "mapping", tcpmap.Name)
+		tcpmap := tcpmap
+		if err := r.Delete(ctx, &tcpmap); err != nil && !kerrors.IsNotFound(err) {
+			r.Recorder.Event(&svc, v1.EventTypeWarning, v1beta1.FailedDeleteMappingEventReason, fmt.Sprintf("Failed to remove TCPIngressMapping %s", tcpmap.Name))
+			return reconcile.Result{}, err
+		}
+	}
+
+	for name, port := range desired {
+		tcpmap := v1beta1.TCPIngressMapping{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: svc.Namespace,
+			},
+		}
+
+		_, err := controllerutil.CreateOrUpdate(ctx, r.Client, &tcpmap, func() error {
+			// Never take over a mapping created by someone else
+			if tcpmap.ResourceVersion != "" && !metav1.IsControlledBy(&tcpmap, &svc) {
+				return fmt.Errorf("TCPIngressMapping %s/%s exists but is not owned by the service", tcpmap.Namespace, tcpmap.Name)
+			}
+
+			if tcpmap.Labels == nil {
+				tcpmap.Labels = make(map[string]string)
+			}
+
+			tcpmap.Labels[ServiceLabel] = svc.Name
+			tcpmap.Spec.BackendService = v1beta1.BackendService{
+				Name: svc.Name,
+				Port: port,
+			}
+
+			tcpmap.Spec.FrontendService = nil
+			if ref, ok := svc.GetAnnotations()[FrontendServiceAnnotation]; ok {
+				ns, name := splitNamespacedName(ref)
+				tcpmap.Spec.FrontendService = &v1beta1.FrontendService{
+					Name:      name,
+					Namespace: ns,
+				}
+			}
+
+			tcpmap.Spec.TCPConfigMap = nil
+			if ref, ok := svc.GetAnnotations()[TCPConfigMapAnnotation]; ok {
+				ns, name := splitNamespacedName(ref)
+				tcpmap.Spec.TCPConfigMap = &v1beta1.TCPConfigMap{
+					Name:      name,
+					Namespace: ns,
+				}
+			}
+
+			return controllerutil.SetControllerReference(&svc, &tcpmap, r.Scheme)
+		})
+
+		if err != nil {
+			r.Recorder.Event(&svc, v1.EventTypeWarning, v1beta1.FailedCreateMappingEventReason, fmt.Sprintf("Failed to create or update TCPIngressMapping %s: %s", name, err.Error()))
+			return reconcile.Result{}, err
+		}
+
+		if tcpmap.Status.ElectedPort != 0 {
+			electedPorts[port.String()] = tcpmap.Status.ElectedPort
+		}
+	}
+
+	if err := r.patchElectedPorts(ctx, svc, electedPorts); err != nil {
+		logger.Error(err, "unable to update elected ports annotation")
+		return reconcile.Result{}, err
+	}
+
+	return reconcile.Result{}, nil
+}
+
+func (r *ServiceReconciler) patchElectedPorts(ctx context.Context, svc v1.Service, electedPorts map[string]int32) error {
+	value := formatElectedPorts(electedPorts)
+	current, ok := svc.GetAnnotations()[ElectedPortsAnnotation]
+	if (ok && current == value) || (!ok && value == "") {
+		return nil
+	}
+
+	latest := svc.DeepCopy()
+	if value == "" {
+		delete(svc.Annotations, ElectedPortsAnnotation)
+	} else {
+		if svc.Annotations == nil {
+			svc.Annotations = make(map[string]string)
+		}
+
+		svc.Annotations[ElectedPortsAnnotation] = value
+	}
+
+	return r.Client.Patch(ctx, &svc, client.MergeFrom(latest))
+}
+
+// parseExposeAnnotation parses a comma separated list of port names or numbers
+func parseExposeAnnotation(value string) []intstr.IntOrString {
+	var ports []intstr.IntOrString
+	seen := make(map[string]struct{})
+
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if _, ok := seen[v]; ok {
+			continue
+		}
+
+		seen[v] = struct{}{}
+		ports = append(ports, intstr.Parse(v))
+	}
+
+	return ports
+}
+
+func formatElectedPorts(electedPorts map[string]int32) string {
+	var pairs []string
+	for port, elected := range electedPorts {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", port, strconv.Itoa(int(elected))))
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// mappingNameForServicePort returns the name of the mapping generated for a service port.
+// The name is suffixed with a hash as service and port names may contain dashes, e.g. a-b/c and a/b-c.
+func mappingNameForServicePort(svc v1.Service, port intstr.IntOrString) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(svc.Name + "/" + port.String()))
+	return strings.ToLower(fmt.Sprintf("%s-%s-%08x", svc.Name, port.String(), h.Sum32()))
+}
+
+// splitNamespacedName splits a reference in the format namespace/name or name
+func splitNamespacedName(ref string) (string, string) {
+	parts := strings.Split(ref, "/")
+	if len(parts) == 1 {
+		return "", parts[0]
+	}
+
+	return parts[0], parts[1]
+}
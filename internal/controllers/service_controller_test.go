@@ -0,0 +1,178 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func TestParseExposeAnnotation(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []intstr.IntOrString
+	}{
+		{value: "", expected: nil},
+		{value: "5432", expected: []intstr.IntOrString{intstr.FromInt(5432)}},
+		{value: " 5432, sql,5432,,", expected: []intstr.IntOrString{intstr.FromInt(5432), intstr.FromString("sql")}},
+	}
+
+	for _, test := range tests {
+		if ports := parseExposeAnnotation(test.value); !reflect.DeepEqual(ports, test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.value, test.expected, ports)
+		}
+	}
+}
+
+func TestMappingNameForServicePort(t *testing.T) {
+	svc := func(name string) v1.Service {
+		return v1.Service{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+
+	a := mappingNameForServicePort(svc("a-b"), intstr.FromString("c"))
+	b := mappingNameForServicePort(svc("a"), intstr.FromString("b-c"))
+	if a == b {
+		t.Errorf("expected distinct mapping names, got %s", a)
+	}
+
+	if name := mappingNameForServicePort(svc("Postgres"), intstr.FromInt(5432)); name != mappingNameForServicePort(svc("Postgres"), intstr.FromInt(5432)) || name[:14] != "postgres-5432-" {
+		t.Errorf("unexpected mapping name %s", name)
+	}
+}
+
+func TestServiceReconcile(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "postgres", UID: "uid", Annotations: map[string]string{
+			ExposeAnnotation:          "5432,sql",
+			FrontendServiceAnnotation: "ingress/ingress-nginx",
+		}},
+	}
+
+	// A mapping named like the generated one for the port sql which has been created by a user
+	foreign := &v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: mappingNameForServicePort(*svc, intstr.FromString("sql"))},
+		Spec:       v1beta1.TCPIngressMappingSpec{BackendService: v1beta1.BackendService{Name: "other", Port: intstr.FromInt(1)}},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(svc, foreign).Build()
+	r := &ServiceReconciler{Client: c, Scheme: scheme, Log: logr.Discard(), Recorder: record.NewFakeRecorder(10)}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "postgres"}}
+
+	if _, err := r.Reconcile(context.TODO(), req); err == nil {
+		t.Error("expected an error as the mapping of the port sql is not owned by the service")
+	}
+
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(foreign), foreign); err != nil {
+		t.Fatal(err)
+	}
+
+	if foreign.Spec.BackendService.Name != "other" || metav1.IsControlledBy(foreign, svc) {
+		t.Error("expected the mapping not owned by the service to be left untouched")
+	}
+
+	// Only expose 5432 from now on
+	if err := c.Get(context.TODO(), req.NamespacedName, svc); err != nil {
+		t.Fatal(err)
+	}
+
+	svc.Annotations[ExposeAnnotation] = "5432"
+	if err := c.Update(context.TODO(), svc); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Reconcile(context.TODO(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	var tcpmap v1beta1.TCPIngressMapping
+	key := types.NamespacedName{Namespace: "default", Name: mappingNameForServicePort(*svc, intstr.FromInt(5432))}
+	if err := c.Get(context.TODO(), key, &tcpmap); err != nil {
+		t.Fatal(err)
+	}
+
+	if !metav1.IsControlledBy(&tcpmap, svc) || tcpmap.Labels[ServiceLabel] != "postgres" {
+		t.Error("expected the mapping to be owned and labeled by the service")
+	}
+
+	if tcpmap.Spec.BackendService.Port != intstr.FromInt(5432) || tcpmap.Spec.FrontendService == nil || tcpmap.Spec.FrontendService.Namespace != "ingress" || tcpmap.Spec.FrontendService.Name != "ingress-nginx" {
+		t.Errorf("unexpected spec %#v", tcpmap.Spec)
+	}
+
+	// The elected port is written back to the service
+	tcpmap.Status.ElectedPort = 1025
+	if err := c.Update(context.TODO(), &tcpmap); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Reconcile(context.TODO(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Get(context.TODO(), req.NamespacedName, svc); err != nil {
+		t.Fatal(err)
+	}
+
+	if svc.Annotations[ElectedPortsAnnotation] != "5432=1025" {
+		t.Errorf("expected the elected ports annotation 5432=1025, got %q", svc.Annotations[ElectedPortsAnnotation])
+	}
+
+	// Removing the annotation removes the mapping and the elected ports
+	delete(svc.Annotations, ExposeAnnotation)
+	if err := c.Update(context.TODO(), svc); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Reconcile(context.TODO(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Get(context.TODO(), key, &tcpmap); !kerrors.IsNotFound(err) {
+		t.Errorf("expected the mapping to be removed, got %v", err)
+	}
+
+	if err := c.Get(context.TODO(), req.NamespacedName, svc); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := svc.Annotations[ElectedPortsAnnotation]; ok {
+		t.Error("expected the elected ports annotation to be removed")
+	}
+
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(foreign), foreign); err != nil {
+		t.Error("expected the mapping not owned by the service to be kept")
+	}
+}
@@ -0,0 +1,120 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// ShardLabel assigns a pool (frontend service and tcp configmap) to a controller shard.
+// Pools without the label are managed by the controller running without a shard.
+const ShardLabel = "tcpmap.infra.doodle.com/shard"
+
+var errShardMismatch = errors.New("object belongs to another shard")
+
+// inShard reports whether an object belongs to the shard
+func inShard(obj client.Object, shard string) bool {
+	return obj.GetLabels()[ShardLabel] == shard
+}
+
+// guardShard refuses writes to objects of another shard
+func guardShard(obj client.Object, shard string) error {
+	if inShard(obj, shard) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s/%s has %s=%q, this controller runs as shard %q", errShardMismatch, obj.GetNamespace(), obj.GetName(), ShardLabel, obj.GetLabels()[ShardLabel], shard)
+}
+
+// frontendServiceKey returns the frontend service of a mapping.
+// A sharded controller prefers the frontend service of the mapping over its default.
+func (r *TCPIngressMappingReconciler) frontendServiceKey(tcpmap v1beta1.TCPIngressMapping) (types.NamespacedName, bool) {
+	return shardedFrontendServiceKey(tcpmap, r.FrontendService, r.Shard)
+}
+
+func shardedFrontendServiceKey(tcpmap v1beta1.TCPIngressMapping, defaultRef, shard string) (types.NamespacedName, bool) {
+	if shard != "" && tcpmap.Spec.FrontendService != nil {
+		return tcpservices.FrontendServiceKey(tcpmap, "")
+	}
+
+	return tcpservices.FrontendServiceKey(tcpmap, defaultRef)
+}
+
+// tcpConfigMapKey returns the tcp configmap of a mapping.
+// A sharded controller prefers the tcp configmap of the mapping over its default.
+func (r *TCPIngressMappingReconciler) tcpConfigMapKey(tcpmap v1beta1.TCPIngressMapping) (types.NamespacedName, bool) {
+	if r.Shard != "" && tcpmap.Spec.TCPConfigMap != nil {
+		return tcpservices.TCPConfigMapKey(tcpmap, "")
+	}
+
+	return tcpservices.TCPConfigMapKey(tcpmap, r.TCPConfigMap)
+}
+
+// ownsMapping reports whether the frontend service of a mapping belongs to the shard of the controller.
+// Mappings without a known frontend service are handled by the controller running without a shard.
+// The frontend service of the mapping decides in every instance, mappings without one are left to the controller running without a shard.
+// Hence a mapping is never owned by both a sharded and an unsharded instance.
+func (r *TCPIngressMappingReconciler) ownsMapping(ctx context.Context, tcpmap v1beta1.TCPIngressMapping) (bool, error) {
+	return ownsFrontend(ctx, r.Client, tcpmap, r.FrontendService, r.Shard)
+}
+
+// ownsService reports whether the frontend service of the mappings generated for a service belongs to the shard of the controller
+func (r *ServiceReconciler) ownsService(ctx context.Context, svc v1.Service) (bool, error) {
+	tcpmap := v1beta1.TCPIngressMapping{}
+	tcpmap.Namespace = svc.Namespace
+	if ref, ok := svc.GetAnnotations()[FrontendServiceAnnotation]; ok {
+		ns, name := splitNamespacedName(ref)
+		tcpmap.Spec.FrontendService = &v1beta1.FrontendService{
+			Name:      name,
+			Namespace: ns,
+		}
+	}
+
+	return ownsFrontend(ctx, r.Client, tcpmap, r.FrontendService, r.Shard)
+}
+
+func ownsFrontend(ctx context.Context, c client.Reader, tcpmap v1beta1.TCPIngressMapping, defaultRef, shard string) (bool, error) {
+	if tcpmap.Spec.FrontendService != nil {
+		defaultRef = ""
+	} else if shard != "" {
+		return false, nil
+	}
+
+	key, ok := tcpservices.FrontendServiceKey(tcpmap, defaultRef)
+	if !ok {
+		return shard == "", nil
+	}
+
+	svc := v1.Service{}
+	if err := c.Get(ctx, key, &svc); kerrors.IsNotFound(err) {
+		return shard == "", nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return inShard(&svc, shard), nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func TestOwnsFrontend(t *testing.T) {
+	c := fake.NewClientBuilder().WithObjects(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "default"}},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "a", Labels: map[string]string{ShardLabel: "a"}}},
+	).Build()
+
+	mapping := func(frontend string) v1beta1.TCPIngressMapping {
+		tcpmap := v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+		if frontend != "" {
+			tcpmap.Spec.FrontendService = &v1beta1.FrontendService{Namespace: "ingress", Name: frontend}
+		}
+
+		return tcpmap
+	}
+
+	tests := []struct {
+		name       string
+		tcpmap     v1beta1.TCPIngressMapping
+		defaultRef string
+		shard      string
+		owned      bool
+	}{
+		{name: "unsharded owns unlabeled frontend", tcpmap: mapping("default"), owned: true},
+		{name: "unsharded skips labeled frontend", tcpmap: mapping("a"), owned: false},
+		{name: "unsharded skips labeled spec frontend despite default", tcpmap: mapping("a"), defaultRef: "ingress/default", owned: false},
+		{name: "unsharded owns mapping without frontend by default", tcpmap: mapping(""), defaultRef: "ingress/default", owned: true},
+		{name: "shard owns labeled frontend", tcpmap: mapping("a"), shard: "a", owned: true},
+		{name: "shard prefers spec over default", tcpmap: mapping("a"), defaultRef: "ingress/default", shard: "a", owned: true},
+		{name: "shard skips mapping without frontend", tcpmap: mapping(""), defaultRef: "ingress/a", shard: "a", owned: false},
+		{name: "shard skips other shard", tcpmap: mapping("a"), shard: "b", owned: false},
+		{name: "unknown frontend is handled unsharded", tcpmap: mapping("missing"), owned: true},
+		{name: "unknown frontend is skipped by shard", tcpmap: mapping("missing"), shard: "a", owned: false},
+	}
+
+	for _, test := range tests {
+		owned, err := ownsFrontend(context.TODO(), c, test.tcpmap, test.defaultRef, test.shard)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if owned != test.owned {
+			t.Errorf("%s: expected owned=%v, got %v", test.name, test.owned, owned)
+		}
+	}
+}
+
+func TestOwnsFrontendExclusive(t *testing.T) {
+	c := fake.NewClientBuilder().WithObjects(
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "default"}},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "a", Labels: map[string]string{ShardLabel: "a"}}},
+	).Build()
+
+	instances := []struct {
+		shard      string
+		defaultRef string
+	}{
+		{shard: "", defaultRef: "ingress/default"},
+		{shard: "a", defaultRef: "ingress/a"},
+	}
+
+	for _, frontend := range []string{"", "default", "a"} {
+		tcpmap := v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+		if frontend != "" {
+			tcpmap.Spec.FrontendService = &v1beta1.FrontendService{Namespace: "ingress", Name: frontend}
+		}
+
+		var owners []string
+		for _, instance := range instances {
+			owned, err := ownsFrontend(context.TODO(), c, tcpmap, instance.defaultRef, instance.shard)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if owned {
+				owners = append(owners, instance.shard)
+			}
+		}
+
+		if len(owners) != 1 {
+			t.Errorf("frontend %q: expected exactly one owning instance, got shards %q", frontend, owners)
+		}
+	}
+}
+
+func TestGuardShard(t *testing.T) {
+	cm := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "tcp-services", Labels: map[string]string{ShardLabel: "a"}}}
+
+	if err := guardShard(cm, "a"); err != nil {
+		t.Errorf("expected shard a to write the configmap, got %v", err)
+	}
+
+	if err := guardShard(cm, ""); !errors.Is(err, errShardMismatch) {
+		t.Errorf("expected the unsharded controller to be refused, got %v", err)
+	}
+
+	if err := guardShard(cm, "b"); !errors.Is(err, errShardMismatch) {
+		t.Errorf("expected shard b to be refused, got %v", err)
+	}
+}
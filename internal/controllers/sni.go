@@ -0,0 +1,121 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/nginx"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// sharedSNIPort returns the port of a frontend service shared by the mappings routed by SNI or 0
+func sharedSNIPort(svc v1.Service) int32 {
+	for _, p := range svc.Spec.Ports {
+		if p.Name == tcpservices.SNIPortName {
+			return p.Port
+		}
+	}
+
+	return 0
+}
+
+// sniHostnames returns the hostnames bound to a shared port by route key
+func sniHostnames(cm v1.ConfigMap, port int32) map[string]string {
+	hostnames := make(map[string]string)
+	for key, value := range cm.Data {
+		if !nginx.IsSNIRouteKey(key, port) {
+			continue
+		}
+
+		if route, ok := nginx.ParseSNIRoute(value); ok {
+			hostnames[key] = route.Hostname
+		}
+	}
+
+	return hostnames
+}
+
+// sniConflict returns the route key of another mapping bound to the hostname of the mapping on a shared port
+func sniConflict(cm v1.ConfigMap, tcpmap v1beta1.TCPIngressMapping, port int32) (string, bool) {
+	own := nginx.SNIRouteKey(tcpmap.Namespace, tcpmap.Name, port)
+	hostnames := sniHostnames(cm, port)
+
+	keys := make([]string, 0, len(hostnames))
+	for key := range hostnames {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key != own && hostnames[key] == tcpmap.Spec.TLS.Hostname {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+// sniPortInUse reports whether mappings other than the given one are still routed by SNI on the shared port
+func (r *TCPIngressMappingReconciler) sniPortInUse(ctx context.Context, tcpmap v1beta1.TCPIngressMapping, frontendService v1.Service, port int32) (bool, error) {
+	if r.StreamSnippetConfigMap == "" {
+		return false, nil
+	}
+
+	cm, err := r.getStreamSnippetConfigMap(ctx, frontendService)
+	if err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+
+	own := nginx.SNIRouteKey(tcpmap.Namespace, tcpmap.Name, port)
+	for key := range sniHostnames(cm, port) {
+		if key != own {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// applySNIRoute declares the route of a mapping on a shared port together with the server block of the port.
+// The server block is declared with the same content by all mappings sharing the port,
+// hence it is removed by the api server once the last of them is gone.
+// The routes proxy to the backend service resolved on every connection, an upstream block would be resolved while nginx loads its configuration
+// and a deleted backend would keep nginx from loading it at all.
+func (r *TCPIngressMappingReconciler) applySNIRoute(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, cm *v1.ConfigMap, port, backendPort int32) error {
+	// Mappings sharing the port with another PROXY protocol setting conflict on the server block
+	server := nginx.SNIServer{
+		Port:          port,
+		ProxyProtocol: downstreamProxyProtocol(*tcpmap, r.Provider),
+		Resolver:      r.NginxResolver,
+	}
+
+	route := nginx.SNIRoute{
+		Hostname: tcpmap.Spec.TLS.Hostname,
+		Upstream: r.serviceAddress(tcpservices.BackendServiceKey(*tcpmap), backendPort),
+	}
+
+	return r.applyConfigMapData(ctx, tcpmap, cm, map[string]string{
+		nginx.SNIServerKey(port):                               server.String(),
+		nginx.SNIRouteKey(tcpmap.Namespace, tcpmap.Name, port): route.String(),
+	})
+}
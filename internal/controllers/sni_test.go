@@ -0,0 +1,187 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/nginx"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+func TestSharedSNIPort(t *testing.T) {
+	svc := v1.Service{
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Name: "tcpmap-1024", Port: 1024},
+				{Name: tcpservices.SNIPortName, Port: 1025},
+			},
+		},
+	}
+
+	if port := sharedSNIPort(svc); port != 1025 {
+		t.Errorf("expected shared port 1025, got %d", port)
+	}
+
+	if port := sharedSNIPort(v1.Service{}); port != 0 {
+		t.Errorf("expected no shared port, got %d", port)
+	}
+}
+
+func TestSNIConflict(t *testing.T) {
+	route := func(hostname string) string {
+		return nginx.SNIRoute{Hostname: hostname, Upstream: "upstream"}.String()
+	}
+
+	cm := v1.ConfigMap{
+		Data: map[string]string{
+			nginx.SNIServerKey(1025):                  "server",
+			nginx.SNIRouteKey("default", "a", 1025):   route("a.example.com"),
+			nginx.SNIRouteKey("default", "b", 1025):   route("b.example.com"),
+			nginx.SNIRouteKey("default", "c", 1026):   route("c.example.com"),
+			nginx.SNIRouteKey("default", "own", 1025): route("own.example.com"),
+		},
+	}
+
+	mapping := func(name, hostname string) v1beta1.TCPIngressMapping {
+		return v1beta1.TCPIngressMapping{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec: v1beta1.TCPIngressMappingSpec{
+				TLS: &v1beta1.TLS{Mode: v1beta1.TLSPassthrough, Hostname: hostname},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		tcpmap   v1beta1.TCPIngressMapping
+		conflict string
+	}{
+		{name: "bound by another mapping", tcpmap: mapping("new", "b.example.com"), conflict: nginx.SNIRouteKey("default", "b", 1025)},
+		{name: "bound on another port", tcpmap: mapping("new", "c.example.com")},
+		{name: "bound by itself", tcpmap: mapping("own", "own.example.com")},
+		{name: "free", tcpmap: mapping("new", "new.example.com")},
+	}
+
+	for _, test := range tests {
+		key, ok := sniConflict(cm, test.tcpmap, 1025)
+		if ok != (test.conflict != "") || key != test.conflict {
+			t.Errorf("%s: expected conflict %q, got %q", test.name, test.conflict, key)
+		}
+	}
+}
+
+func TestCleanupSharedSNIPort(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	mapping := func(name string) *v1beta1.TCPIngressMapping {
+		return &v1beta1.TCPIngressMapping{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec: v1beta1.TCPIngressMappingSpec{
+				BackendService: v1beta1.BackendService{Name: name, Port: intstr.FromInt(5432)},
+				TLS:            &v1beta1.TLS{Mode: v1beta1.TLSPassthrough, Hostname: name + ".example.com"},
+			},
+			Status: v1beta1.TCPIngressMappingStatus{ElectedPort: 1030},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		routes   []string
+		released bool
+	}{
+		{name: "other mappings remain on the port", routes: []string{"a", "b"}, released: false},
+		{name: "last mapping on the port", routes: []string{"a"}, released: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snippets := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "stream-snippets"},
+				Data:       map[string]string{nginx.SNIServerKey(1030): "server"},
+			}
+
+			for _, name := range test.routes {
+				snippets.Data[nginx.SNIRouteKey("default", name, 1030)] = nginx.SNIRoute{Hostname: name + ".example.com", Upstream: "upstream"}.String()
+			}
+
+			frontend := &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "nginx"},
+				Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: tcpservices.SNIPortName, Port: 1030}}},
+			}
+
+			var applied []appliedPatch
+			c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+				mapping("a"),
+				frontend,
+				snippets,
+				&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "tcp-services"}},
+			).WithInterceptorFuncs(captureApply(&applied, nil)).Build()
+
+			recorder := record.NewFakeRecorder(10)
+			r := &TCPIngressMappingReconciler{
+				Client:                 c,
+				Recorder:               recorder,
+				FrontendService:        "ingress/nginx",
+				TCPConfigMap:           "ingress/tcp-services",
+				StreamSnippetConfigMap: "stream-snippets",
+				HoldDown:               time.Hour,
+			}
+
+			cleaned, _, err := r.cleanup(context.TODO(), *mapping("a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.Get(context.TODO(), client.ObjectKeyFromObject(frontend), frontend); err != nil {
+				t.Fatal(err)
+			}
+
+			if held := strings.Contains(frontend.Annotations[ReleasedPortsAnnotation], "1030"); held != test.released {
+				t.Errorf("expected the port to be held down %v, got annotation %q", test.released, frontend.Annotations[ReleasedPortsAnnotation])
+			}
+
+			var releasedEntry bool
+			for _, entry := range cleaned.Status.PortHistory {
+				releasedEntry = releasedEntry || entry.Reason == v1beta1.PortReleased
+			}
+
+			if releasedEntry != test.released {
+				t.Errorf("expected a Released port history entry %v, got %v", test.released, cleaned.Status.PortHistory)
+			}
+
+			if events := len(recorder.Events); (events != 0) != test.released {
+				t.Errorf("expected a PortChanged event %v, got %d events", test.released, events)
+			}
+		})
+	}
+}
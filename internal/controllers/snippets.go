@@ -0,0 +1,146 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/nginx"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// DefaultStreamStatusPort is the port of the status server in the ingress-nginx pods reporting the served stream snippets
+const DefaultStreamStatusPort int32 = 10261
+
+const (
+	// snippetPendingInterval is the interval at which a mapping checks again whether ingress-nginx serves its snippets
+	snippetPendingInterval = 5 * time.Second
+
+	// statusTimeout is the timeout for asking a single ingress-nginx pod for the served snippets
+	statusTimeout = 2 * time.Second
+)
+
+// syncStreamSnippet renders the snippet configmap into the stream-snippet setting of the ingress-nginx controller configmap.
+// ingress-nginx reloads nginx as soon as the setting changes.
+func (r *TCPIngressMappingReconciler) syncStreamSnippet(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, frontendService v1.Service, snippets v1.ConfigMap) error {
+	if r.IngressNginxConfigMap == "" {
+		return nil
+	}
+
+	cm := v1.ConfigMap{}
+	if err := r.Client.Get(ctx, tcpservices.ParseRef(frontendService.Namespace, r.IngressNginxConfigMap), &cm); err != nil {
+		return err
+	}
+
+	rendered := nginx.Render(snippets.Data, r.StreamStatusPort)
+	if cm.Data[nginx.StreamSnippetKey] == rendered {
+		return nil
+	}
+
+	latest := cm.DeepCopy()
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+
+	cm.Data[nginx.StreamSnippetKey] = rendered
+	return r.patch(ctx, tcpmap, &cm, client.MergeFrom(latest), []string{
+		fmt.Sprintf("ConfigMap %s/%s: render the stream snippets of %s/%s into %s", cm.Namespace, cm.Name, snippets.Namespace, snippets.Name, nginx.StreamSnippetKey),
+	})
+}
+
+// snippetsServed reports whether all ready ingress-nginx pods behind the frontend service serve the given snippets (by key).
+// The status server rendered into the stream snippet reports the checksums of the snippets nginx has been loaded with.
+func (r *TCPIngressMappingReconciler) snippetsServed(ctx context.Context, frontendService v1.Service, snippets map[string]string) (bool, string, error) {
+	var slices discoveryv1.EndpointSliceList
+	if err := r.List(ctx, &slices, client.InNamespace(frontendService.Namespace), client.MatchingLabels{
+		discoveryv1.LabelServiceName: frontendService.Name,
+	}); err != nil {
+		return false, "", err
+	}
+
+	addresses := make(map[string]struct{})
+	for _, slice := range slices.Items {
+		for _, endpoint := range slice.Endpoints {
+			// A nil ready condition must be interpreted as ready
+			if (endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready) && len(endpoint.Addresses) > 0 {
+				addresses[endpoint.Addresses[0]] = struct{}{}
+			}
+		}
+	}
+
+	if len(addresses) == 0 {
+		return false, "Frontend service has no ready ingress-nginx pods serving the stream snippets", nil
+	}
+
+	sorted := make([]string, 0, len(addresses))
+	for address := range addresses {
+		sorted = append(sorted, address)
+	}
+
+	sort.Strings(sorted)
+	for _, address := range sorted {
+		status, err := streamStatus(ctx, net.JoinHostPort(address, strconv.Itoa(int(r.StreamStatusPort))))
+		if err != nil {
+			return false, fmt.Sprintf("Failed to ask ingress-nginx pod %s for the served stream snippets: %s", address, err.Error()), nil
+		}
+
+		for key, snippet := range snippets {
+			if status[key] != nginx.Checksum(snippet) {
+				return false, fmt.Sprintf("ingress-nginx pod %s has not been reloaded with the stream snippet %s yet", address, key), nil
+			}
+		}
+	}
+
+	return true, "", nil
+}
+
+// streamStatus returns the checksums of the snippets served by the status server at address
+func streamStatus(ctx context.Context, address string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	if _, err := io.Copy(&b, io.LimitReader(conn, 1<<20)); err != nil {
+		return nil, err
+	}
+
+	return nginx.ParseStatus(b.String()), nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/nginx"
+)
+
+func TestSyncStreamSnippet(t *testing.T) {
+	controller := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "ingress-nginx-controller"},
+		Data:       map[string]string{"use-proxy-protocol": "true"},
+	}
+
+	c := fake.NewClientBuilder().WithObjects(controller).Build()
+	r := &TCPIngressMappingReconciler{Client: c, IngressNginxConfigMap: "ingress-nginx-controller", StreamStatusPort: DefaultStreamStatusPort, Recorder: record.NewFakeRecorder(10)}
+	tcpmap := &v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+	frontend := v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "ingress-nginx"}}
+	snippets := v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "stream-snippets"},
+		Data:       map[string]string{"default.db.conf": "server {\n    listen 1025 ssl;\n}\n"},
+	}
+
+	if err := r.syncStreamSnippet(context.TODO(), tcpmap, frontend, snippets); err != nil {
+		t.Fatal(err)
+	}
+
+	var cm v1.ConfigMap
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: "ingress", Name: "ingress-nginx-controller"}, &cm); err != nil {
+		t.Fatal(err)
+	}
+
+	if cm.Data[nginx.StreamSnippetKey] != nginx.Render(snippets.Data, DefaultStreamStatusPort) {
+		t.Errorf("expected the snippets to be rendered into the stream-snippet setting, got:\n%s", cm.Data[nginx.StreamSnippetKey])
+	}
+
+	if cm.Data["use-proxy-protocol"] != "true" {
+		t.Error("expected the other settings to be left untouched")
+	}
+
+	// Dry-run only records the planned change
+	snippets.Data["default.db.conf"] = "server {\n    listen 1026 ssl;\n}\n"
+	r.DryRun = true
+	if err := r.syncStreamSnippet(context.TODO(), tcpmap, frontend, snippets); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tcpmap.Status.PlannedChanges) != 1 || !strings.Contains(tcpmap.Status.PlannedChanges[0], "stream-snippet") {
+		t.Errorf("expected a planned change of the stream-snippet setting, got %v", tcpmap.Status.PlannedChanges)
+	}
+}
+
+func TestSnippetsServed(t *testing.T) {
+	snippet := "server {\n    listen 1025 ssl;\n}\n"
+	status := "default.db.conf=" + nginx.Checksum(snippet)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			_, _ = conn.Write([]byte(status))
+			conn.Close()
+		}
+	}()
+
+	frontend := v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "ingress-nginx"}}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta:  metav1.ObjectMeta{Namespace: "ingress", Name: "ingress-nginx-abc", Labels: map[string]string{discoveryv1.LabelServiceName: "ingress-nginx"}},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"127.0.0.1"}},
+			{Addresses: []string{"192.0.2.1"}, Conditions: discoveryv1.EndpointConditions{Ready: pointer.Bool(false)}},
+		},
+	}
+
+	r := &TCPIngressMappingReconciler{
+		Client:           fake.NewClientBuilder().WithObjects(slice).Build(),
+		StreamStatusPort: int32(l.Addr().(*net.TCPAddr).Port),
+	}
+
+	if ok, msg, err := r.snippetsServed(context.TODO(), frontend, map[string]string{"default.db.conf": snippet}); err != nil || !ok {
+		t.Errorf("expected the snippet to be served, got %v: %s", err, msg)
+	}
+
+	if ok, _, _ := r.snippetsServed(context.TODO(), frontend, map[string]string{"default.db.conf": "server {}\n"}); ok {
+		t.Error("expected a changed snippet not to be served before the reload")
+	}
+
+	if ok, _, _ := r.snippetsServed(context.TODO(), frontend, map[string]string{"default.other.conf": snippet}); ok {
+		t.Error("expected a missing snippet not to be served")
+	}
+
+	r.Client = fake.NewClientBuilder().Build()
+	if ok, _, _ := r.snippetsServed(context.TODO(), frontend, map[string]string{"default.db.conf": snippet}); ok {
+		t.Error("expected the snippet not to be served without ready ingress-nginx pods")
+	}
+}
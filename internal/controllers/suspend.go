@@ -0,0 +1,264 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/schedule"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// SuspendedPortsAnnotation is written by the controller on the frontend service and holds the ports
+// reserved for suspended mappings in the format port=namespace/name,...
+const SuspendedPortsAnnotation = "tcpmap.infra.doodle.com/suspended-ports"
+
+// isSuspended returns true if a mapping has been withdrawn from the frontend
+func isSuspended(tcpmap v1beta1.TCPIngressMapping) bool {
+	return apimeta.IsStatusConditionTrue(tcpmap.Status.Conditions, v1beta1.SuspendedCondition)
+}
+
+// parseSchedule returns the active windows of a schedule in its time zone
+func parseSchedule(s v1beta1.Schedule) ([]schedule.Window, *time.Location, error) {
+	loc := time.UTC
+	if s.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(s.TimeZone); err != nil {
+			return nil, nil, fmt.Errorf("unknown time zone %q", s.TimeZone)
+		}
+	}
+
+	var windows []schedule.Window
+	for _, w := range s.Windows {
+		start, err := schedule.Parse(w.Start)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if w.Duration.Duration <= 0 {
+			return nil, nil, fmt.Errorf("window %q has no duration", w.Start)
+		}
+
+		windows = append(windows, schedule.Window{Start: start, Duration: w.Duration.Duration})
+	}
+
+	return windows, loc, nil
+}
+
+// suspension returns whether a mapping is suspended at now, either by spec.suspend or outside of its schedule,
+// together with the condition reason and message.
+// The returned duration is the time until the schedule opens or closes a window, 0 without a schedule.
+func suspension(tcpmap v1beta1.TCPIngressMapping, now time.Time) (suspended bool, reason, msg string, next time.Duration, err error) {
+	if tcpmap.Spec.Schedule != nil {
+		windows, loc, err := parseSchedule(*tcpmap.Spec.Schedule)
+		if err != nil {
+			return false, "", "", 0, err
+		}
+
+		active, transition := schedule.Evaluate(windows, now.In(loc))
+		if !transition.IsZero() {
+			next = transition.Sub(now)
+		}
+
+		if !active {
+			suspended, reason, msg = true, v1beta1.OutsideScheduleReason, "Mapping is outside of its active windows"
+			if !transition.IsZero() {
+				msg = fmt.Sprintf("Mapping is outside of its active windows until %s", transition.Format(time.RFC3339))
+			}
+		}
+	}
+
+	if tcpmap.Spec.Suspend {
+		suspended, reason, msg = true, v1beta1.SuspendedReason, "Mapping is suspended"
+	}
+
+	return suspended, reason, msg, next, nil
+}
+
+// suspend withdraws a mapping from the frontend service, the tcp configmap and the stream snippets.
+// The elected port stays reserved on the frontend service until the mapping is resumed.
+func (r *TCPIngressMappingReconciler) suspend(ctx context.Context, tcpmap v1beta1.TCPIngressMapping, reason, msg string, logger logr.Logger) (v1beta1.TCPIngressMapping, ctrl.Result, error) {
+	frontendService, tcpmap, err := r.getFrontendService(ctx, tcpmap)
+	if err != nil {
+		return tcpmap, ctrl.Result{}, err
+	}
+
+	var cm v1.ConfigMap
+	if r.usesTCPConfigMap() {
+		cm, tcpmap, err = r.getConfigMap(ctx, tcpmap)
+		if err != nil {
+			return tcpmap, ctrl.Result{}, err
+		}
+	}
+
+	// The status might have been lost while suspended
+	if tcpmap.Status.ElectedPort == 0 {
+		if port := suspendedPort(frontendService, tcpmap); port != 0 && !r.DryRun {
+			tcpmap.Status.ElectedPort = port
+			tcpmap = r.portChanged(tcpmap, port, v1beta1.PortAdopted, fmt.Sprintf("Port %d adopted as it is still reserved for this mapping", port))
+		}
+	}
+
+	// Reserve the port before it is removed, hence it is never free for other mappings
+	if port := tcpmap.Status.ElectedPort; port != 0 {
+		if err := r.reserveSuspendedPort(ctx, &tcpmap, &frontendService, port); err != nil {
+			msg := "Failed to reserve the port of the suspended mapping on the fronted service"
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterFrontendPortReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterFrontendPortReason, msg), ctrl.Result{Requeue: true}, err
+		}
+	}
+
+	tcpmap, result, err := r.unpublish(ctx, tcpmap, &frontendService, &cm)
+	if err != nil {
+		return tcpmap, result, err
+	}
+
+	if !isSuspended(tcpmap) {
+		logger.Info("suspended mapping", "port", tcpmap.Status.ElectedPort, "reason", reason)
+		r.Recorder.Event(&tcpmap, v1.EventTypeNormal, reason, msg)
+	}
+
+	tcpmap = v1beta1.TCPIngressMappingSuspended(tcpmap, reason, msg)
+	return v1beta1.TCPIngressMappingNotReady(tcpmap, reason, msg), ctrl.Result{}, nil
+}
+
+// resume marks a previously suspended mapping as active again.
+// Mappings which have never been suspended are left without a Suspended condition.
+func (r *TCPIngressMappingReconciler) resume(tcpmap v1beta1.TCPIngressMapping) v1beta1.TCPIngressMapping {
+	if isSuspended(tcpmap) {
+		msg := "Mapping has been resumed"
+		if tcpmap.Spec.Schedule != nil {
+			msg = "Mapping is within an active window"
+		}
+
+		r.Recorder.Event(&tcpmap, v1.EventTypeNormal, v1beta1.ResumedReason, msg)
+		return v1beta1.TCPIngressMappingResumed(tcpmap, v1beta1.ResumedReason, msg)
+	}
+
+	if tcpmap.Spec.Schedule != nil && apimeta.FindStatusCondition(tcpmap.Status.Conditions, v1beta1.SuspendedCondition) == nil {
+		return v1beta1.TCPIngressMappingResumed(tcpmap, v1beta1.ResumedReason, "Mapping is within an active window")
+	}
+
+	return tcpmap
+}
+
+// parseSuspendedPorts parses the suspended ports annotation by mapping, invalid items are ignored.
+// The mappings routed by SNI share a port, hence a port might be reserved for multiple mappings.
+func parseSuspendedPorts(value string) map[types.NamespacedName]int32 {
+	suspended := make(map[types.NamespacedName]int32)
+	for _, item := range strings.Split(value, ",") {
+		port, mapping, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+
+		p, err := tcpservices.ParsePort(port)
+		if err != nil {
+			continue
+		}
+
+		suspended[tcpservices.ParseRef("", mapping)] = p
+	}
+
+	return suspended
+}
+
+// formatSuspendedPorts formats suspended ports as annotation value ordered by port and mapping
+func formatSuspendedPorts(suspended map[types.NamespacedName]int32) string {
+	var mappings []types.NamespacedName
+	for mapping := range suspended {
+		mappings = append(mappings, mapping)
+	}
+
+	sort.Slice(mappings, func(i, j int) bool {
+		if suspended[mappings[i]] != suspended[mappings[j]] {
+			return suspended[mappings[i]] < suspended[mappings[j]]
+		}
+
+		return mappings[i].String() < mappings[j].String()
+	})
+
+	var items []string
+	for _, mapping := range mappings {
+		items = append(items, fmt.Sprintf("%d=%s", suspended[mapping], mapping))
+	}
+
+	return strings.Join(items, ",")
+}
+
+// suspendedPort returns the port reserved for a mapping on the frontend service, 0 if there is none
+func suspendedPort(svc v1.Service, tcpmap v1beta1.TCPIngressMapping) int32 {
+	return parseSuspendedPorts(svc.Annotations[SuspendedPortsAnnotation])[objectKey(&tcpmap)]
+}
+
+// reserveSuspendedPort records the port of a suspended mapping on the frontend service
+func (r *TCPIngressMappingReconciler) reserveSuspendedPort(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, svc *v1.Service, port int32) error {
+	return r.updateSuspendedPorts(ctx, tcpmap, svc, func(suspended map[types.NamespacedName]int32) {
+		suspended[objectKey(tcpmap)] = port
+	})
+}
+
+// releaseSuspendedPort removes the reservation of a resumed mapping
+func (r *TCPIngressMappingReconciler) releaseSuspendedPort(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, svc *v1.Service) error {
+	if suspendedPort(*svc, *tcpmap) == 0 {
+		return nil
+	}
+
+	return r.updateSuspendedPorts(ctx, tcpmap, svc, func(suspended map[types.NamespacedName]int32) {})
+}
+
+// updateSuspendedPorts removes the reservations of the mapping and applies update
+func (r *TCPIngressMappingReconciler) updateSuspendedPorts(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, svc *v1.Service, update func(suspended map[types.NamespacedName]int32)) error {
+	if err := r.Client.Get(ctx, client.ObjectKeyFromObject(svc), svc); err != nil {
+		return err
+	}
+
+	suspended := parseSuspendedPorts(svc.Annotations[SuspendedPortsAnnotation])
+	delete(suspended, objectKey(tcpmap))
+
+	update(suspended)
+	value := formatSuspendedPorts(suspended)
+	if value == svc.Annotations[SuspendedPortsAnnotation] {
+		return nil
+	}
+
+	latest := svc.DeepCopy()
+	if value == "" {
+		delete(svc.Annotations, SuspendedPortsAnnotation)
+	} else {
+		if svc.Annotations == nil {
+			svc.Annotations = make(map[string]string)
+		}
+
+		svc.Annotations[SuspendedPortsAnnotation] = value
+	}
+
+	change := fmt.Sprintf("Service %s/%s: set annotation %s=%s", svc.Namespace, svc.Name, SuspendedPortsAnnotation, value)
+	return r.patch(ctx, tcpmap, svc, client.MergeFromWithOptions(latest, client.MergeFromWithOptimisticLock{}), []string{change})
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func TestSuspension(t *testing.T) {
+	// Monday
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	mapping := func(suspend bool, s *v1beta1.Schedule) v1beta1.TCPIngressMapping {
+		return v1beta1.TCPIngressMapping{
+			Spec: v1beta1.TCPIngressMappingSpec{Suspend: suspend, Schedule: s},
+		}
+	}
+
+	workdays := func(start string, tz string) *v1beta1.Schedule {
+		return &v1beta1.Schedule{
+			TimeZone: tz,
+			Windows:  []v1beta1.ActiveWindow{{Start: start, Duration: metav1.Duration{Duration: 10 * time.Hour}}},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		tcpmap    v1beta1.TCPIngressMapping
+		suspended bool
+		reason    string
+		next      time.Duration
+		err       bool
+	}{
+		{name: "active", tcpmap: mapping(false, nil)},
+		{name: "suspended", tcpmap: mapping(true, nil), suspended: true, reason: v1beta1.SuspendedReason},
+		{name: "within window", tcpmap: mapping(false, workdays("0 8 * * mon-fri", "")), next: 6 * time.Hour},
+		{name: "outside of window", tcpmap: mapping(false, workdays("0 14 * * mon-fri", "")), suspended: true, reason: v1beta1.OutsideScheduleReason, next: 2 * time.Hour},
+		{name: "suspended within window", tcpmap: mapping(true, workdays("0 8 * * mon-fri", "")), suspended: true, reason: v1beta1.SuspendedReason, next: 6 * time.Hour},
+		{name: "invalid expression", tcpmap: mapping(false, workdays("0 8 * *", "")), err: true},
+		{name: "unknown time zone", tcpmap: mapping(false, workdays("0 8 * * *", "Mars/Olympus")), err: true},
+		{name: "no duration", tcpmap: mapping(false, &v1beta1.Schedule{Windows: []v1beta1.ActiveWindow{{Start: "@daily"}}}), err: true},
+	}
+
+	for _, test := range tests {
+		suspended, reason, _, next, err := suspension(test.tcpmap, now)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+
+		if suspended != test.suspended || reason != test.reason || next != test.next {
+			t.Errorf("%s: expected suspended=%t (%q) next=%s, got suspended=%t (%q) next=%s", test.name, test.suspended, test.reason, test.next, suspended, reason, next)
+		}
+	}
+}
+
+func TestSuspendedPorts(t *testing.T) {
+	// The port shared by mappings routed by SNI is reserved for each of them
+	value := "1025=default/db,1030=default/sni-a,1030=other/sni-b"
+	suspended := parseSuspendedPorts(value + ",invalid,x=default/y")
+
+	if len(suspended) != 3 || suspended[types.NamespacedName{Namespace: "other", Name: "sni-b"}] != 1030 || suspended[types.NamespacedName{Namespace: "default", Name: "sni-a"}] != 1030 {
+		t.Fatalf("unexpected suspended ports %v", suspended)
+	}
+
+	if formatted := formatSuspendedPorts(suspended); formatted != value {
+		t.Errorf("expected %q, got %q", value, formatted)
+	}
+
+	svc := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{SuspendedPortsAnnotation: value},
+		},
+	}
+
+	db := v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}}
+	if port := suspendedPort(svc, db); port != 1025 {
+		t.Errorf("expected port 1025 to be reserved for default/db, got %d", port)
+	}
+
+	// Ports reserved for suspended mappings are never elected by others
+	other := v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other"}}
+	r := &TCPIngressMappingReconciler{Log: logr.Discard(), MinPort: 1025, MaxPort: 1026}
+	if port, _, _ := r.electPort(other, svc, v1.ConfigMap{}); port != 1026 {
+		t.Errorf("expected the reserved port to be skipped, got %d", port)
+	}
+}
+
+func TestReserveSharedSuspendedPort(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "nginx"}}
+	c := fake.NewClientBuilder().WithObjects(svc).Build()
+	r := &TCPIngressMappingReconciler{Client: c, Recorder: record.NewFakeRecorder(10)}
+
+	a := &v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sni-a"}}
+	b := &v1beta1.TCPIngressMapping{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sni-b"}}
+
+	// Both mappings routed by SNI on port 1030 are suspended
+	for _, tcpmap := range []*v1beta1.TCPIngressMapping{a, b} {
+		if err := r.reserveSuspendedPort(context.TODO(), tcpmap, svc, 1030); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if port := suspendedPort(*svc, *a); port != 1030 {
+		t.Errorf("expected the port of default/sni-a to stay reserved, got annotation %q", svc.Annotations[SuspendedPortsAnnotation])
+	}
+
+	// Resuming one of them keeps the reservation of the other
+	if err := r.releaseSuspendedPort(context.TODO(), a, svc); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Get(context.TODO(), client.ObjectKeyFromObject(svc), svc); err != nil {
+		t.Fatal(err)
+	}
+
+	if value := svc.Annotations[SuspendedPortsAnnotation]; value != "1030=default/sni-b" {
+		t.Errorf("expected only default/sni-b to keep its reservation, got %q", value)
+	}
+}
+
+func TestResume(t *testing.T) {
+	r := &TCPIngressMappingReconciler{Recorder: record.NewFakeRecorder(10)}
+
+	tcpmap := v1beta1.TCPIngressMappingSuspended(v1beta1.TCPIngressMapping{}, v1beta1.SuspendedReason, "Mapping is suspended")
+	if !isSuspended(tcpmap) {
+		t.Fatal("expected the mapping to be suspended")
+	}
+
+	if tcpmap = r.resume(tcpmap); isSuspended(tcpmap) {
+		t.Error("expected the mapping to be resumed")
+	}
+
+	if tcpmap = r.resume(v1beta1.TCPIngressMapping{}); len(tcpmap.Status.Conditions) != 0 {
+		t.Errorf("expected no Suspended condition on a mapping which was never suspended, got %v", tcpmap.Status.Conditions)
+	}
+}
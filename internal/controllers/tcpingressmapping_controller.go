@@ -20,15 +20,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
-	"strings"
+	"time"
 
+	runtimeclient "github.com/fluxcd/pkg/runtime/client"
 	"github.com/go-logr/logr"
 	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -37,24 +41,42 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/nginx"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
 )
 
 // +kubebuilder:rbac:groups=networking.infra.doodle.com,resources=tcpingressmappings,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=networking.infra.doodle.com,resources=tcpingressmappings/status,verbs=get;update;patch
-// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch
-// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch;create;update;patch;delete
 
 const (
-	serviceIndex = ".metadata.service"
-	finalizer    = "finalizer.infra.doodle.com"
+	serviceIndex          = ".metadata.service"
+	connectionIndex       = ".metadata.connectionFrontendService"
+	tlsSecretIndex        = ".spec.tls.secretRef"
+	kubeConfigSecretIndex = ".spec.backendService.kubeConfig.secretRef"
+	finalizer             = "finalizer.infra.doodle.com"
 )
 
 var (
 	ErrPortNotFound = errors.New("Port not found")
 )
 
+// BackendGating defines how the availability of backend endpoints affects a mapping
+type BackendGating string
+
+const (
+	// BackendGatingNone ignores the backend endpoints
+	BackendGatingNone BackendGating = "none"
+	// BackendGatingReady only reports a mapping as ready if the backend has ready endpoints
+	BackendGatingReady BackendGating = "ready"
+	// BackendGatingPublish only publishes a mapping once the backend has ready endpoints
+	BackendGatingPublish BackendGating = "publish"
+)
+
 type TCPIngressMappingReconciler struct {
 	MinPort         int32
 	MaxPort         int32
@@ -63,6 +85,41 @@ type TCPIngressMappingReconciler struct {
 	Recorder        record.EventRecorder
 	TCPConfigMap    string
 	FrontendService string
+	BackendGating   BackendGating
+	Prober          *Prober
+	DryRun          bool
+	// ElectionStrategy defines which free port is elected for new mappings
+	ElectionStrategy tcpservices.ElectionStrategy
+	// HoldDown is the period during which a released port is not elected again
+	HoldDown time.Duration
+	// ReissueReleasedPorts re-issues a held down port to a mapping recreated with the same namespace/name
+	ReissueReleasedPorts bool
+	// Shard is the value of the shard label of the pools managed by this controller
+	Shard string
+	// KubeConfigOpts are applied to the kubeconfigs of remote clusters
+	KubeConfigOpts runtimeclient.KubeConfigOptions
+	// StreamSnippetConfigMap holds the nginx stream server blocks of mappings terminating TLS, routed by SNI or limiting connections
+	StreamSnippetConfigMap string
+	// IngressNginxConfigMap is the controller configmap of ingress-nginx the stream snippets are rendered into
+	IngressNginxConfigMap string
+	// TLSSecret receives the certificates of the mappings terminating TLS
+	TLSSecret string
+	// TLSDir is the directory in the ingress-nginx pods the managed tls secret is mounted at
+	TLSDir string
+	// StreamStatusPort is the port of the status server in the ingress-nginx pods reporting the served stream snippets
+	StreamStatusPort int32
+	// NginxResolver is the DNS server nginx resolves the backends of the stream snippets with, while loading its configuration if empty
+	NginxResolver string
+	// ClusterDomain qualifies the addresses of backend services in the stream snippets
+	ClusterDomain string
+	// RemoteSyncInterval is the interval at which the endpoints of remote backends are mirrored again
+	RemoteSyncInterval time.Duration
+	// ExpiryWarning is the time before the expiry of a mapping at which a warning event is emitted
+	ExpiryWarning time.Duration
+	// Provider is the proxy serving the frontend ports, ingress-nginx if empty
+	Provider Provider
+	ports    portAllocator
+	remotes  remoteClients
 	client.Client
 }
 
@@ -76,10 +133,60 @@ func (r *TCPIngressMappingReconciler) SetupWithManager(mgr ctrl.Manager, opts TC
 	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &v1beta1.TCPIngressMapping{}, serviceIndex,
 		func(o client.Object) []string {
 			vb := o.(*v1beta1.TCPIngressMapping)
-			r.Log.Info(fmt.Sprintf("%s/%s", vb.GetNamespace(), vb.Spec.BackendService.Name))
-			return []string{
-				fmt.Sprintf("%s/%s", vb.GetNamespace(), vb.Spec.BackendService.Name),
+			keys := []string{
+				tcpservices.BackendServiceKey(*vb).String(),
+			}
+
+			for _, backend := range vb.Spec.BackendService.Weighted {
+				keys = append(keys, tcpservices.WeightedBackendKey(*vb, backend).String())
+			}
+
+			return keys
+		},
+	); err != nil {
+		return err
+	}
+
+	// Index the mappings writing their connection details by their frontend service, the address of the frontend is part of them
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &v1beta1.TCPIngressMapping{}, connectionIndex,
+		func(o client.Object) []string {
+			vb := o.(*v1beta1.TCPIngressMapping)
+			if vb.Spec.WriteConnectionTo == nil {
+				return nil
+			}
+
+			if key, ok := tcpservices.FrontendServiceKey(*vb, r.FrontendService); ok {
+				return []string{key.String()}
+			}
+
+			return nil
+		},
+	); err != nil {
+		return err
+	}
+
+	// Index the mappings with a backend in a remote cluster by their kubeconfig secret, a changed kubeconfig replaces the cached client
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &v1beta1.TCPIngressMapping{}, kubeConfigSecretIndex,
+		func(o client.Object) []string {
+			if key, ok := kubeConfigSecretKey(*o.(*v1beta1.TCPIngressMapping)); ok {
+				return []string{key.String()}
+			}
+
+			return nil
+		},
+	); err != nil {
+		return err
+	}
+
+	// Index the mappings terminating TLS by their tls secret, a rotated certificate is copied into the managed tls secret
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &v1beta1.TCPIngressMapping{}, tlsSecretIndex,
+		func(o client.Object) []string {
+			vb := o.(*v1beta1.TCPIngressMapping)
+			if vb.Spec.TLS == nil || vb.Spec.TLS.SecretRef == nil {
+				return nil
 			}
+
+			return []string{fmt.Sprintf("%s/%s", vb.Namespace, vb.Spec.TLS.SecretRef.Name)}
 		},
 	); err != nil {
 		return err
@@ -91,6 +198,17 @@ func (r *TCPIngressMappingReconciler) SetupWithManager(mgr ctrl.Manager, opts TC
 			&v1.Service{},
 			handler.EnqueueRequestsFromMapFunc(r.requestsForServiceChange),
 		).
+		Watches(
+			&discoveryv1.EndpointSlice{},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForEndpointSliceChange),
+		).
+		Watches(
+			&v1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForSecretChange),
+		).
+		// Restore deleted or edited connection details
+		Owns(&v1.Secret{}).
+		Owns(&v1.ConfigMap{}).
 		WithOptions(controller.Options{MaxConcurrentReconciles: opts.MaxConcurrentReconciles}).
 		Complete(r)
 }
@@ -108,8 +226,15 @@ func (r *TCPIngressMappingReconciler) requestsForServiceChange(ctx context.Conte
 		return nil
 	}
 
+	var connections v1beta1.TCPIngressMappingList
+	if err := r.List(ctx, &connections, client.MatchingFields{
+		connectionIndex: objectKey(s).String(),
+	}); err != nil {
+		return nil
+	}
+
 	var reqs []reconcile.Request
-	for _, i := range list.Items {
+	for _, i := range append(list.Items, connections.Items...) {
 		r.Log.Info("referenced service from a TCPIngressMapping changed detected, reconcile TCPIngressMapping", "namespace", i.GetNamespace(), "name", i.GetName())
 		reqs = append(reqs, reconcile.Request{NamespacedName: objectKey(&i)})
 	}
@@ -117,6 +242,52 @@ func (r *TCPIngressMappingReconciler) requestsForServiceChange(ctx context.Conte
 	return reqs
 }
 
+func (r *TCPIngressMappingReconciler) requestsForEndpointSliceChange(ctx context.Context, o client.Object) []reconcile.Request {
+	slice, ok := o.(*discoveryv1.EndpointSlice)
+	if !ok {
+		panic(fmt.Sprintf("expected an EndpointSlice, got %T", o))
+	}
+
+	svcName, ok := slice.GetLabels()[discoveryv1.LabelServiceName]
+	if !ok {
+		return nil
+	}
+
+	var list v1beta1.TCPIngressMappingList
+	if err := r.List(ctx, &list, client.MatchingFields{
+		serviceIndex: fmt.Sprintf("%s/%s", slice.GetNamespace(), svcName),
+	}); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, i := range list.Items {
+		reqs = append(reqs, reconcile.Request{NamespacedName: objectKey(&i)})
+	}
+
+	return reqs
+}
+
+func (r *TCPIngressMappingReconciler) requestsForSecretChange(ctx context.Context, o client.Object) []reconcile.Request {
+	r.remotes.invalidate(objectKey(o), o.GetResourceVersion())
+
+	var reqs []reconcile.Request
+	for _, index := range []string{tlsSecretIndex, kubeConfigSecretIndex} {
+		var list v1beta1.TCPIngressMappingList
+		if err := r.List(ctx, &list, client.MatchingFields{
+			index: objectKey(o).String(),
+		}); err != nil {
+			return nil
+		}
+
+		for _, i := range list.Items {
+			reqs = append(reqs, reconcile.Request{NamespacedName: objectKey(&i)})
+		}
+	}
+
+	return reqs
+}
+
 // Reconcile TCPIngressMappings
 func (r *TCPIngressMappingReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := r.Log.WithValues("Namespace", req.Namespace, "Name", req.NamespacedName)
@@ -128,6 +299,9 @@ func (r *TCPIngressMappingReconciler) Reconcile(ctx context.Context, req ctrl.Re
 	err := r.Client.Get(ctx, req.NamespacedName, &tcpmap)
 	if err != nil {
 		if kerrors.IsNotFound(err) {
+			forgetExpiry(req.NamespacedName)
+			r.remotes.forget(req.NamespacedName)
+
 			// Request object not found, could have been deleted after reconcile request.
 			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
 			// Return and don't requeue
@@ -137,12 +311,22 @@ func (r *TCPIngressMappingReconciler) Reconcile(ctx context.Context, req ctrl.Re
 		return reconcile.Result{}, err
 	}
 
+	// Mappings of pools which belong to another shard are left untouched
+	if owned, err := r.ownsMapping(ctx, tcpmap); err != nil {
+		return reconcile.Result{}, err
+	} else if !owned {
+		r.remotes.forget(req.NamespacedName)
+		logger.V(1).Info("frontend service belongs to another shard, skip TCPIngressMapping")
+		return reconcile.Result{}, nil
+	}
+
 	// Check if object has a delete request
 	if tcpmap.ObjectMeta.DeletionTimestamp.IsZero() {
 		// The object is not being deleted, so if it does not have our finalizer,
 		// then lets add the finalizer and update the object. This is equivalent
 		// registering our finalizer.
-		if !containsString(tcpmap.ObjectMeta.Finalizers, finalizer) {
+		// In dry-run mode nothing gets published, hence there is nothing to clean up.
+		if !containsString(tcpmap.ObjectMeta.Finalizers, finalizer) && !r.DryRun {
 			tcpmap.ObjectMeta.Finalizers = append(tcpmap.ObjectMeta.Finalizers, finalizer)
 			if err := r.Update(ctx, &tcpmap); err != nil {
 				return ctrl.Result{}, err
@@ -151,10 +335,27 @@ func (r *TCPIngressMappingReconciler) Reconcile(ctx context.Context, req ctrl.Re
 	} else {
 		// The object is being deleted
 		if containsString(tcpmap.ObjectMeta.Finalizers, finalizer) {
-			if _, res, err := r.cleanup(ctx, tcpmap); err != nil {
+			if r.DryRun {
+				tcpmap.Status.PlannedChanges = nil
+			}
+
+			tcpmap, res, err := r.cleanup(ctx, tcpmap)
+			if err != nil {
 				return res, err
 			}
 
+			// Keep the finalizer in dry-run mode as the port has not been released.
+			// The mapping stays terminating until a controller without --dry-run releases it, the planned cleanup is reported in the status.
+			if r.DryRun {
+				logger.Info("mapping is kept terminating in dry-run mode until its port is released")
+				return ctrl.Result{}, r.patchStatus(ctx, &tcpmap)
+			}
+
+			// Record the released port before the mapping is gone
+			if err := r.patchStatus(ctx, &tcpmap); err != nil {
+				return ctrl.Result{}, err
+			}
+
 			// remove our finalizer from the list and update it.
 			tcpmap.ObjectMeta.Finalizers = removeString(tcpmap.ObjectMeta.Finalizers, finalizer)
 			if err := r.Update(ctx, &tcpmap); err != nil {
@@ -163,12 +364,35 @@ func (r *TCPIngressMappingReconciler) Reconcile(ctx context.Context, req ctrl.Re
 		}
 
 		// Stop reconciliation as the item is being deleted
+		forgetExpiry(req.NamespacedName)
+		r.remotes.forget(req.NamespacedName)
 		return ctrl.Result{}, nil
 	}
 
+	if r.DryRun {
+		tcpmap.Status.PlannedChanges = nil
+	}
+
+	r.remotes.track(tcpmap)
 	tcpmap, result, reconcileErr := r.reconcile(ctx, tcpmap, logger)
 	tcpmap.Status.ObservedGeneration = tcpmap.GetGeneration()
 
+	// Remote clusters are not watched, their endpoints get mirrored again periodically
+	if tcpmap.Spec.BackendService.KubeConfig != nil && r.RemoteSyncInterval > 0 && reconcileErr == nil && !result.Requeue &&
+		(result.RequeueAfter == 0 || result.RequeueAfter > r.RemoteSyncInterval) {
+		result.RequeueAfter = r.RemoteSyncInterval
+	}
+
+	// Scheduled mappings are reconciled again once a window opens or closes,
+	// expiring mappings once the warning or the expiry is due
+	if reconcileErr == nil {
+		_, _, _, next, _ := suspension(tcpmap, time.Now())
+		result = requeueWithin(result, next)
+		result = requeueWithin(result, r.nextExpiryCheck(tcpmap, time.Now()))
+	}
+
+	recordExpiry(tcpmap)
+
 	// Update status after reconciliation.
 	if err = r.patchStatus(ctx, &tcpmap); err != nil {
 		logger.Error(err, "unable to update status after reconciliation")
@@ -178,250 +402,626 @@ func (r *TCPIngressMappingReconciler) Reconcile(ctx context.Context, req ctrl.Re
 	return result, reconcileErr
 }
 
+// requeueWithin shortens the requeue interval of a result to at most d, unchanged if d is 0
+func requeueWithin(result ctrl.Result, d time.Duration) ctrl.Result {
+	if d > 0 && !result.Requeue && (result.RequeueAfter == 0 || result.RequeueAfter > d) {
+		result.RequeueAfter = d
+	}
+
+	return result
+}
+
 func (r *TCPIngressMappingReconciler) cleanup(ctx context.Context, tcpmap v1beta1.TCPIngressMapping) (v1beta1.TCPIngressMapping, ctrl.Result, error) {
 	frontendService, tcpmap, err := r.getFrontendService(ctx, tcpmap)
 	if err != nil {
 		return tcpmap, ctrl.Result{}, err
 	}
 
-	cm, tcpmap, err := r.getConfigMap(ctx, tcpmap)
-	if err != nil {
-		return tcpmap, ctrl.Result{}, err
+	var cm v1.ConfigMap
+	if r.usesTCPConfigMap() {
+		cm, tcpmap, err = r.getConfigMap(ctx, tcpmap)
+		if err != nil {
+			return tcpmap, ctrl.Result{}, err
+		}
 	}
 
-	//Remove port from frontend service
-	for k, v := range frontendService.Spec.Ports {
-		if v.Port == tcpmap.Status.ElectedPort {
-			frontendService.Spec.Ports = append(frontendService.Spec.Ports[:k], frontendService.Spec.Ports[k+1:]...)
+	// The port shared by mappings routed by SNI is only released by the last of them
+	releasedPort := tcpmap.Status.ElectedPort
+	if releasedPort != 0 && tcpservices.RoutesBySNI(tcpmap) && releasedPort == sharedSNIPort(frontendService) {
+		inUse, err := r.sniPortInUse(ctx, tcpmap, frontendService, releasedPort)
+		if err != nil {
+			return tcpmap, ctrl.Result{}, err
+		}
 
-			if err := r.patchService(ctx, &frontendService); err != nil {
-				msg := "Failed to remove port from the fronted service"
-				r.Recorder.Event(&tcpmap, "Normal", "error", msg)
-				return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterFrontendPortReason, msg), ctrl.Result{Requeue: true}, err
-			}
+		if inUse {
+			releasedPort = 0
+		}
+	}
+
+	// Keep the released port from being elected by other mappings for the hold-down period.
+	// It is recorded before the port is removed, hence it is never free in between.
+	if releasedPort != 0 && r.holdDown(frontendService) > 0 {
+		if err := r.holdDownPort(ctx, &tcpmap, &frontendService, releasedPort); err != nil {
+			msg := "Failed to hold down the released port on the fronted service"
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterFrontendPortReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterFrontendPortReason, msg), ctrl.Result{Requeue: true}, err
 		}
 	}
 
-	//Remove port from tcp configmap
-	port := strconv.Itoa(int(tcpmap.Status.ElectedPort))
-	if _, ok := cm.Data[port]; ok {
-		delete(cm.Data, port)
+	tcpmap, result, err := r.unpublish(ctx, tcpmap, &frontendService, &cm)
+	if err != nil {
+		return tcpmap, result, err
+	}
+
+	// The port reserved while suspended is not needed anymore
+	if err := r.releaseSuspendedPort(ctx, &tcpmap, &frontendService); err != nil {
+		msg := "Failed to release the port reserved for the suspended mapping"
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterFrontendPortReason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterFrontendPortReason, msg), ctrl.Result{Requeue: true}, err
+	}
+
+	if releasedPort != 0 && !r.DryRun {
+		tcpmap = r.portChanged(tcpmap, releasedPort, v1beta1.PortReleased, fmt.Sprintf("Port %d released", releasedPort))
+	}
+
+	return tcpmap, ctrl.Result{}, nil
+}
 
-		if err := r.patchConfigMap(ctx, &cm); err != nil {
+// unpublish removes the port of a mapping from the frontend service, the tcp configmap and the stream snippets
+func (r *TCPIngressMappingReconciler) unpublish(ctx context.Context, tcpmap v1beta1.TCPIngressMapping, frontendService *v1.Service, cm *v1.ConfigMap) (v1beta1.TCPIngressMapping, ctrl.Result, error) {
+	// Release the port owned by this mapping from the frontend service
+	if err := r.applyFrontendPorts(ctx, &tcpmap, frontendService); err != nil {
+		msg := "Failed to remove port from the fronted service"
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterFrontendPortReason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterFrontendPortReason, msg), ctrl.Result{Requeue: true}, err
+	}
+
+	if err := r.removeUnmanagedFrontendPort(ctx, &tcpmap, frontendService, tcpmap.Status.ElectedPort, frontendPortName(tcpmap)); err != nil {
+		msg := "Failed to remove port from the fronted service"
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterFrontendPortReason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterFrontendPortReason, msg), ctrl.Result{Requeue: true}, err
+	}
+
+	// Release the key owned by this mapping from the tcp configmap
+	if cm.Name != "" {
+		if err := r.applyConfigMapData(ctx, &tcpmap, cm, nil); err != nil {
 			msg := "Failed to remove port from the tcp configmap"
-			r.Recorder.Event(&tcpmap, "Normal", "error", msg)
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterConfigMapPortReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterConfigMapPortReason, msg), ctrl.Result{Requeue: true}, err
+		}
+
+		port := strconv.Itoa(int(tcpmap.Status.ElectedPort))
+		if err := r.removeUnmanagedConfigMapKey(ctx, &tcpmap, cm, port, backendReference(tcpmap)); err != nil {
+			msg := "Failed to remove port from the tcp configmap"
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterConfigMapPortReason, msg)
 			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterConfigMapPortReason, msg), ctrl.Result{Requeue: true}, err
 		}
 	}
 
+	if err := r.releaseStreamSnippet(ctx, &tcpmap, *frontendService); err != nil {
+		msg := "Failed to remove the server block from the stream snippet configmap"
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterConfigMapPortReason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterConfigMapPortReason, msg), ctrl.Result{Requeue: true}, err
+	}
+
 	return tcpmap, ctrl.Result{}, nil
 }
 
 func (r *TCPIngressMappingReconciler) reconcile(ctx context.Context, tcpmap v1beta1.TCPIngressMapping, logger logr.Logger) (v1beta1.TCPIngressMapping, ctrl.Result, error) {
 	logger.Info("check updates TCPIngressMapping")
 
+	if reason, msg := validateExpiry(tcpmap); reason != "" {
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, reason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, reason, msg), ctrl.Result{}, nil
+	}
+
+	if r.checkExpiry(&tcpmap, time.Now()) {
+		return r.expire(ctx, tcpmap, logger)
+	}
+
+	suspended, suspendReason, suspendMsg, _, err := suspension(tcpmap, time.Now())
+	if err != nil {
+		msg := fmt.Sprintf("Invalid schedule: %s", err.Error())
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.InvalidScheduleReason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.InvalidScheduleReason, msg), ctrl.Result{}, nil
+	}
+
+	if suspended {
+		return r.suspend(ctx, tcpmap, suspendReason, suspendMsg, logger)
+	}
+
+	tcpmap = r.resume(tcpmap)
+
 	// Lookup backend service
 	backendService := v1.Service{}
-	backendNS := tcpmap.GetNamespace()
-	if tcpmap.Spec.BackendService.Namespace != "" {
-		backendNS = tcpmap.Spec.BackendService.Namespace
-	}
+	backendKey := tcpservices.BackendServiceKey(tcpmap)
+	tcpmap.Status.Backends = nil
+
+	switch {
+	case tcpmap.Spec.BackendService.KubeConfig != nil && tcpmap.Spec.BackendService.External != nil:
+		msg := "A backend can not be both in a remote cluster and external"
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.ExternalBackendFailedReason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.ExternalBackendFailedReason, msg), ctrl.Result{}, nil
+	case tcpservices.IsWeighted(tcpmap) && (tcpmap.Spec.BackendService.KubeConfig != nil || tcpmap.Spec.BackendService.External != nil):
+		msg := "Weighted backends can not be combined with a remote or external backend"
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.WeightedBackendFailedReason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.WeightedBackendFailedReason, msg), ctrl.Result{}, nil
+	case tcpservices.IsWeighted(tcpmap):
+		svc, err := r.aggregateWeightedBackends(ctx, &tcpmap)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to aggregate the weighted backends: %s", err.Error())
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.WeightedBackendFailedReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.WeightedBackendFailedReason, msg), ctrl.Result{}, err
+		}
+
+		backendService = svc
+	case tcpmap.Spec.BackendService.KubeConfig != nil:
+		svc, err := r.mirrorRemoteBackend(ctx, &tcpmap)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to mirror the remote backend service: %s", err.Error())
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.RemoteBackendFailedReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.RemoteBackendFailedReason, msg), ctrl.Result{}, err
+		}
+
+		backendService = svc
+	case tcpmap.Spec.BackendService.External != nil:
+		svc, err := r.mirrorExternalBackend(ctx, &tcpmap)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to create the service for the external backend: %s", err.Error())
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.ExternalBackendFailedReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.ExternalBackendFailedReason, msg), ctrl.Result{}, err
+		}
+
+		backendService = svc
+	default:
+		if err := r.Client.Get(ctx, backendKey, &backendService); err != nil {
+			msg := "Service not found"
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.BackendServiceNotFoundReason, msg)
+			if kerrors.IsNotFound(err) {
+				if err := r.withdrawStreamSnippet(ctx, &tcpmap); err != nil {
+					return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.BackendServiceNotFoundReason, msg), ctrl.Result{Requeue: true}, err
+				}
+			}
 
-	err := r.Client.Get(ctx, client.ObjectKey{
-		Namespace: backendNS,
-		Name:      tcpmap.Spec.BackendService.Name,
-	}, &backendService)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.BackendServiceNotFoundReason, msg), ctrl.Result{Requeue: true}, err
+		}
+	}
 
+	backendPort, err := getBackendPort(backendService, tcpservices.BackendPort(tcpmap))
 	if err != nil {
-		msg := "Service not found"
-		r.Recorder.Event(&tcpmap, "Normal", "error", msg)
-		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.BackendServiceNotFoundReason, msg), ctrl.Result{Requeue: true}, err
+		msg := "Backend port not found"
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.BackendPortNotFoundReason, msg)
+		if err := r.withdrawStreamSnippet(ctx, &tcpmap); err != nil {
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.BackendPortNotFoundReason, msg), ctrl.Result{Requeue: true}, err
+		}
+
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.BackendPortNotFoundReason, msg), ctrl.Result{Requeue: true}, err
 	}
 
-	frontendService, tcpmap, err := r.getFrontendService(ctx, tcpmap)
+	port := backendPort.Port
+
+	if reason, msg, err := r.validateTLS(ctx, tcpmap); reason != "" {
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, reason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, reason, msg), ctrl.Result{Requeue: reason == v1beta1.TLSSecretNotFoundReason}, err
+	}
+
+	if reason, msg := r.validateLimits(tcpmap); reason != "" {
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, reason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, reason, msg), ctrl.Result{}, nil
+	}
+
+	if reason, msg := r.validateProxyProtocol(tcpmap); reason != "" {
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, reason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, reason, msg), ctrl.Result{}, nil
+	}
+
+	readyEndpoints, err := r.countReadyEndpoints(ctx, backendService, backendPort)
 	if err != nil {
 		return tcpmap, ctrl.Result{}, err
 	}
 
-	cm, tcpmap, err := r.getConfigMap(ctx, tcpmap)
+	tcpmap.Status.ReadyEndpoints = readyEndpoints
+	if readyEndpoints == 0 {
+		msg := "Backend service has no ready endpoints"
+		tcpmap = v1beta1.TCPIngressMappingBackendUnavailable(tcpmap, v1beta1.NoReadyEndpointsReason, msg)
+
+		// Do not publish a new mapping until the backend becomes available.
+		// The mapping gets reconciled again once an EndpointSlice of the backend changes.
+		if r.BackendGating == BackendGatingPublish && tcpmap.Status.ElectedPort == 0 {
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.BackendUnavailableReason, msg), ctrl.Result{}, nil
+		}
+	} else {
+		msg := fmt.Sprintf("Backend service has %d ready endpoints", readyEndpoints)
+		tcpmap = v1beta1.TCPIngressMappingBackendAvailable(tcpmap, v1beta1.EndpointsReadyReason, msg)
+	}
+
+	frontendService, tcpmap, err := r.getFrontendService(ctx, tcpmap)
 	if err != nil {
 		return tcpmap, ctrl.Result{}, err
 	}
 
+	// The envoy fleet is configured by the xDS server from the mappings and their elected ports only
+	var cm v1.ConfigMap
+	if r.usesTCPConfigMap() {
+		cm, tcpmap, err = r.getConfigMap(ctx, tcpmap)
+		if err != nil {
+			return tcpmap, ctrl.Result{}, err
+		}
+	}
+
 	electedPort := tcpmap.Status.ElectedPort
 	var newlyElected int32
-
+	var reissued bool
+	var adopted bool
+	var shared bool
+	// served are the stream snippets (by key) ingress-nginx must be reloaded with before the mapping is ready
+	var served map[string]string
+
+	// The status might have been lost, e.g. after a restore from a backup.
+	// Re-adopt the port still registered for this mapping instead of electing a new one.
 	if tcpmap.Status.ElectedPort == 0 {
-		var ports []int32
-		for _, p := range frontendService.Spec.Ports {
-			ports = append(ports, p.Port)
+		electedPort = adoptPort(tcpmap, frontendService, cm, port)
+		// The port of a mapping which has been suspended is only reserved on the frontend service
+		if electedPort == 0 {
+			electedPort = suspendedPort(frontendService, tcpmap)
 		}
 
-		for k := range cm.Data {
-			p, err := strconv.Atoi(k)
-			if err == nil {
-				ports = append(ports, int32(p))
-			}
+		adopted = electedPort != 0
+
+		if adopted {
+			logger.Info("adopted port registered for this mapping", "port", electedPort)
 		}
+	}
 
-		logger.Info("use port pool", "ports", ports, "elected-port", tcpmap.Status.ElectedPort)
+	// A mapping switching between routing by SNI and a dedicated port gives up its port
+	if sni := sharedSNIPort(frontendService); electedPort != 0 && sni != 0 && (electedPort == sni) != tcpservices.RoutesBySNI(tcpmap) {
+		electedPort = 0
+	}
+
+	// Mappings routed by SNI join the port already shared by others
+	if electedPort == 0 && tcpservices.RoutesBySNI(tcpmap) {
+		electedPort = sharedSNIPort(frontendService)
+		shared = electedPort != 0
+	}
 
-		electedPort = r.findPort(ports)
+	if electedPort == 0 {
+		var retry time.Duration
+		electedPort, reissued, retry = r.electPort(tcpmap, frontendService, cm)
 		newlyElected = electedPort
 
-		if electedPort == 0 {
+		if electedPort == 0 && retry > 0 {
+			msg := "No port can be elected until a held down port is released"
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.NoPortElectedReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.NoPortElectedReason, msg), ctrl.Result{RequeueAfter: retry}, nil
+		} else if electedPort == 0 {
 			msg := "No port can be elected"
-			r.Recorder.Event(&tcpmap, "Normal", "error", msg)
-			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.BackendPortNotFoundReason, msg), ctrl.Result{Requeue: true}, nil
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.NoPortElectedReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.NoPortElectedReason, msg), ctrl.Result{Requeue: true}, nil
 		}
 
-		logger.Info("elected free port", "port", electedPort)
+		logger.Info("elected free port", "port", electedPort, "reissued", reissued)
+
+		// Free the reserved port again unless it has been persisted in the status
+		defer func() {
+			if tcpmap.Status.ElectedPort == 0 {
+				r.ports.release(frontendService, cm, electedPort)
+			}
+		}()
 	}
 
-	port, err := getBackendPort(backendService, tcpmap.Spec.BackendService.Port)
-	if err != nil {
-		msg := "Backend port not found"
-		r.Recorder.Event(&tcpmap, "Normal", "error", msg)
-		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.BackendPortNotFoundReason, msg), ctrl.Result{Requeue: true}, err
+	// The port is declared using server-side apply on every reconciliation.
+	// The mapping owns only its own port, a previously elected port is released by the api server.
+	// The port shared by mappings routed by SNI is declared with identical values by each of them
+	portName := frontendPortName(tcpmap)
+	if tcpservices.RoutesBySNI(tcpmap) {
+		portName = tcpservices.SNIPortName
+	}
+
+	err = r.applyFrontendPorts(ctx, &tcpmap, &frontendService, corev1ac.ServicePort().
+		WithName(portName).
+		WithPort(electedPort).
+		WithTargetPort(intstr.FromInt(int(electedPort))).
+		WithProtocol(v1.ProtocolTCP))
+
+	if kerrors.IsConflict(err) {
+		msg := fmt.Sprintf("Port %d on the fronted service is managed by another field manager: %s", electedPort, err.Error())
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FieldManagerConflictReason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FieldManagerConflictReason, msg), ctrl.Result{Requeue: true}, nil
+	} else if err != nil {
+		msg := "Failed to add port to the fronted service"
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterFrontendPortReason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterFrontendPortReason, msg), ctrl.Result{Requeue: true}, err
+	} else {
+		logger.Info("added port to frontend", "port", electedPort)
+	}
+
+	data := map[string]string{
+		strconv.Itoa(int(electedPort)): tcpservices.Entry{
+			Namespace: backendKey.Namespace,
+			Service:   backendKey.Name,
+			Port:      strconv.Itoa(int(port)),
+			Decode:    downstreamProxyProtocol(tcpmap, r.Provider),
+			Encode:    upstreamProxyProtocol(tcpmap) != "",
+		}.String(),
 	}
 
-	if !hasPort(frontendService, electedPort) {
-		portName := fmt.Sprintf("%s-%s", backendNS, tcpmap.Spec.BackendService.Name)
-		//remove port by name if it exists
-		for k, v := range frontendService.Spec.Ports {
-			if v.Name == portName {
-				frontendService.Spec.Ports = append(frontendService.Spec.Ports[:k], frontendService.Spec.Ports[k+1:]...)
+	if tcpservices.RoutesBySNI(tcpmap) {
+		snippets, err := r.getStreamSnippetConfigMap(ctx, frontendService)
+		if err == nil {
+			if other, conflict := sniConflict(snippets, tcpmap, electedPort); conflict {
+				msg := fmt.Sprintf("Hostname %s on port %d is already bound by %s", tcpmap.Spec.TLS.Hostname, electedPort, other)
+				r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.SNIHostnameConflictReason, msg)
+				return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.SNIHostnameConflictReason, msg), ctrl.Result{Requeue: true}, nil
 			}
+
+			err = r.applySNIRoute(ctx, &tcpmap, &snippets, electedPort, port)
 		}
 
-		frontendService.Spec.Ports = append(frontendService.Spec.Ports, v1.ServicePort{
-			Name:       portName,
-			Port:       electedPort,
-			TargetPort: intstr.FromInt(int(electedPort)),
-			Protocol:   v1.ProtocolTCP,
-		})
+		if kerrors.IsConflict(err) {
+			msg := fmt.Sprintf("Port %d in the stream snippet configmap is managed by another field manager: %s", electedPort, err.Error())
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FieldManagerConflictReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FieldManagerConflictReason, msg), ctrl.Result{Requeue: true}, nil
+		} else if err != nil {
+			msg := "Failed to add the route by SNI to the stream snippet configmap"
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterConfigMapPortReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterConfigMapPortReason, msg), ctrl.Result{Requeue: true}, err
+		}
 
-		if err := r.patchService(ctx, &frontendService); err != nil {
-			msg := "Failed to add port to the fronted service"
-			r.Recorder.Event(&tcpmap, "Normal", "error", msg)
-			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterFrontendPortReason, msg), ctrl.Result{Requeue: true}, err
-		} else {
-			logger.Info("added port to frontend", "port", electedPort)
+		if err := r.syncStreamSnippet(ctx, &tcpmap, frontendService, snippets); err != nil {
+			msg := "Failed to render the stream snippets into the ingress-nginx configmap"
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterConfigMapPortReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterConfigMapPortReason, msg), ctrl.Result{Requeue: true}, err
 		}
-	}
 
-	if cm.Data == nil {
-		cm.Data = make(map[string]string)
+		logger.Info("added route by SNI to stream snippets", "port", electedPort, "hostname", tcpmap.Spec.TLS.Hostname)
+
+		served = make(map[string]string)
+		for _, key := range []string{nginx.SNIServerKey(electedPort), nginx.SNIRouteKey(tcpmap.Namespace, tcpmap.Name, electedPort)} {
+			served[key] = snippets.Data[key]
+		}
+
+		// The port is served by the stream snippet, an entry in the tcp configmap would collide with it
+		data = nil
+	} else if r.usesTCPConfigMap() && tcpservices.ServedBySnippet(tcpmap) {
+		snippets, err := r.getStreamSnippetConfigMap(ctx, frontendService)
+		if err == nil {
+			err = r.applyStreamSnippet(ctx, &tcpmap, frontendService, &snippets, electedPort, port)
+		}
+
+		if kerrors.IsConflict(err) {
+			msg := fmt.Sprintf("Port %d in the stream snippet configmap is managed by another field manager: %s", electedPort, err.Error())
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FieldManagerConflictReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FieldManagerConflictReason, msg), ctrl.Result{Requeue: true}, nil
+		} else if err != nil {
+			msg := "Failed to add the server block to the stream snippet configmap"
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterConfigMapPortReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterConfigMapPortReason, msg), ctrl.Result{Requeue: true}, err
+		}
+
+		if err := r.syncStreamSnippet(ctx, &tcpmap, frontendService, snippets); err != nil {
+			msg := "Failed to render the stream snippets into the ingress-nginx configmap"
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterConfigMapPortReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterConfigMapPortReason, msg), ctrl.Result{Requeue: true}, err
+		}
+
+		logger.Info("added server block to stream snippets", "port", electedPort)
+
+		key := nginx.SnippetKey(tcpmap.Namespace, tcpmap.Name)
+		served = map[string]string{key: snippets.Data[key]}
+
+		// The port is served by the stream snippet, an entry in the tcp configmap would collide with it
+		data = nil
+	} else if err := r.releaseStreamSnippet(ctx, &tcpmap, frontendService); err != nil {
+		msg := "Failed to remove the server block from the stream snippet configmap"
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterConfigMapPortReason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterConfigMapPortReason, msg), ctrl.Result{Requeue: true}, err
 	}
 
-	p := strconv.Itoa(int(electedPort))
-	//if _, ok := cm.Data[p]; !ok {
-	cm.Data[p] = fmt.Sprintf(
-		"%s/%s:%d:PROXY", backendNS, tcpmap.Spec.BackendService.Name, port,
-	)
+	if r.usesTCPConfigMap() {
+		err = r.applyConfigMapData(ctx, &tcpmap, &cm, data)
+	}
 
-	if err := r.patchConfigMap(ctx, &cm); err != nil {
+	if kerrors.IsConflict(err) {
+		msg := fmt.Sprintf("Port %d in the tcp configmap is managed by another field manager: %s", electedPort, err.Error())
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FieldManagerConflictReason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FieldManagerConflictReason, msg), ctrl.Result{Requeue: true}, nil
+	} else if err != nil {
 		msg := "Failed to add port to the tcp configmap"
-		r.Recorder.Event(&tcpmap, "Normal", "error", msg)
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterConfigMapPortReason, msg)
 		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterConfigMapPortReason, msg), ctrl.Result{Requeue: true}, err
-	} else {
+	} else if r.usesTCPConfigMap() {
 		logger.Info("added port to cm", "port", electedPort)
 	}
-	//}
 
-	if newlyElected != 0 {
+	if reissued {
+		if err := r.forgetReleasedPort(ctx, &tcpmap, &frontendService, electedPort); err != nil {
+			msg := "Failed to remove the re-issued port from the held down ports"
+			r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterFrontendPortReason, msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterFrontendPortReason, msg), ctrl.Result{Requeue: true}, err
+		}
+	}
+
+	// A resumed mapping has registered its port again, the reservation is not needed anymore
+	if err := r.releaseSuspendedPort(ctx, &tcpmap, &frontendService); err != nil {
+		msg := "Failed to release the port reserved for the suspended mapping"
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FailedRegisterFrontendPortReason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FailedRegisterFrontendPortReason, msg), ctrl.Result{Requeue: true}, err
+	}
+
+	connectionWritten, err := r.writeConnection(ctx, &tcpmap, frontendService, electedPort)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to write the connection details: %s", err.Error())
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.ConnectionWriteFailedReason, msg)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.ConnectionWriteFailedReason, msg), ctrl.Result{}, err
+	}
+
+	if r.DryRun {
+		msg := fmt.Sprintf("Dry-run, %d changes planned for port %d", len(tcpmap.Status.PlannedChanges), electedPort)
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.DryRunReason, msg), ctrl.Result{}, nil
+	}
+
+	msg := "Port mapping successfully registered"
+	if adopted {
+		tcpmap.Status.ElectedPort = electedPort
+		tcpmap = r.portChanged(tcpmap, electedPort, v1beta1.PortAdopted, fmt.Sprintf("Port %d adopted as it is still registered for this mapping", electedPort))
+	} else if reissued {
 		tcpmap.Status.ElectedPort = electedPort
-		msg := "Port mapping successfully registered"
-		r.Recorder.Event(&tcpmap, "Normal", "info", msg)
-		return v1beta1.TCPIngressMappingReady(tcpmap, v1beta1.PortReadyReason, msg), ctrl.Result{}, err
+		tcpmap = r.portChanged(tcpmap, electedPort, v1beta1.PortReissued, fmt.Sprintf("Port %d re-issued as it was released by this mapping within the hold-down period", electedPort))
+	} else if shared {
+		tcpmap.Status.ElectedPort = electedPort
+		tcpmap = r.portChanged(tcpmap, electedPort, v1beta1.PortElected, fmt.Sprintf("Port %d shared with the mappings routed by SNI", electedPort))
+	} else if newlyElected != 0 {
+		tcpmap.Status.ElectedPort = electedPort
+		tcpmap = r.portChanged(tcpmap, electedPort, v1beta1.PortElected, fmt.Sprintf("Port %d elected", electedPort))
 	}
 
-	return tcpmap, ctrl.Result{}, nil
-}
+	// The mapping is reconciled again once the load balancer of the frontend service got an address
+	if !connectionWritten {
+		msg := "Port mapping registered but the load balancer of the frontend service has no address for the connection details yet"
+		return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.ConnectionPendingReason, msg), ctrl.Result{}, nil
+	}
 
-func hasPort(svc v1.Service, port int32) bool {
-	for _, v := range svc.Spec.Ports {
-		if v.Port == port {
-			return true
+	if len(served) > 0 {
+		if ok, msg, err := r.snippetsServed(ctx, frontendService, served); err != nil {
+			return tcpmap, ctrl.Result{}, err
+		} else if !ok {
+			logger.Info("stream snippets not served yet", "reason", msg)
+			return v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.SnippetPendingReason, msg), ctrl.Result{RequeueAfter: snippetPendingInterval}, nil
 		}
 	}
 
-	return false
+	if readyEndpoints == 0 && r.BackendGating != BackendGatingNone && r.BackendGating != "" {
+		tcpmap = v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.BackendUnavailableReason, "Port mapping registered but backend service has no ready endpoints")
+	} else {
+		tcpmap = v1beta1.TCPIngressMappingReady(tcpmap, v1beta1.PortReadyReason, msg)
+	}
+
+	if r.Prober == nil {
+		return tcpmap, ctrl.Result{}, nil
+	}
+
+	return r.probe(ctx, tcpmap, frontendService, electedPort, logger)
+}
+
+// probe dials the published port on the frontend service and records the result as Reachable condition.
+// Failed probes are requeued using the rate limiter backoff while successful ones are probed again after the probe interval.
+func (r *TCPIngressMappingReconciler) probe(ctx context.Context, tcpmap v1beta1.TCPIngressMapping, frontendService v1.Service, port int32, logger logr.Logger) (v1beta1.TCPIngressMapping, ctrl.Result, error) {
+	host := frontendAddress(frontendService)
+	if host == "" {
+		msg := "Frontend service has no address which can be probed"
+		return v1beta1.TCPIngressMappingUnreachable(tcpmap, v1beta1.ProbeFailedReason, msg), ctrl.Result{Requeue: true}, nil
+	}
+
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	latency, err := r.Prober.Probe(ctx, address, r.Prober.bannerFor(tcpmap))
+	if err != nil {
+		probeDuration.WithLabelValues(tcpmap.Namespace, tcpmap.Name, "failure").Observe(latency.Seconds())
+		logger.Info("frontend port probe failed", "address", address, "error", err.Error())
+		msg := fmt.Sprintf("Probe of %s failed: %s", address, err.Error())
+		return v1beta1.TCPIngressMappingUnreachable(tcpmap, v1beta1.ProbeFailedReason, msg), ctrl.Result{Requeue: true}, nil
+	}
+
+	probeDuration.WithLabelValues(tcpmap.Namespace, tcpmap.Name, "success").Observe(latency.Seconds())
+	msg := fmt.Sprintf("Probe of %s succeeded", address)
+	return v1beta1.TCPIngressMappingReachable(tcpmap, v1beta1.ProbeSucceededReason, msg), ctrl.Result{RequeueAfter: r.Prober.Interval}, nil
+}
+
+// portChanged records a port change in the port history and emits a PortChanged event
+func (r *TCPIngressMappingReconciler) portChanged(tcpmap v1beta1.TCPIngressMapping, port int32, reason v1beta1.PortChangeReason, msg string) v1beta1.TCPIngressMapping {
+	r.Recorder.AnnotatedEventf(&tcpmap, map[string]string{
+		v1beta1.PortAnnotation:             strconv.Itoa(int(port)),
+		v1beta1.PortChangeReasonAnnotation: string(reason),
+	}, v1.EventTypeNormal, v1beta1.PortChangedEventReason, "%s", msg)
+
+	return v1beta1.TCPIngressMappingPortChanged(tcpmap, port, reason, msg)
+}
+
+// backendReference returns the backend service in the format namespace/name as used in the tcp configmap
+func backendReference(tcpmap v1beta1.TCPIngressMapping) string {
+	return tcpservices.BackendServiceKey(tcpmap).String()
+}
+
+// frontendPortName returns the name of the port on the frontend service
+func frontendPortName(tcpmap v1beta1.TCPIngressMapping) string {
+	key := tcpservices.BackendServiceKey(tcpmap)
+	return tcpservices.PortName(key.Namespace, key.Name)
 }
 
-func getBackendPort(svc v1.Service, port intstr.IntOrString) (int32, error) {
+func getBackendPort(svc v1.Service, port intstr.IntOrString) (v1.ServicePort, error) {
 	for _, v := range svc.Spec.Ports {
 		if v.Name == port.String() {
-			return v.Port, nil
+			return v, nil
 		}
 		if int(v.Port) == port.IntValue() {
-			return v.Port, nil
+			return v, nil
 		}
 	}
 
-	return 0, ErrPortNotFound
+	return v1.ServicePort{}, ErrPortNotFound
 }
 
-func (r *TCPIngressMappingReconciler) findPort(ports []int32) int32 {
-	minPort := r.MinPort
-	if minPort == 0 {
-		minPort = 1025
+// countReadyEndpoints returns the number of ready endpoints serving the given service port
+// An ExternalName service has no endpoints, its external name is considered as a single ready endpoint.
+func (r *TCPIngressMappingReconciler) countReadyEndpoints(ctx context.Context, svc v1.Service, port v1.ServicePort) (int32, error) {
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		return 1, nil
 	}
 
-	maxPort := r.MaxPort
-	if minPort == 0 {
-		maxPort = 65535
+	var slices discoveryv1.EndpointSliceList
+	if err := r.List(ctx, &slices, client.InNamespace(svc.Namespace), client.MatchingLabels{
+		discoveryv1.LabelServiceName: svc.Name,
+	}); err != nil {
+		return 0, err
 	}
 
-OUTER:
-	for i := int32(minPort); i <= int32(maxPort); i++ {
-		for _, e := range ports {
-			if e == i {
-				continue OUTER
+	var ready int32
+	for _, slice := range slices.Items {
+		if !hasEndpointPort(slice, port) {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			// A nil ready condition must be interpreted as ready
+			if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+				ready++
 			}
 		}
+	}
+
+	return ready, nil
+}
+
+func hasEndpointPort(slice discoveryv1.EndpointSlice, port v1.ServicePort) bool {
+	for _, p := range slice.Ports {
+		name := ""
+		if p.Name != nil {
+			name = *p.Name
+		}
 
-		return i
+		if name == port.Name {
+			return true
+		}
 	}
 
-	return 0
+	return false
 }
 
 func (r *TCPIngressMappingReconciler) getFrontendService(ctx context.Context, tcpmap v1beta1.TCPIngressMapping) (v1.Service, v1beta1.TCPIngressMapping, error) {
 	// Lookup frontend service
 	frontendService := v1.Service{}
-	ns := tcpmap.GetNamespace()
-	name := ""
 
-	if r.FrontendService == "" && tcpmap.Spec.FrontendService == nil {
+	key, ok := r.frontendServiceKey(tcpmap)
+	if !ok {
 		msg := "Neither a frontendService nor a default one have been specified"
-		r.Recorder.Event(&tcpmap, "Normal", "info", msg)
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FrontendServiceNotFoundReason, msg)
 		return frontendService, v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FrontendServiceNotFoundReason, msg), errors.New(msg)
-	} else {
-		if r.FrontendService == "" {
-			name = tcpmap.Spec.FrontendService.Name
-			if tcpmap.Spec.FrontendService.Namespace != "" {
-				ns = tcpmap.Spec.FrontendService.Namespace
-			}
-		} else {
-			parts := strings.Split(r.FrontendService, "/")
-			if len(parts) == 1 {
-				name = parts[0]
-			} else {
-				ns = parts[0]
-				name = parts[1]
-			}
-		}
 	}
 
-	err := r.Client.Get(ctx, client.ObjectKey{
-		Namespace: ns,
-		Name:      name,
-	}, &frontendService)
+	err := r.Client.Get(ctx, key, &frontendService)
 
 	if err != nil {
 		msg := "Service not found"
-		r.Recorder.Event(&tcpmap, "Normal", "info", msg)
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.FrontendServiceNotFoundReason, msg)
 		return frontendService, v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.FrontendServiceNotFoundReason, msg), err
 	}
 
@@ -431,62 +1031,29 @@ func (r *TCPIngressMappingReconciler) getFrontendService(ctx context.Context, tc
 func (r *TCPIngressMappingReconciler) getConfigMap(ctx context.Context, tcpmap v1beta1.TCPIngressMapping) (v1.ConfigMap, v1beta1.TCPIngressMapping, error) {
 	// Lookup configmap
 	cm := v1.ConfigMap{}
-	ns := tcpmap.GetNamespace()
-	name := ""
 
-	if r.TCPConfigMap == "" && tcpmap.Spec.TCPConfigMap == nil {
+	key, ok := r.tcpConfigMapKey(tcpmap)
+	if !ok {
 		msg := "Neither a ConfigMap nor a default one have been specified"
-		r.Recorder.Event(&tcpmap, "Normal", "info", msg)
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.TCPConfigMapNotFoundReason, msg)
 		return cm, v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.TCPConfigMapNotFoundReason, msg), nil
-	} else {
-		if r.TCPConfigMap == "" {
-			name = tcpmap.Spec.TCPConfigMap.Name
-			if tcpmap.Spec.TCPConfigMap.Namespace != "" {
-				ns = tcpmap.Spec.TCPConfigMap.Namespace
-			}
-		} else {
-			parts := strings.Split(r.TCPConfigMap, "/")
-			if len(parts) == 1 {
-				name = parts[0]
-			} else {
-				ns = parts[0]
-				name = parts[1]
-			}
-		}
 	}
 
-	err := r.Client.Get(ctx, client.ObjectKey{
-		Namespace: ns,
-		Name:      name,
-	}, &cm)
+	err := r.Client.Get(ctx, key, &cm)
 
 	if err != nil {
 		msg := "ConfigMap not found"
-		r.Recorder.Event(&tcpmap, "Normal", "info", msg)
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.TCPConfigMapNotFoundReason, msg)
 		return cm, v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.TCPConfigMapNotFoundReason, msg), nil
 	}
 
-	return cm, tcpmap, err
-}
-
-func (r *TCPIngressMappingReconciler) patchConfigMap(ctx context.Context, cm *v1.ConfigMap) error {
-	key := client.ObjectKeyFromObject(cm)
-	latest := &v1.ConfigMap{}
-	if err := r.Client.Get(ctx, key, latest); err != nil {
-		return err
-	}
-
-	return r.Client.Patch(ctx, cm, client.StrategicMergeFrom(latest))
-}
-
-func (r *TCPIngressMappingReconciler) patchService(ctx context.Context, svc *v1.Service) error {
-	key := client.ObjectKeyFromObject(svc)
-	latest := &v1.Service{}
-	if err := r.Client.Get(ctx, key, latest); err != nil {
-		return err
+	if err := guardShard(&cm, r.Shard); err != nil {
+		msg := fmt.Sprintf("ConfigMap does not belong to the shard of the frontend service: %s", err.Error())
+		r.Recorder.Event(&tcpmap, v1.EventTypeWarning, v1beta1.ShardMismatchReason, msg)
+		return cm, v1beta1.TCPIngressMappingNotReady(tcpmap, v1beta1.ShardMismatchReason, msg), err
 	}
 
-	return r.Client.Patch(ctx, svc, client.StrategicMergeFrom(latest))
+	return cm, tcpmap, err
 }
 
 func (r *TCPIngressMappingReconciler) patchStatus(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping) error {
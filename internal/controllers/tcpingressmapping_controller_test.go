@@ -0,0 +1,246 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func endpointSlice(name, service string, port *string, ready ...*bool) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Name: port}},
+	}
+
+	for _, r := range ready {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{"10.0.0.1"},
+			Conditions: discoveryv1.EndpointConditions{Ready: r},
+		})
+	}
+
+	return slice
+}
+
+func TestCountReadyEndpoints(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+
+	yes, no := true, false
+	postgres, metrics, unnamed := "postgres", "metrics", ""
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		endpointSlice("db-1", "db", &postgres, &yes, nil, &no),
+		endpointSlice("db-2", "db", &postgres, &yes),
+		endpointSlice("db-3", "db", &metrics, &yes, &yes),
+		endpointSlice("other", "other", &postgres, &yes),
+		endpointSlice("single-1", "single", nil, &yes, &no),
+		endpointSlice("single-2", "single", &unnamed, nil),
+	).Build()
+
+	r := &TCPIngressMappingReconciler{Client: c}
+
+	tests := []struct {
+		name    string
+		service v1.Service
+		port    v1.ServicePort
+		ready   int32
+	}{
+		{
+			name:    "nil ready condition is ready and not ready ones are skipped",
+			service: v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}},
+			port:    v1.ServicePort{Name: "postgres", Port: 5432},
+			ready:   3,
+		},
+		{
+			name:    "slices of other ports are skipped",
+			service: v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}},
+			port:    v1.ServicePort{Name: "metrics", Port: 9090},
+			ready:   2,
+		},
+		{
+			name:    "unknown port",
+			service: v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"}},
+			port:    v1.ServicePort{Name: "http", Port: 80},
+		},
+		{
+			name:    "unnamed port of a single port service",
+			service: v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "single"}},
+			port:    v1.ServicePort{Port: 5432},
+			ready:   2,
+		},
+		{
+			name:    "no endpoint slices",
+			service: v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "missing"}},
+			port:    v1.ServicePort{Name: "postgres", Port: 5432},
+		},
+		{
+			name:    "external name",
+			service: v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "external"}, Spec: v1.ServiceSpec{Type: v1.ServiceTypeExternalName}},
+			port:    v1.ServicePort{Port: 5432},
+			ready:   1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ready, err := r.countReadyEndpoints(context.TODO(), test.service, test.port)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ready != test.ready {
+				t.Errorf("expected %d ready endpoints, got %d", test.ready, ready)
+			}
+		})
+	}
+}
+
+func TestReconcileBackendGatingPublish(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	no := false
+	postgres := "postgres"
+	tcpmap := &v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Spec: v1beta1.TCPIngressMappingSpec{
+			BackendService: v1beta1.BackendService{Name: "db", Port: intstr.FromString("postgres")},
+		},
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		tcpmap,
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "postgres", Port: 5432}}},
+		},
+		endpointSlice("db-1", "db", &postgres, &no),
+	).Build()
+
+	r := &TCPIngressMappingReconciler{Client: c, Recorder: record.NewFakeRecorder(10), BackendGating: BackendGatingPublish}
+
+	// A new mapping is not published while the backend has no ready endpoints
+	gated, _, err := r.reconcile(context.TODO(), *tcpmap, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gated.Status.ElectedPort != 0 || gated.Status.ReadyEndpoints != 0 {
+		t.Errorf("expected no elected port and no ready endpoints, got %d and %d", gated.Status.ElectedPort, gated.Status.ReadyEndpoints)
+	}
+
+	if ready := apimeta.FindStatusCondition(gated.Status.Conditions, v1beta1.ReadyCondition); ready == nil || ready.Reason != v1beta1.BackendUnavailableReason {
+		t.Errorf("expected the Ready reason %s, got %v", v1beta1.BackendUnavailableReason, ready)
+	}
+
+	if available := apimeta.FindStatusCondition(gated.Status.Conditions, v1beta1.BackendAvailableCondition); available == nil || available.Status != metav1.ConditionFalse {
+		t.Errorf("expected the backend to be unavailable, got %v", available)
+	}
+
+	// Once an endpoint is ready the gating is passed and the frontend service is looked up
+	var slice discoveryv1.EndpointSlice
+	if err := c.Get(context.TODO(), client.ObjectKey{Namespace: "default", Name: "db-1"}, &slice); err != nil {
+		t.Fatal(err)
+	}
+
+	slice.Endpoints[0].Conditions.Ready = nil
+	if err := c.Update(context.TODO(), &slice); err != nil {
+		t.Fatal(err)
+	}
+
+	published, _, _ := r.reconcile(context.TODO(), *tcpmap, logr.Discard())
+	if published.Status.ReadyEndpoints != 1 {
+		t.Errorf("expected 1 ready endpoint, got %d", published.Status.ReadyEndpoints)
+	}
+
+	if available := apimeta.FindStatusCondition(published.Status.Conditions, v1beta1.BackendAvailableCondition); available == nil || available.Status != metav1.ConditionTrue {
+		t.Errorf("expected the backend to be available, got %v", available)
+	}
+
+	if ready := apimeta.FindStatusCondition(published.Status.Conditions, v1beta1.ReadyCondition); ready == nil || ready.Reason == v1beta1.BackendUnavailableReason {
+		t.Errorf("expected the gating to be passed, got %v", ready)
+	}
+}
+
+func TestPortChanged(t *testing.T) {
+	recorder := record.NewFakeRecorder(2 * v1beta1.MaxPortHistory)
+	r := &TCPIngressMappingReconciler{Recorder: recorder}
+	tcpmap := v1beta1.TCPIngressMapping{}
+
+	for port := int32(1024); port < 1024+v1beta1.MaxPortHistory+2; port++ {
+		tcpmap = r.portChanged(tcpmap, port, v1beta1.PortElected, fmt.Sprintf("Port %d elected", port))
+	}
+
+	history := tcpmap.Status.PortHistory
+	if len(history) != v1beta1.MaxPortHistory {
+		t.Fatalf("expected the port history to be capped at %d entries, got %d", v1beta1.MaxPortHistory, len(history))
+	}
+
+	if history[0].Port != 1026 || history[len(history)-1].Port != 1024+v1beta1.MaxPortHistory+1 {
+		t.Errorf("expected the oldest entries to be dropped, got ports %d to %d", history[0].Port, history[len(history)-1].Port)
+	}
+
+	expected := "Normal PortChanged Port 1024 elected map[tcpmap.infra.doodle.com/port:1024 tcpmap.infra.doodle.com/port-change-reason:Elected]"
+	if event := <-recorder.Events; event != expected {
+		t.Errorf("expected event %q, got %q", expected, event)
+	}
+}
+
+// The event reasons, port change reasons and annotations are part of the API, alerts and dashboards rely on them
+func TestEventReasons(t *testing.T) {
+	reasons := map[string]string{
+		v1beta1.PortChangedEventReason:         "PortChanged",
+		v1beta1.DryRunEventReason:              "DryRun",
+		v1beta1.FailedCreateMappingEventReason: "FailedCreateMapping",
+		v1beta1.FailedDeleteMappingEventReason: "FailedDeleteMapping",
+		string(v1beta1.PortElected):            "Elected",
+		string(v1beta1.PortReissued):           "Reissued",
+		string(v1beta1.PortReleased):           "Released",
+		string(v1beta1.PortAdopted):            "Adopted",
+		v1beta1.PortAnnotation:                 "tcpmap.infra.doodle.com/port",
+		v1beta1.PortChangeReasonAnnotation:     "tcpmap.infra.doodle.com/port-change-reason",
+	}
+
+	for reason, expected := range reasons {
+		if reason != expected {
+			t.Errorf("expected %q, got %q", expected, reason)
+		}
+	}
+}
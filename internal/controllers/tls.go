@@ -0,0 +1,254 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/nginx"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+)
+
+// DefaultTLSDir is the directory in the ingress-nginx pods the managed tls secret is mounted at
+const DefaultTLSDir = "/etc/tcpmap-controller/tls"
+
+// DefaultNginxResolver is the DNS server nginx resolves the backends of the stream snippets with
+const DefaultNginxResolver = "kube-dns.kube-system.svc.cluster.local"
+
+// DefaultClusterDomain is the domain the in-cluster addresses of services are qualified with
+const DefaultClusterDomain = "cluster.local"
+
+// validateTLS verifies that TLS of a mapping can be terminated or routed by SNI.
+// The tcp services configmap of ingress-nginx only forwards connections, hence a stream snippet configmap is required.
+func (r *TCPIngressMappingReconciler) validateTLS(ctx context.Context, tcpmap v1beta1.TCPIngressMapping) (string, string, error) {
+	if !r.usesTCPConfigMap() && (tcpservices.TerminatesTLS(tcpmap) || tcpservices.RoutesBySNI(tcpmap)) {
+		return v1beta1.TLSUnsupportedReason, fmt.Sprintf("TLS termination and routing by SNI are not supported by the %s provider", r.Provider), nil
+	}
+
+	if tcpservices.RoutesBySNI(tcpmap) {
+		switch {
+		case r.StreamSnippetConfigMap == "" || r.IngressNginxConfigMap == "":
+			return v1beta1.TLSUnsupportedReason, "The tcp services configmap of ingress-nginx can not route by SNI, --stream-snippet-configmap and --ingress-nginx-configmap are required", nil
+		case tcpmap.Spec.TLS.Mode != v1beta1.TLSPassthrough:
+			return v1beta1.TLSUnsupportedReason, "Routing by SNI is only supported in the Passthrough mode", nil
+		case r.NginxResolver == "":
+			return v1beta1.TLSUnsupportedReason, "Routing by SNI requires --nginx-resolver to resolve the backends", nil
+		}
+
+		return "", "", nil
+	}
+
+	if !tcpservices.TerminatesTLS(tcpmap) {
+		return "", "", nil
+	}
+
+	if r.StreamSnippetConfigMap == "" || r.IngressNginxConfigMap == "" || r.TLSSecret == "" {
+		return v1beta1.TLSUnsupportedReason, "TLS can not be terminated by the tcp services configmap of ingress-nginx, --stream-snippet-configmap, --ingress-nginx-configmap and --tls-secret are required", nil
+	}
+
+	if tcpmap.Spec.TLS.SecretRef == nil {
+		return v1beta1.TLSSecretNotFoundReason, "A secretRef is required to terminate TLS", nil
+	}
+
+	secret := v1.Secret{}
+	key := types.NamespacedName{Namespace: tcpmap.Namespace, Name: tcpmap.Spec.TLS.SecretRef.Name}
+	if err := r.Client.Get(ctx, key, &secret); kerrors.IsNotFound(err) {
+		return v1beta1.TLSSecretNotFoundReason, fmt.Sprintf("TLS secret %s not found", key), nil
+	} else if err != nil {
+		return v1beta1.TLSSecretNotFoundReason, fmt.Sprintf("Failed to get TLS secret %s", key), err
+	}
+
+	for _, k := range []string{v1.TLSCertKey, v1.TLSPrivateKeyKey} {
+		if _, ok := secret.Data[k]; !ok {
+			return v1beta1.TLSSecretNotFoundReason, fmt.Sprintf("TLS secret %s has no key %s", key, k), nil
+		}
+	}
+
+	return "", "", nil
+}
+
+// getStreamSnippetConfigMap returns the stream snippet configmap.
+// Without a namespace it is looked up in the namespace of the frontend service.
+func (r *TCPIngressMappingReconciler) getStreamSnippetConfigMap(ctx context.Context, frontendService v1.Service) (v1.ConfigMap, error) {
+	cm := v1.ConfigMap{}
+	err := r.Client.Get(ctx, tcpservices.ParseRef(frontendService.Namespace, r.StreamSnippetConfigMap), &cm)
+	return cm, err
+}
+
+// applyStreamSnippet declares the stream server block of a mapping terminating TLS or limiting connections.
+// Without a port the snippets previously declared by the mapping are removed.
+func (r *TCPIngressMappingReconciler) applyStreamSnippet(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, frontendService v1.Service, cm *v1.ConfigMap, port, backendPort int32) error {
+	if port == 0 {
+		if err := r.applyCertificate(ctx, tcpmap, frontendService, false); err != nil {
+			return err
+		}
+
+		if !managedBy(cm.ManagedFields, fieldManagerFor(*tcpmap)) {
+			return nil
+		}
+
+		return r.applyConfigMapData(ctx, tcpmap, cm, nil)
+	}
+
+	backend := tcpservices.BackendServiceKey(*tcpmap)
+	server := nginx.Server{
+		Name:                  objectKey(tcpmap).String(),
+		Port:                  port,
+		ProxyProtocol:         downstreamProxyProtocol(*tcpmap, r.Provider),
+		UpstreamProxyProtocol: upstreamProxyProtocol(*tcpmap) != "",
+		Upstream:              r.serviceAddress(backend, backendPort),
+		Resolver:              r.NginxResolver,
+	}
+
+	// The certificate is written before the server block referencing it
+	if err := r.applyCertificate(ctx, tcpmap, frontendService, tcpservices.TerminatesTLS(*tcpmap)); err != nil {
+		return err
+	}
+
+	if tcpservices.TerminatesTLS(*tcpmap) {
+		secret := v1.Secret{}
+		if err := r.Client.Get(ctx, types.NamespacedName{Namespace: tcpmap.Namespace, Name: tcpmap.Spec.TLS.SecretRef.Name}, &secret); err != nil {
+			return err
+		}
+
+		name := nginx.CertificateName(secret.Namespace, secret.Name, secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+		server.Certificate, server.CertificateKey = nginx.CertificateFiles(r.TLSDir, name)
+	}
+
+	if limits := tcpmap.Spec.Limits; limits != nil {
+		server.MaxConnections = limits.MaxConnections
+		if limits.ConnectTimeout != nil {
+			server.ConnectTimeout = limits.ConnectTimeout.Duration
+		}
+
+		if limits.IdleTimeout != nil {
+			server.IdleTimeout = limits.IdleTimeout.Duration
+		}
+	}
+
+	return r.applyConfigMapData(ctx, tcpmap, cm, map[string]string{
+		nginx.SnippetKey(tcpmap.Namespace, tcpmap.Name): server.String(),
+	})
+}
+
+// applyCertificate copies the certificate and key of the tls secret of a mapping into the managed tls secret
+// which is mounted into the ingress-nginx pods. Without terminate the certificate previously copied by the mapping is removed.
+func (r *TCPIngressMappingReconciler) applyCertificate(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, frontendService v1.Service, terminate bool) error {
+	if r.TLSSecret == "" {
+		return nil
+	}
+
+	managed := v1.Secret{}
+	if err := r.Client.Get(ctx, tcpservices.ParseRef(frontendService.Namespace, r.TLSSecret), &managed); err != nil {
+		if !terminate {
+			return client.IgnoreNotFound(err)
+		}
+
+		return err
+	}
+
+	if !terminate {
+		if !managedBy(managed.ManagedFields, fieldManagerFor(*tcpmap)) {
+			return nil
+		}
+
+		return r.applySecretData(ctx, tcpmap, &managed, nil)
+	}
+
+	secret := v1.Secret{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: tcpmap.Namespace, Name: tcpmap.Spec.TLS.SecretRef.Name}, &secret); err != nil {
+		return err
+	}
+
+	cert, key := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+	name := nginx.CertificateName(secret.Namespace, secret.Name, cert, key)
+	return r.applySecretData(ctx, tcpmap, &managed, map[string][]byte{
+		name + ".crt": cert,
+		name + ".key": key,
+	})
+}
+
+// managedBy reports whether the field manager has applied any fields
+func managedBy(managedFields []metav1.ManagedFieldsEntry, manager string) bool {
+	for _, entry := range managedFields {
+		if entry.Manager == manager && entry.Operation == metav1.ManagedFieldsOperationApply {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serviceAddress returns the address nginx connects to a backend service port with
+func (r *TCPIngressMappingReconciler) serviceAddress(backend types.NamespacedName, port int32) string {
+	return nginx.ServiceAddress(backend.Namespace, backend.Name, r.clusterDomain(), port)
+}
+
+// clusterDomain returns the domain in-cluster service addresses are qualified with
+func (r *TCPIngressMappingReconciler) clusterDomain() string {
+	if r.ClusterDomain == "" {
+		return DefaultClusterDomain
+	}
+
+	return r.ClusterDomain
+}
+
+// withdrawStreamSnippet removes the snippets of a mapping whose backend service or port does not exist (anymore).
+// Without a resolver nginx refuses to load a server block whose upstream can not be resolved, which would block the reloads for all mappings.
+func (r *TCPIngressMappingReconciler) withdrawStreamSnippet(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping) error {
+	if r.StreamSnippetConfigMap == "" {
+		return nil
+	}
+
+	key, ok := r.frontendServiceKey(*tcpmap)
+	if !ok {
+		return nil
+	}
+
+	frontendService := v1.Service{}
+	if err := r.Client.Get(ctx, key, &frontendService); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	return r.releaseStreamSnippet(ctx, tcpmap, frontendService)
+}
+
+// releaseStreamSnippet removes the snippets of a mapping if a stream snippet configmap is configured
+func (r *TCPIngressMappingReconciler) releaseStreamSnippet(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping, frontendService v1.Service) error {
+	if r.StreamSnippetConfigMap == "" {
+		return nil
+	}
+
+	cm, err := r.getStreamSnippetConfigMap(ctx, frontendService)
+	if err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	if err := r.applyStreamSnippet(ctx, tcpmap, frontendService, &cm, 0, 0); err != nil {
+		return err
+	}
+
+	return r.syncStreamSnippet(ctx, tcpmap, frontendService, cm)
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/nginx"
+)
+
+func TestValidateTLS(t *testing.T) {
+	c := fake.NewClientBuilder().WithObjects(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "valid"},
+			Data:       map[string][]byte{v1.TLSCertKey: []byte("crt"), v1.TLSPrivateKeyKey: []byte("key")},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "no-key"},
+			Data:       map[string][]byte{v1.TLSCertKey: []byte("crt")},
+		},
+	).Build()
+
+	mapping := func(tls *v1beta1.TLS) v1beta1.TCPIngressMapping {
+		return v1beta1.TCPIngressMapping{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+			Spec:       v1beta1.TCPIngressMappingSpec{TLS: tls},
+		}
+	}
+
+	secret := func(name string) *v1beta1.TLS {
+		return &v1beta1.TLS{SecretRef: &v1beta1.LocalObjectReference{Name: name}}
+	}
+
+	tests := []struct {
+		name     string
+		tcpmap   v1beta1.TCPIngressMapping
+		snippets string
+		provider Provider
+		reason   string
+	}{
+		{name: "no tls", tcpmap: mapping(nil), reason: ""},
+		{name: "passthrough", tcpmap: mapping(&v1beta1.TLS{Mode: v1beta1.TLSPassthrough}), reason: ""},
+		{name: "terminate without snippets", tcpmap: mapping(secret("valid")), reason: v1beta1.TLSUnsupportedReason},
+		{name: "terminate", tcpmap: mapping(secret("valid")), snippets: "stream-snippets", reason: ""},
+		{name: "terminate without secret", tcpmap: mapping(&v1beta1.TLS{}), snippets: "stream-snippets", reason: v1beta1.TLSSecretNotFoundReason},
+		{name: "secret not found", tcpmap: mapping(secret("missing")), snippets: "stream-snippets", reason: v1beta1.TLSSecretNotFoundReason},
+		{name: "secret without key", tcpmap: mapping(secret("no-key")), snippets: "stream-snippets", reason: v1beta1.TLSSecretNotFoundReason},
+		{name: "sni without snippets", tcpmap: mapping(&v1beta1.TLS{Mode: v1beta1.TLSPassthrough, Hostname: "db.example.com"}), reason: v1beta1.TLSUnsupportedReason},
+		{name: "sni terminate", tcpmap: mapping(&v1beta1.TLS{Mode: v1beta1.TLSTerminate, Hostname: "db.example.com"}), snippets: "stream-snippets", reason: v1beta1.TLSUnsupportedReason},
+		{name: "sni passthrough", tcpmap: mapping(&v1beta1.TLS{Mode: v1beta1.TLSPassthrough, Hostname: "db.example.com"}), snippets: "stream-snippets", reason: ""},
+		{name: "envoy passthrough", tcpmap: mapping(&v1beta1.TLS{Mode: v1beta1.TLSPassthrough}), provider: ProviderEnvoy, reason: ""},
+		{name: "envoy terminate", tcpmap: mapping(secret("valid")), snippets: "stream-snippets", provider: ProviderEnvoy, reason: v1beta1.TLSUnsupportedReason},
+		{name: "proxy terminate", tcpmap: mapping(secret("valid")), snippets: "stream-snippets", provider: ProviderProxy, reason: v1beta1.TLSUnsupportedReason},
+	}
+
+	// The certificates are copied into the managed tls secret
+	r := &TCPIngressMappingReconciler{Client: c, StreamSnippetConfigMap: "stream-snippets", IngressNginxConfigMap: "ingress-nginx-controller"}
+	if reason, _, _ := r.validateTLS(context.TODO(), mapping(secret("valid"))); reason != v1beta1.TLSUnsupportedReason {
+		t.Errorf("expected terminating TLS without a managed tls secret to be unsupported, got %q", reason)
+	}
+
+	// The backends of the routes by SNI are resolved on every connection
+	if reason, _, _ := r.validateTLS(context.TODO(), mapping(&v1beta1.TLS{Mode: v1beta1.TLSPassthrough, Hostname: "db.example.com"})); reason != v1beta1.TLSUnsupportedReason {
+		t.Errorf("expected routing by SNI without a resolver to be unsupported, got %q", reason)
+	}
+
+	for _, test := range tests {
+		r := &TCPIngressMappingReconciler{Client: c, StreamSnippetConfigMap: test.snippets, Provider: test.provider}
+		if test.snippets != "" {
+			r.IngressNginxConfigMap, r.TLSSecret, r.NginxResolver = "ingress-nginx-controller", "tcpmap-tls", DefaultNginxResolver
+		}
+
+		reason, _, err := r.validateTLS(context.TODO(), test.tcpmap)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if reason != test.reason {
+			t.Errorf("%s: expected reason %q, got %q", test.name, test.reason, reason)
+		}
+	}
+}
+
+func TestValidateLimits(t *testing.T) {
+	mapping := func(limits *v1beta1.Limits, tls *v1beta1.TLS) v1beta1.TCPIngressMapping {
+		return v1beta1.TCPIngressMapping{
+			Spec: v1beta1.TCPIngressMappingSpec{Limits: limits, TLS: tls},
+		}
+	}
+
+	sni := &v1beta1.TLS{Mode: v1beta1.TLSPassthrough, Hostname: "db.example.com"}
+
+	tests := []struct {
+		name     string
+		tcpmap   v1beta1.TCPIngressMapping
+		snippets string
+		provider Provider
+		reason   string
+	}{
+		{name: "no limits", tcpmap: mapping(nil, nil), reason: ""},
+		{name: "empty limits", tcpmap: mapping(&v1beta1.Limits{}, nil), reason: ""},
+		{name: "without snippets", tcpmap: mapping(&v1beta1.Limits{MaxConnections: 10}, nil), reason: v1beta1.LimitsUnsupportedReason},
+		{name: "max connections", tcpmap: mapping(&v1beta1.Limits{MaxConnections: 10}, nil), snippets: "stream-snippets", reason: ""},
+		{name: "idle timeout", tcpmap: mapping(&v1beta1.Limits{IdleTimeout: &metav1.Duration{Duration: time.Minute}}, nil), snippets: "stream-snippets", reason: ""},
+		{name: "connection rate", tcpmap: mapping(&v1beta1.Limits{ConnectionRate: 10}, nil), snippets: "stream-snippets", reason: v1beta1.LimitsUnsupportedReason},
+		{name: "sub millisecond idle timeout", tcpmap: mapping(&v1beta1.Limits{IdleTimeout: &metav1.Duration{Duration: time.Microsecond}}, nil), snippets: "stream-snippets", reason: v1beta1.LimitsUnsupportedReason},
+		{name: "negative connect timeout", tcpmap: mapping(&v1beta1.Limits{ConnectTimeout: &metav1.Duration{Duration: -time.Second}}, nil), snippets: "stream-snippets", reason: v1beta1.LimitsUnsupportedReason},
+		{name: "sni", tcpmap: mapping(&v1beta1.Limits{MaxConnections: 10}, sni), snippets: "stream-snippets", reason: v1beta1.LimitsUnsupportedReason},
+		{name: "envoy timeouts", tcpmap: mapping(&v1beta1.Limits{IdleTimeout: &metav1.Duration{Duration: time.Minute}}, nil), provider: ProviderEnvoy, reason: ""},
+		{name: "envoy max connections", tcpmap: mapping(&v1beta1.Limits{MaxConnections: 10}, nil), provider: ProviderEnvoy, reason: v1beta1.LimitsUnsupportedReason},
+		{name: "proxy max connections", tcpmap: mapping(&v1beta1.Limits{MaxConnections: 10}, nil), provider: ProviderProxy, reason: ""},
+		{name: "proxy zero idle timeout", tcpmap: mapping(&v1beta1.Limits{IdleTimeout: &metav1.Duration{}}, nil), provider: ProviderProxy, reason: v1beta1.LimitsUnsupportedReason},
+		{name: "envoy sub millisecond connect timeout", tcpmap: mapping(&v1beta1.Limits{ConnectTimeout: &metav1.Duration{Duration: time.Nanosecond}}, nil), provider: ProviderEnvoy, reason: v1beta1.LimitsUnsupportedReason},
+		{name: "proxy connection rate", tcpmap: mapping(&v1beta1.Limits{ConnectionRate: 10}, nil), provider: ProviderProxy, reason: v1beta1.LimitsUnsupportedReason},
+	}
+
+	// Limits are only enforced once ingress-nginx serves the rendered snippets
+	r := &TCPIngressMappingReconciler{StreamSnippetConfigMap: "stream-snippets"}
+	if reason, _ := r.validateLimits(mapping(&v1beta1.Limits{MaxConnections: 10}, nil)); reason != v1beta1.LimitsUnsupportedReason {
+		t.Errorf("expected limits without the ingress-nginx configmap to be unsupported, got %q", reason)
+	}
+
+	for _, test := range tests {
+		r := &TCPIngressMappingReconciler{StreamSnippetConfigMap: test.snippets, Provider: test.provider}
+		if test.snippets != "" {
+			r.IngressNginxConfigMap = "ingress-nginx-controller"
+		}
+
+		if reason, _ := r.validateLimits(test.tcpmap); reason != test.reason {
+			t.Errorf("%s: expected reason %q, got %q", test.name, test.reason, reason)
+		}
+	}
+}
+
+func TestValidateProxyProtocol(t *testing.T) {
+	mapping := func(pp *v1beta1.ProxyProtocol, tls *v1beta1.TLS) v1beta1.TCPIngressMapping {
+		return v1beta1.TCPIngressMapping{
+			Spec: v1beta1.TCPIngressMappingSpec{ProxyProtocol: pp, TLS: tls},
+		}
+	}
+
+	sni := &v1beta1.TLS{Mode: v1beta1.TLSPassthrough, Hostname: "db.example.com"}
+	upstream := &v1beta1.ProxyProtocol{Upstream: true}
+	upstreamV2 := &v1beta1.ProxyProtocol{Version: v1beta1.ProxyProtocolV2, Upstream: true}
+	plain := &v1beta1.ProxyProtocol{Downstream: pointer.Bool(false)}
+
+	tests := []struct {
+		name     string
+		tcpmap   v1beta1.TCPIngressMapping
+		provider Provider
+		reason   string
+	}{
+		{name: "default", tcpmap: mapping(nil, nil), reason: ""},
+		{name: "upstream v1", tcpmap: mapping(upstream, nil), reason: ""},
+		{name: "upstream v2", tcpmap: mapping(upstreamV2, nil), reason: v1beta1.ProxyProtocolUnsupportedReason},
+		{name: "no downstream", tcpmap: mapping(plain, nil), reason: ""},
+		{name: "sni upstream", tcpmap: mapping(upstream, sni), reason: v1beta1.ProxyProtocolUnsupportedReason},
+		{name: "sni no downstream", tcpmap: mapping(plain, sni), reason: ""},
+		{name: "sni default", tcpmap: mapping(&v1beta1.ProxyProtocol{}, sni), reason: ""},
+		{name: "envoy upstream v2", tcpmap: mapping(upstreamV2, nil), provider: ProviderEnvoy, reason: ""},
+		{name: "proxy upstream v2", tcpmap: mapping(upstreamV2, nil), provider: ProviderProxy, reason: ""},
+		{name: "proxy downstream", tcpmap: mapping(&v1beta1.ProxyProtocol{Downstream: pointer.Bool(true)}, nil), provider: ProviderProxy, reason: v1beta1.ProxyProtocolUnsupportedReason},
+	}
+
+	for _, test := range tests {
+		r := &TCPIngressMappingReconciler{Provider: test.provider}
+		if reason, _ := r.validateProxyProtocol(test.tcpmap); reason != test.reason {
+			t.Errorf("%s: expected reason %q, got %q", test.name, test.reason, reason)
+		}
+	}
+
+	if !downstreamProxyProtocol(mapping(nil, nil), ProviderIngressNginx) || downstreamProxyProtocol(mapping(nil, nil), ProviderEnvoy) {
+		t.Error("expected the downstream PROXY protocol to default to the provider")
+	}
+
+	if upstreamProxyProtocol(mapping(upstream, nil)) != v1beta1.ProxyProtocolV1 || upstreamProxyProtocol(mapping(&v1beta1.ProxyProtocol{Version: v1beta1.ProxyProtocolV2}, nil)) != "" {
+		t.Error("expected the upstream PROXY protocol to default to v1 if enabled only")
+	}
+}
+
+func TestReconcileWithdrawsSnippetOfMissingBackend(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	tcpmap := &v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+		Spec: v1beta1.TCPIngressMappingSpec{
+			BackendService: v1beta1.BackendService{Name: "db", Port: intstr.FromString("postgres")},
+			Limits:         &v1beta1.Limits{MaxConnections: 10},
+		},
+		Status: v1beta1.TCPIngressMappingStatus{ElectedPort: 1030},
+	}
+
+	tests := []struct {
+		name    string
+		backend []client.Object
+		reason  string
+	}{
+		{name: "backend service not found", reason: v1beta1.BackendServiceNotFoundReason},
+		{name: "backend port not found", backend: []client.Object{&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "mysql", Port: 3306}}},
+		}}, reason: v1beta1.BackendPortNotFoundReason},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snippets := &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "stream-snippets", ManagedFields: []metav1.ManagedFieldsEntry{
+					{Manager: fieldManagerFor(*tcpmap), Operation: metav1.ManagedFieldsOperationApply},
+				}},
+				Data: map[string]string{nginx.SnippetKey("default", "db"): "server {\n    listen 1030;\n}\n"},
+			}
+
+			objects := append([]client.Object{
+				tcpmap.DeepCopy(),
+				snippets,
+				&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "nginx"}},
+				&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "ingress-nginx-controller"}},
+			}, test.backend...)
+
+			var applied []appliedPatch
+			c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).WithInterceptorFuncs(captureApply(&applied, nil)).Build()
+			r := &TCPIngressMappingReconciler{
+				Client:                 c,
+				Recorder:               record.NewFakeRecorder(10),
+				FrontendService:        "ingress/nginx",
+				StreamSnippetConfigMap: "stream-snippets",
+				IngressNginxConfigMap:  "ingress-nginx-controller",
+			}
+
+			withdrawn, _, _ := r.reconcile(context.TODO(), *tcpmap, logr.Discard())
+			if ready := apimeta.FindStatusCondition(withdrawn.Status.Conditions, v1beta1.ReadyCondition); ready == nil || ready.Reason != test.reason {
+				t.Errorf("expected the Ready reason %s, got %v", test.reason, ready)
+			}
+
+			// The snippet is withdrawn by applying the snippet configmap without any keys
+			var withdrawnSnippet bool
+			for _, patch := range applied {
+				if patch.kind == "ConfigMap" && patch.manager == fieldManagerFor(*tcpmap) && strings.Contains(string(patch.data), `"stream-snippets"`) {
+					withdrawnSnippet = !strings.Contains(string(patch.data), `"data"`)
+				}
+			}
+
+			if !withdrawnSnippet {
+				t.Errorf("expected the snippet of the mapping to be withdrawn, got %v", applied)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/xds"
+)
+
+// weightedBackend is a weighted backend of a mapping together with its ready endpoints
+type weightedBackend struct {
+	key       types.NamespacedName
+	weight    int32
+	port      v1.ServicePort
+	endpoints []xds.Endpoint
+}
+
+// resolveWeightedBackends returns the ready endpoints of the weighted backends of a mapping
+func resolveWeightedBackends(ctx context.Context, c client.Reader, tcpmap v1beta1.TCPIngressMapping) ([]weightedBackend, error) {
+	var backends []weightedBackend
+	for _, backend := range tcpmap.Spec.BackendService.Weighted {
+		key := tcpservices.WeightedBackendKey(tcpmap, backend)
+		svc := v1.Service{}
+		if err := c.Get(ctx, key, &svc); err != nil {
+			return nil, fmt.Errorf("failed to get backend service %s: %w", key, err)
+		}
+
+		if svc.Spec.Type == v1.ServiceTypeExternalName {
+			return nil, fmt.Errorf("backend service %s of type ExternalName can not be weighted", key)
+		}
+
+		port, err := getBackendPort(svc, backend.Port)
+		if err != nil {
+			return nil, fmt.Errorf("backend service %s has no port %s", key, backend.Port.String())
+		}
+
+		endpoints, err := readyEndpoints(ctx, c, svc, port)
+		if err != nil {
+			return nil, err
+		}
+
+		backends = append(backends, weightedBackend{
+			key:       key,
+			weight:    tcpservices.Weight(backend),
+			port:      port,
+			endpoints: endpoints,
+		})
+	}
+
+	return backends, nil
+}
+
+// aggregateWeightedBackends creates or updates the service aggregating the endpoints of the weighted backends of a mapping
+// and reports the current weights in the status.
+// ingress-nginx balances the connections evenly across the endpoints of a service, hence the weights are approximated
+// by the number of endpoints aggregated per backend. The other providers route by the exact weights.
+func (r *TCPIngressMappingReconciler) aggregateWeightedBackends(ctx context.Context, tcpmap *v1beta1.TCPIngressMapping) (v1.Service, error) {
+	backends, err := resolveWeightedBackends(ctx, r.Client, *tcpmap)
+	if err != nil {
+		return v1.Service{}, err
+	}
+
+	weights := make([]int, len(backends))
+	available := make([]int, len(backends))
+	counts := make([]int, len(backends))
+	for i, backend := range backends {
+		available[i] = len(backend.endpoints)
+		if available[i] > 0 {
+			weights[i] = int(backend.weight)
+		}
+
+		if weights[i] > 0 {
+			counts[i] = available[i]
+		}
+	}
+
+	shares := weights
+	if r.usesTCPConfigMap() {
+		counts = weightedEndpointCounts(weights, available)
+		shares = counts
+	}
+
+	var slices []discoveryv1.EndpointSlice
+	for i, backend := range backends {
+		slices = append(slices, weightedEndpointSlices(backend.key, backend.endpoints[:counts[i]])...)
+	}
+
+	ports := []v1.ServicePort{
+		{
+			Name:       tcpservices.WeightedPortName,
+			Protocol:   v1.ProtocolTCP,
+			Port:       backends[0].port.Port,
+			TargetPort: intstr.FromInt(int(backends[0].port.Port)),
+		},
+	}
+
+	svc, err := r.mirrorBackend(ctx, tcpmap, "", ports, slices)
+	if err != nil {
+		return svc, err
+	}
+
+	tcpmap.Status.Backends = weightedBackendStatus(backends, shares)
+	return svc, nil
+}
+
+// weightedEndpointCounts returns how many of the available endpoints of each backend are aggregated
+// so that the share of the endpoints of a backend approximates its share of the weights.
+// Backends with a weight keep at least one endpoint if they have any.
+func weightedEndpointCounts(weights []int, available []int) []int {
+	total := 0
+	for i, w := range weights {
+		if available[i] > 0 {
+			total += w
+		}
+	}
+
+	counts := make([]int, len(weights))
+	if total == 0 {
+		return counts
+	}
+
+	// The largest scale at which no backend needs more endpoints than it has
+	scale := math.Inf(1)
+	for i, w := range weights {
+		if w > 0 && available[i] > 0 {
+			scale = math.Min(scale, float64(available[i]*total)/float64(w))
+		}
+	}
+
+	for i, w := range weights {
+		if w == 0 || available[i] == 0 {
+			continue
+		}
+
+		counts[i] = int(math.Round(scale * float64(w) / float64(total)))
+		if counts[i] < 1 {
+			counts[i] = 1
+		}
+
+		if counts[i] > available[i] {
+			counts[i] = available[i]
+		}
+	}
+
+	return counts
+}
+
+// weightedEndpointSlices groups the endpoints of a backend by address type and port
+func weightedEndpointSlices(backend types.NamespacedName, endpoints []xds.Endpoint) []discoveryv1.EndpointSlice {
+	type group struct {
+		addressType discoveryv1.AddressType
+		port        int32
+	}
+
+	var order []group
+	grouped := make(map[group][]discoveryv1.Endpoint)
+	for _, endpoint := range endpoints {
+		g := group{addressType: discoveryv1.AddressTypeFQDN, port: endpoint.Port}
+		if ip := net.ParseIP(endpoint.Address); ip != nil && ip.To4() != nil {
+			g.addressType = discoveryv1.AddressTypeIPv4
+		} else if ip != nil {
+			g.addressType = discoveryv1.AddressTypeIPv6
+		}
+
+		if _, ok := grouped[g]; !ok {
+			order = append(order, g)
+		}
+
+		ready := true
+		grouped[g] = append(grouped[g], discoveryv1.Endpoint{
+			Addresses:  []string{endpoint.Address},
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		})
+	}
+
+	var slices []discoveryv1.EndpointSlice
+	for _, g := range order {
+		name := tcpservices.WeightedPortName
+		protocol := v1.ProtocolTCP
+		port := g.port
+
+		slices = append(slices, discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: fmt.Sprintf("%s-%s-%d", backend, g.addressType, g.port),
+			},
+			AddressType: g.addressType,
+			Endpoints:   grouped[g],
+			Ports: []discoveryv1.EndpointPort{
+				{
+					Name:     &name,
+					Protocol: &protocol,
+					Port:     &port,
+				},
+			},
+		})
+	}
+
+	return slices
+}
+
+// weightedBackendStatus reports the share of new connections of each backend
+func weightedBackendStatus(backends []weightedBackend, shares []int) []v1beta1.BackendStatus {
+	total := 0
+	for _, share := range shares {
+		total += share
+	}
+
+	status := make([]v1beta1.BackendStatus, 0, len(backends))
+	for i, backend := range backends {
+		var percent int32
+		if total > 0 {
+			percent = int32(math.Round(float64(shares[i]*100) / float64(total)))
+		}
+
+		status = append(status, v1beta1.BackendStatus{
+			Name:           backend.key.String(),
+			Weight:         backend.weight,
+			ReadyEndpoints: int32(len(backend.endpoints)),
+			Percent:        percent,
+		})
+	}
+
+	return status
+}
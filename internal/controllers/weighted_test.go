@@ -0,0 +1,139 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+func TestWeightedEndpointCounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		weights   []int
+		available []int
+		counts    []int
+	}{
+		{name: "even", weights: []int{1, 1}, available: []int{2, 2}, counts: []int{2, 2}},
+		{name: "canary", weights: []int{90, 10}, available: []int{3, 3}, counts: []int{3, 1}},
+		{name: "limited by the smaller backend", weights: []int{50, 50}, available: []int{4, 1}, counts: []int{1, 1}},
+		{name: "shifted", weights: []int{25, 75}, available: []int{4, 4}, counts: []int{1, 4}},
+		{name: "drained", weights: []int{0, 1}, available: []int{3, 3}, counts: []int{0, 3}},
+		{name: "no endpoints", weights: []int{1, 1}, available: []int{0, 2}, counts: []int{0, 2}},
+		{name: "nothing available", weights: []int{1, 1}, available: []int{0, 0}, counts: []int{0, 0}},
+	}
+
+	for _, test := range tests {
+		if counts := weightedEndpointCounts(test.weights, test.available); fmt.Sprint(counts) != fmt.Sprint(test.counts) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.counts, counts)
+		}
+	}
+}
+
+func TestAggregateWeightedBackends(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	backend := func(name string, addresses ...string) []client.Object {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "postgres", Port: 5432}}},
+		}
+
+		portName := "postgres"
+		port := int32(5432)
+		slice := &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      name + "-abc",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: name},
+			},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+		}
+
+		for _, address := range addresses {
+			slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{Addresses: []string{address}})
+		}
+
+		return []client.Object{svc, slice}
+	}
+
+	tcpmap := &v1beta1.TCPIngressMapping{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "postgres", UID: "uid"},
+		Spec: v1beta1.TCPIngressMappingSpec{
+			BackendService: v1beta1.BackendService{
+				Weighted: []v1beta1.WeightedBackend{
+					{Name: "postgres-old", Port: intstr.FromString("postgres"), Weight: pointer.Int32(90)},
+					{Name: "postgres-new", Port: intstr.FromInt(5432), Weight: pointer.Int32(10)},
+				},
+			},
+		},
+	}
+
+	objects := append(backend("postgres-old", "10.0.0.1", "10.0.0.2", "10.0.0.3"), backend("postgres-new", "10.0.1.1", "10.0.1.2", "10.0.1.3")...)
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(objects, tcpmap)...).Build()
+
+	tests := []struct {
+		provider Provider
+		ready    int32
+		percent  []int32
+	}{
+		{provider: ProviderIngressNginx, ready: 4, percent: []int32{75, 25}},
+		{provider: ProviderEnvoy, ready: 6, percent: []int32{90, 10}},
+	}
+
+	for _, test := range tests {
+		r := &TCPIngressMappingReconciler{Client: c, Scheme: scheme, Provider: test.provider}
+		svc, err := r.aggregateWeightedBackends(context.TODO(), tcpmap)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ready, err := r.countReadyEndpoints(context.TODO(), svc, svc.Spec.Ports[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ready != test.ready {
+			t.Errorf("%s: expected %d aggregated endpoints, got %d", test.provider, test.ready, ready)
+		}
+
+		var percent []int32
+		for _, backend := range tcpmap.Status.Backends {
+			percent = append(percent, backend.Percent)
+		}
+
+		if fmt.Sprint(percent) != fmt.Sprint(test.percent) {
+			t.Errorf("%s: expected the backends to get %v percent, got %v", test.provider, test.percent, percent)
+		}
+	}
+}
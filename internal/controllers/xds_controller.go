@@ -0,0 +1,209 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/xds"
+)
+
+// xdsRequest is the single request all changes are collapsed into as the snapshots are always built from all mappings
+var xdsRequest = reconcile.Request{NamespacedName: types.NamespacedName{Name: "xds"}}
+
+// XDSReconciler serves the mappings with an elected port to the envoy fleets using the xDS server.
+// It only reads from the cache, hence it runs on every replica.
+type XDSReconciler struct {
+	Log logr.Logger
+	// FrontendService is the default frontend service of the controller
+	FrontendService string
+	// Shard is the value of the shard label of the pools managed by this controller
+	Shard  string
+	Server *xds.Server
+	client.Client
+}
+
+// SetupWithManager adding controllers
+func (r *XDSReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.Add(r.Server); err != nil {
+		return err
+	}
+
+	enqueue := handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, o client.Object) []reconcile.Request {
+		return []reconcile.Request{xdsRequest}
+	})
+
+	needLeaderElection := false
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("xds").
+		Watches(&v1beta1.TCPIngressMapping{}, enqueue).
+		Watches(&v1.Service{}, enqueue).
+		Watches(&discoveryv1.EndpointSlice{}, enqueue).
+		WithOptions(controller.Options{MaxConcurrentReconciles: 1, NeedLeaderElection: &needLeaderElection}).
+		Complete(r)
+}
+
+// Reconcile builds the snapshots of all envoy fleets
+func (r *XDSReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var mappings v1beta1.TCPIngressMappingList
+	if err := r.List(ctx, &mappings); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	fleets := make(map[string][]xds.Mapping)
+	for _, tcpmap := range mappings.Items {
+		// Suspended mappings are withdrawn, ports shared by SNI are not supported by the envoy provider
+		if tcpmap.Status.ElectedPort == 0 || !tcpmap.DeletionTimestamp.IsZero() || isSuspended(tcpmap) || tcpservices.RoutesBySNI(tcpmap) {
+			continue
+		}
+
+		if owned, err := ownsFrontend(ctx, r.Client, tcpmap, r.FrontendService, r.Shard); err != nil {
+			return ctrl.Result{}, err
+		} else if !owned {
+			continue
+		}
+
+		frontend, ok := shardedFrontendServiceKey(tcpmap, r.FrontendService, r.Shard)
+		if !ok {
+			continue
+		}
+
+		mapping, err := resolveMapping(ctx, r.Client, tcpmap)
+		if err != nil {
+			r.Log.Info("skipping mapping without backend", "namespace", tcpmap.Namespace, "name", tcpmap.Name, "error", err.Error())
+			continue
+		}
+
+		mapping.DownstreamProxyProtocol = downstreamProxyProtocol(tcpmap, ProviderEnvoy)
+		fleets[frontend.String()] = append(fleets[frontend.String()], mapping)
+	}
+
+	return ctrl.Result{}, r.Server.Sync(ctx, fleets)
+}
+
+// resolveMapping resolves the ready endpoints of the backend of a mapping.
+// Weighted backends are resolved individually instead of using the service aggregating them.
+func resolveMapping(ctx context.Context, c client.Reader, tcpmap v1beta1.TCPIngressMapping) (xds.Mapping, error) {
+	mapping := xds.Mapping{
+		Name:                  objectKey(&tcpmap).String(),
+		Port:                  tcpmap.Status.ElectedPort,
+		UpstreamProxyProtocol: string(upstreamProxyProtocol(tcpmap)),
+	}
+
+	if limits := tcpmap.Spec.Limits; limits != nil {
+		if limits.ConnectTimeout != nil {
+			mapping.ConnectTimeout = limits.ConnectTimeout.Duration
+		}
+
+		if limits.IdleTimeout != nil {
+			mapping.IdleTimeout = limits.IdleTimeout.Duration
+		}
+	}
+
+	if tcpservices.IsWeighted(tcpmap) {
+		backends, err := resolveWeightedBackends(ctx, c, tcpmap)
+		if err != nil {
+			return mapping, err
+		}
+
+		// Backends without weight or endpoints are left out as envoy requires a weight of at least 1
+		for _, backend := range backends {
+			if backend.weight > 0 && len(backend.endpoints) > 0 {
+				mapping.Backends = append(mapping.Backends, xds.Backend{
+					Name:      backend.key.String(),
+					Weight:    uint32(backend.weight),
+					Endpoints: backend.endpoints,
+				})
+			}
+		}
+
+		return mapping, nil
+	}
+
+	svc := v1.Service{}
+	if err := c.Get(ctx, tcpservices.BackendServiceKey(tcpmap), &svc); err != nil {
+		return xds.Mapping{}, err
+	}
+
+	port, err := getBackendPort(svc, tcpservices.BackendPort(tcpmap))
+	if err != nil {
+		return xds.Mapping{}, err
+	}
+
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		mapping.DNS = true
+		mapping.Endpoints = []xds.Endpoint{{Address: svc.Spec.ExternalName, Port: port.Port}}
+		return mapping, nil
+	}
+
+	mapping.Endpoints, err = readyEndpoints(ctx, c, svc, port)
+	return mapping, err
+}
+
+// readyEndpoints returns the addresses of the ready endpoints of a service port
+func readyEndpoints(ctx context.Context, c client.Reader, svc v1.Service, port v1.ServicePort) ([]xds.Endpoint, error) {
+	var slices discoveryv1.EndpointSliceList
+	if err := c.List(ctx, &slices, client.InNamespace(svc.Namespace), client.MatchingLabels{
+		discoveryv1.LabelServiceName: svc.Name,
+	}); err != nil {
+		return nil, err
+	}
+
+	var endpoints []xds.Endpoint
+	for _, slice := range slices.Items {
+		for _, p := range slice.Ports {
+			if p.Port == nil || (p.Name == nil && port.Name != "") || (p.Name != nil && *p.Name != port.Name) {
+				continue
+			}
+
+			for _, endpoint := range slice.Endpoints {
+				// A nil ready condition must be interpreted as ready
+				if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+					continue
+				}
+
+				for _, address := range endpoint.Addresses {
+					endpoints = append(endpoints, xds.Endpoint{Address: address, Port: *p.Port})
+				}
+			}
+		}
+	}
+
+	// Keep the snapshot version stable regardless of the order of the slices
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Address != endpoints[j].Address {
+			return endpoints[i].Address < endpoints[j].Address
+		}
+
+		return endpoints[i].Port < endpoints[j].Port
+	})
+
+	return endpoints, nil
+}
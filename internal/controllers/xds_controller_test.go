@@ -0,0 +1,114 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/xds"
+)
+
+func TestXDSReconcile(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = v1beta1.AddToScheme(scheme)
+
+	mapping := func(name string, port int32) *v1beta1.TCPIngressMapping {
+		return &v1beta1.TCPIngressMapping{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec: v1beta1.TCPIngressMappingSpec{
+				BackendService: v1beta1.BackendService{Name: "postgres", Port: intstr.FromString("sql")},
+			},
+			Status: v1beta1.TCPIngressMappingStatus{ElectedPort: port},
+		}
+	}
+
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		mapping("elected", 1025),
+		mapping("pending", 0),
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "postgres"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "sql", Port: 5432}}},
+		},
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "postgres-abc",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "postgres"},
+			},
+			Ports: []discoveryv1.EndpointPort{{Name: pointer.String("sql"), Port: pointer.Int32(15432)}},
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.0.0.2"}},
+				{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: pointer.Bool(true)}},
+				{Addresses: []string{"10.0.0.3"}, Conditions: discoveryv1.EndpointConditions{Ready: pointer.Bool(false)}},
+			},
+		},
+	).Build()
+
+	r := &XDSReconciler{
+		Client:          c,
+		Log:             logr.Discard(),
+		FrontendService: "ingress/envoy",
+		Server:          xds.New("", logr.Discard()),
+	}
+
+	if _, err := r.Reconcile(context.TODO(), xdsRequest); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := r.Server.Snapshot("ingress/envoy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if listeners := snapshot.GetResources(resource.ListenerType); len(listeners) != 1 {
+		t.Errorf("expected a listener for the elected port only, got %v", listeners)
+	}
+
+	assignment, ok := snapshot.GetResources(resource.EndpointType)["default/elected"].(*endpoint.ClusterLoadAssignment)
+	if !ok {
+		t.Fatal("expected endpoints of the mapping")
+	}
+
+	var addresses []string
+	for _, e := range assignment.Endpoints[0].LbEndpoints {
+		address := e.GetEndpoint().GetAddress().GetSocketAddress()
+		if address.GetPortValue() != 15432 {
+			t.Errorf("expected the target port of the endpoint, got %d", address.GetPortValue())
+		}
+
+		addresses = append(addresses, address.GetAddress())
+	}
+
+	if len(addresses) != 2 || addresses[0] != "10.0.0.1" || addresses[1] != "10.0.0.2" {
+		t.Errorf("expected the ready endpoints sorted by address, got %v", addresses)
+	}
+}
@@ -0,0 +1,325 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package nginx renders nginx stream configuration snippets for mappings which can not be expressed
+// by an entry of the ingress-nginx tcp services configmap.
+// The snippets are inlined into the stream-snippet setting of ingress-nginx
+// (https://kubernetes.github.io/ingress-nginx/user-guide/nginx-configuration/configmap/#stream-snippet),
+// hence ingress-nginx reloads as soon as they change.
+package nginx
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StreamSnippetKey is the setting of the ingress-nginx controller configmap the snippets are rendered into
+const StreamSnippetKey = "stream-snippet"
+
+// Render renders the server blocks of the snippet configmap in the order of their keys.
+// The routes of the ports shared by SNI are rendered into the map of their port.
+// A status server listening on statusPort returns the checksums of the rendered snippets,
+// which tells whether nginx has been reloaded with them.
+func Render(data map[string]string, statusPort int32) string {
+	var keys []string
+	for key := range data {
+		if strings.HasSuffix(key, ".conf") || strings.HasSuffix(key, ".map") {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	var b strings.Builder
+	var status []string
+	for _, key := range keys {
+		status = append(status, fmt.Sprintf("%s=%s", key, Checksum(data[key])))
+		if !strings.HasSuffix(key, ".conf") {
+			continue
+		}
+
+		if port, ok := ParseSNIServerKey(key); ok {
+			var routes []string
+			for _, k := range keys {
+				if IsSNIRouteKey(k, port) {
+					routes = append(routes, data[k])
+				}
+			}
+
+			fmt.Fprintf(&b, "%s\n", SNIMap(port, routes))
+		}
+
+		fmt.Fprintf(&b, "%s\n", data[key])
+	}
+
+	fmt.Fprintf(&b, "# served snippets\n")
+	fmt.Fprintf(&b, "server {\n")
+	fmt.Fprintf(&b, "    listen %d;\n", statusPort)
+	fmt.Fprintf(&b, "    return \"%s\";\n", strings.Join(status, " "))
+	fmt.Fprintf(&b, "}\n")
+
+	return b.String()
+}
+
+// Checksum returns the checksum of a snippet as reported by the status server
+func Checksum(snippet string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(snippet)))[:16]
+}
+
+// ParseStatus parses the response of the status server into the checksums by key
+func ParseStatus(status string) map[string]string {
+	checksums := make(map[string]string)
+	for _, field := range strings.Fields(status) {
+		if key, checksum, ok := strings.Cut(field, "="); ok {
+			checksums[key] = checksum
+		}
+	}
+
+	return checksums
+}
+
+// Server is a stream server block of a single port terminating TLS or limiting connections
+type Server struct {
+	// Name identifies the mapping of the server
+	Name string
+	// Port to listen on
+	Port int32
+	// ProxyProtocol expects the PROXY protocol from clients
+	ProxyProtocol bool
+	// Certificate is the path of the certificate, TLS is not terminated if empty
+	Certificate string
+	// CertificateKey is the path of the key of the certificate
+	CertificateKey string
+	// Upstream is the address (host:port) connections are proxied to
+	Upstream string
+	// Resolver resolves the upstream on every connection. Without it nginx resolves the upstream
+	// while loading the configuration and refuses to load it at all if the upstream does not exist.
+	Resolver string
+	// UpstreamProxyProtocol sends a PROXY protocol v1 header to the upstream
+	UpstreamProxyProtocol bool
+	// MaxConnections limits the concurrent connections of a single client address, unlimited if 0
+	MaxConnections int32
+	// ConnectTimeout is the timeout for establishing a connection to the upstream, nginx default if 0
+	ConnectTimeout time.Duration
+	// IdleTimeout is the timeout between two successive read or write operations, nginx default if 0
+	IdleTimeout time.Duration
+}
+
+// String renders the server block
+func (s Server) String() string {
+	var b strings.Builder
+
+	listen := []string{fmt.Sprintf("%d", s.Port)}
+	if s.Certificate != "" {
+		listen = append(listen, "ssl")
+	}
+
+	if s.ProxyProtocol {
+		listen = append(listen, "proxy_protocol")
+	}
+
+	// The client address is passed by the PROXY protocol
+	client := "$binary_remote_addr"
+	if s.ProxyProtocol {
+		client = "$proxy_protocol_addr"
+	}
+
+	zone := fmt.Sprintf("tcpmap_conn_%d", s.Port)
+
+	fmt.Fprintf(&b, "# %s\n", s.Name)
+	if s.MaxConnections > 0 {
+		fmt.Fprintf(&b, "limit_conn_zone %s zone=%s:1m;\n\n", client, zone)
+	}
+
+	fmt.Fprintf(&b, "server {\n")
+	fmt.Fprintf(&b, "    listen %s;\n", strings.Join(listen, " "))
+	if s.Certificate != "" {
+		fmt.Fprintf(&b, "    ssl_certificate %s;\n", s.Certificate)
+		fmt.Fprintf(&b, "    ssl_certificate_key %s;\n", s.CertificateKey)
+	}
+
+	if s.MaxConnections > 0 {
+		fmt.Fprintf(&b, "    limit_conn %s %d;\n", zone, s.MaxConnections)
+	}
+
+	if s.ConnectTimeout > 0 {
+		fmt.Fprintf(&b, "    proxy_connect_timeout %s;\n", duration(s.ConnectTimeout))
+	}
+
+	if s.IdleTimeout > 0 {
+		fmt.Fprintf(&b, "    proxy_timeout %s;\n", duration(s.IdleTimeout))
+	}
+
+	if s.UpstreamProxyProtocol {
+		fmt.Fprintf(&b, "    proxy_protocol on;\n")
+	}
+
+	if s.Resolver != "" {
+		fmt.Fprintf(&b, "    resolver %s;\n", s.Resolver)
+		fmt.Fprintf(&b, "    set $tcpmap_upstream %s;\n", s.Upstream)
+		fmt.Fprintf(&b, "    proxy_pass $tcpmap_upstream;\n")
+	} else {
+		fmt.Fprintf(&b, "    proxy_pass %s;\n", s.Upstream)
+	}
+
+	fmt.Fprintf(&b, "}\n")
+
+	return b.String()
+}
+
+// duration formats a duration in the nginx time format, rounded up to milliseconds
+func duration(d time.Duration) string {
+	ms := (d + time.Millisecond - 1) / time.Millisecond
+	if ms%1000 == 0 {
+		return fmt.Sprintf("%ds", ms/1000)
+	}
+
+	return fmt.Sprintf("%dms", ms)
+}
+
+// SNIServer is a stream server block routing the connections of a port shared by multiple mappings
+// to their upstreams by the server name of the TLS client hello
+type SNIServer struct {
+	// Port to listen on
+	Port int32
+	// ProxyProtocol expects the PROXY protocol from clients
+	ProxyProtocol bool
+	// Resolver resolves the upstream of a route on every connection
+	Resolver string
+}
+
+// String renders the server block, the map of server names to upstreams is rendered by SNIMap
+func (s SNIServer) String() string {
+	var b strings.Builder
+
+	listen := []string{fmt.Sprintf("%d", s.Port)}
+	if s.ProxyProtocol {
+		listen = append(listen, "proxy_protocol")
+	}
+
+	fmt.Fprintf(&b, "# routes port %d by SNI\n", s.Port)
+	fmt.Fprintf(&b, "server {\n")
+	fmt.Fprintf(&b, "    listen %s;\n", strings.Join(listen, " "))
+	fmt.Fprintf(&b, "    ssl_preread on;\n")
+	if s.Resolver != "" {
+		fmt.Fprintf(&b, "    resolver %s;\n", s.Resolver)
+	}
+
+	fmt.Fprintf(&b, "    proxy_pass %s;\n", sniVariable(s.Port))
+	fmt.Fprintf(&b, "}\n")
+
+	return b.String()
+}
+
+// SNIMap renders the map of server names to upstreams of a shared port from the routes rendered by SNIRoute.String
+func SNIMap(port int32, routes []string) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "map $ssl_preread_server_name %s {\n", sniVariable(port))
+	fmt.Fprintf(&b, "    hostnames;\n")
+	for _, route := range routes {
+		fmt.Fprintf(&b, "    %s\n", strings.TrimSpace(route))
+	}
+
+	fmt.Fprintf(&b, "}\n")
+
+	return b.String()
+}
+
+func sniVariable(port int32) string {
+	return fmt.Sprintf("$tcpmap_sni_%d", port)
+}
+
+// SNIRoute routes a server name to an upstream
+type SNIRoute struct {
+	Hostname string
+	// Upstream is the address (host:port) connections are proxied to, resolved by the resolver of the SNIServer
+	Upstream string
+}
+
+// String renders the route as entry of the map of a SNIServer
+func (r SNIRoute) String() string {
+	return fmt.Sprintf("%s %s;\n", r.Hostname, r.Upstream)
+}
+
+// SNIServerKey returns the key of the server block of a shared port in the snippet configmap
+func SNIServerKey(port int32) string {
+	return fmt.Sprintf("sni-%d.conf", port)
+}
+
+// ParseSNIServerKey returns the port of a key returned by SNIServerKey
+func ParseSNIServerKey(key string) (int32, bool) {
+	var port int32
+	if _, err := fmt.Sscanf(key, "sni-%d.conf", &port); err != nil || SNIServerKey(port) != key {
+		return 0, false
+	}
+
+	return port, true
+}
+
+// SNIRouteKey returns the key of the route of a mapping on a shared port in the snippet configmap
+func SNIRouteKey(namespace, name string, port int32) string {
+	return fmt.Sprintf("%s.%s%s", namespace, name, sniRouteSuffix(port))
+}
+
+// ParseSNIRoute parses a route rendered by SNIRoute.String
+func ParseSNIRoute(v string) (SNIRoute, bool) {
+	fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(v), ";"))
+	if len(fields) != 2 {
+		return SNIRoute{}, false
+	}
+
+	return SNIRoute{Hostname: fields[0], Upstream: fields[1]}, true
+}
+
+// IsSNIRouteKey reports whether a key of the snippet configmap is a route on the given shared port
+func IsSNIRouteKey(key string, port int32) bool {
+	return strings.HasSuffix(key, sniRouteSuffix(port))
+}
+
+func sniRouteSuffix(port int32) string {
+	return fmt.Sprintf(".sni-%d.map", port)
+}
+
+// SnippetKey returns the key of the snippet of a mapping in the snippet configmap
+func SnippetKey(namespace, name string) string {
+	return fmt.Sprintf("%s.%s.conf", namespace, name)
+}
+
+// CertificateName returns the name of the certificate of a tls secret within the managed tls secret.
+// The name contains a checksum of the certificate and key, hence a rotated certificate gets a new file
+// which is only referenced once it has been written.
+func CertificateName(namespace, secret string, cert, key []byte) string {
+	h := sha256.New()
+	_, _ = h.Write(cert)
+	_, _ = h.Write(key)
+	return fmt.Sprintf("%s.%s.%x", namespace, secret, h.Sum(nil)[:4])
+}
+
+// CertificateFiles returns the paths of the certificate and key named by CertificateName in the directory the managed tls secret is mounted at
+func CertificateFiles(dir, name string) (string, string) {
+	return path.Join(dir, name+".crt"), path.Join(dir, name+".key")
+}
+
+// ServiceAddress returns the fully qualified in-cluster address of a service port.
+// The nginx resolver does not apply the search domains of the pod.
+func ServiceAddress(namespace, name, clusterDomain string, port int32) string {
+	return fmt.Sprintf("%s.%s.svc.%s:%d", name, namespace, clusterDomain, port)
+}
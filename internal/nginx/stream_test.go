@@ -0,0 +1,266 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nginx
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	s := Server{
+		Name:          "default/postgres",
+		Port:          1025,
+		ProxyProtocol: true,
+		Upstream:      ServiceAddress("default", "postgres", "cluster.local", 5432),
+	}
+
+	s.Certificate, s.CertificateKey = CertificateFiles("/etc/tcpmap-controller/tls", "default.postgres-tls.0a1b2c3d")
+
+	expected := `# default/postgres
+server {
+    listen 1025 ssl proxy_protocol;
+    ssl_certificate /etc/tcpmap-controller/tls/default.postgres-tls.0a1b2c3d.crt;
+    ssl_certificate_key /etc/tcpmap-controller/tls/default.postgres-tls.0a1b2c3d.key;
+    proxy_pass postgres.default.svc.cluster.local:5432;
+}
+`
+
+	if got := s.String(); got != expected {
+		t.Errorf("unexpected server block:\n%s", got)
+	}
+
+	if key := SnippetKey("default", "postgres"); key != "default.postgres.conf" {
+		t.Errorf("unexpected snippet key %s", key)
+	}
+}
+
+func TestCertificateName(t *testing.T) {
+	name := CertificateName("default", "postgres-tls", []byte("crt"), []byte("key"))
+	if !strings.HasPrefix(name, "default.postgres-tls.") || len(name) != len("default.postgres-tls.")+8 {
+		t.Errorf("unexpected certificate name %s", name)
+	}
+
+	if rotated := CertificateName("default", "postgres-tls", []byte("crt2"), []byte("key")); rotated == name {
+		t.Error("expected a rotated certificate to get another name")
+	}
+}
+
+func TestRender(t *testing.T) {
+	data := map[string]string{
+		"default.redis.conf":    "server {\n    listen 1026;\n}\n",
+		"default.postgres.conf": "server {\n    listen 1025;\n}\n",
+		"ignored.txt":           "not a snippet",
+	}
+
+	expected := `server {
+    listen 1025;
+}
+
+server {
+    listen 1026;
+}
+
+# served snippets
+server {
+    listen 10261;
+    return "default.postgres.conf=` + Checksum(data["default.postgres.conf"]) + ` default.redis.conf=` + Checksum(data["default.redis.conf"]) + `";
+}
+`
+
+	got := Render(data, 10261)
+	if got != expected {
+		t.Errorf("unexpected stream snippet:\n%s", got)
+	}
+
+	status := ParseStatus("default.postgres.conf=" + Checksum(data["default.postgres.conf"]) + " default.redis.conf=" + Checksum(data["default.redis.conf"]) + "\n")
+	if len(status) != 2 || status["default.redis.conf"] != Checksum(data["default.redis.conf"]) {
+		t.Errorf("unexpected status %v", status)
+	}
+
+	if empty := Render(nil, 10261); !strings.Contains(empty, `return "";`) {
+		t.Errorf("expected an empty status without snippets:\n%s", empty)
+	}
+}
+
+func TestSNIServer(t *testing.T) {
+	s := SNIServer{
+		Port:          1025,
+		ProxyProtocol: true,
+		Resolver:      "kube-dns.kube-system.svc.cluster.local",
+	}
+
+	expected := `# routes port 1025 by SNI
+server {
+    listen 1025 proxy_protocol;
+    ssl_preread on;
+    resolver kube-dns.kube-system.svc.cluster.local;
+    proxy_pass $tcpmap_sni_1025;
+}
+`
+
+	if got := s.String(); got != expected {
+		t.Errorf("unexpected server block:\n%s", got)
+	}
+
+	if plain := (SNIServer{Port: 1025}).String(); strings.Contains(plain, "proxy_protocol") {
+		t.Errorf("expected no PROXY protocol:\n%s", plain)
+	}
+
+	if key := SNIServerKey(1025); key != "sni-1025.conf" {
+		t.Errorf("unexpected server key %s", key)
+	}
+
+	if port, ok := ParseSNIServerKey("sni-1025.conf"); !ok || port != 1025 {
+		t.Errorf("expected port 1025, got %d", port)
+	}
+
+	for _, key := range []string{"default.postgres.conf", "sni-1025.confx", "sni-x.conf"} {
+		if _, ok := ParseSNIServerKey(key); ok {
+			t.Errorf("expected %s not to be a server key", key)
+		}
+	}
+}
+
+func TestRenderSNI(t *testing.T) {
+	server := SNIServer{Port: 1025, ProxyProtocol: true}
+	data := map[string]string{
+		SNIServerKey(1025):                server.String(),
+		SNIRouteKey("default", "a", 1025): SNIRoute{Hostname: "a.example.com", Upstream: "a.default.svc.cluster.local:5432"}.String(),
+		SNIRouteKey("default", "b", 1025): SNIRoute{Hostname: "b.example.com", Upstream: "b.default.svc.cluster.local:5432"}.String(),
+		SNIRouteKey("default", "c", 1026): SNIRoute{Hostname: "c.example.com", Upstream: "c.default.svc.cluster.local:5432"}.String(),
+	}
+
+	rendered := Render(data, 10261)
+	expected := `map $ssl_preread_server_name $tcpmap_sni_1025 {
+    hostnames;
+    a.example.com a.default.svc.cluster.local:5432;
+    b.example.com b.default.svc.cluster.local:5432;
+}
+
+` + server.String()
+
+	if !strings.Contains(rendered, expected) {
+		t.Errorf("expected the routes in the map of the shared port:\n%s", rendered)
+	}
+
+	if strings.Contains(rendered, "c.example.com") {
+		t.Errorf("expected routes without a shared port not to be rendered:\n%s", rendered)
+	}
+
+	if !strings.Contains(rendered, SNIRouteKey("default", "a", 1025)+"="+Checksum(data[SNIRouteKey("default", "a", 1025)])) {
+		t.Errorf("expected the status to report the routes:\n%s", rendered)
+	}
+}
+
+func TestSNIRoute(t *testing.T) {
+	route := SNIRoute{Hostname: "db.example.com", Upstream: ServiceAddress("default", "postgres", "cluster.local", 5432)}
+
+	parsed, ok := ParseSNIRoute(route.String())
+	if !ok || parsed != route {
+		t.Errorf("expected route %v to be parsed, got %v", route, parsed)
+	}
+
+	if _, ok := ParseSNIRoute("invalid"); ok {
+		t.Error("expected invalid route not to be parsed")
+	}
+
+	key := SNIRouteKey("default", "postgres", 1025)
+	if key != "default.postgres.sni-1025.map" {
+		t.Errorf("unexpected route key %s", key)
+	}
+
+	if !IsSNIRouteKey(key, 1025) || IsSNIRouteKey(key, 1026) || IsSNIRouteKey(SNIServerKey(1025), 1025) {
+		t.Errorf("unexpected route key match for %s", key)
+	}
+}
+
+func TestServerResolver(t *testing.T) {
+	s := Server{
+		Name:     "default/postgres",
+		Port:     1025,
+		Upstream: ServiceAddress("default", "postgres", "cluster.local", 5432),
+		Resolver: "kube-dns.kube-system.svc.cluster.local",
+	}
+
+	expected := `# default/postgres
+server {
+    listen 1025;
+    resolver kube-dns.kube-system.svc.cluster.local;
+    set $tcpmap_upstream postgres.default.svc.cluster.local:5432;
+    proxy_pass $tcpmap_upstream;
+}
+`
+
+	if got := s.String(); got != expected {
+		t.Errorf("unexpected server block:\n%s", got)
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	s := Server{
+		Name:           "default/redis",
+		Port:           1026,
+		ProxyProtocol:  true,
+		Upstream:       ServiceAddress("default", "redis", "cluster.local", 6379),
+		MaxConnections: 10,
+		ConnectTimeout: 1500 * time.Millisecond,
+		IdleTimeout:    10 * time.Minute,
+	}
+
+	expected := `# default/redis
+limit_conn_zone $proxy_protocol_addr zone=tcpmap_conn_1026:1m;
+
+server {
+    listen 1026 proxy_protocol;
+    limit_conn tcpmap_conn_1026 10;
+    proxy_connect_timeout 1500ms;
+    proxy_timeout 600s;
+    proxy_pass redis.default.svc.cluster.local:6379;
+}
+`
+
+	if got := s.String(); got != expected {
+		t.Errorf("unexpected server block:\n%s", got)
+	}
+}
+
+func TestServerUpstreamProxyProtocol(t *testing.T) {
+	s := Server{
+		Name:                  "default/redis",
+		Port:                  1026,
+		Upstream:              ServiceAddress("default", "redis", "cluster.local", 6379),
+		MaxConnections:        10,
+		UpstreamProxyProtocol: true,
+	}
+
+	expected := `# default/redis
+limit_conn_zone $binary_remote_addr zone=tcpmap_conn_1026:1m;
+
+server {
+    listen 1026;
+    limit_conn tcpmap_conn_1026 10;
+    proxy_protocol on;
+    proxy_pass redis.default.svc.cluster.local:6379;
+}
+`
+
+	if got := s.String(); got != expected {
+		t.Errorf("unexpected server block:\n%s", got)
+	}
+}
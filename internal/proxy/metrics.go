@@ -0,0 +1,57 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	directionReceived = "received"
+	directionSent     = "sent"
+)
+
+var (
+	connectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpmap_proxy_connections_total",
+			Help: "Connections accepted per port and result (forwarded, rejected, failed).",
+		},
+		[]string{"port", "result"},
+	)
+
+	activeConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tcpmap_proxy_active_connections",
+			Help: "Connections currently forwarded per port.",
+		},
+		[]string{"port"},
+	)
+
+	bytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcpmap_proxy_bytes_total",
+			Help: "Bytes forwarded per port, received from clients or sent to clients.",
+		},
+		[]string{"port", "direction"},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(connectionsTotal, activeConnections, bytesTotal)
+}
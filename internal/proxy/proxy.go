@@ -0,0 +1,482 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package proxy is a lightweight TCP proxy serving the elected ports of the mappings of a frontend service.
+// Connections are forwarded to the ready endpoints of the backend using round-robin.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// DefaultConnectTimeout is used for routes without a connect timeout
+const DefaultConnectTimeout = 5 * time.Second
+
+// Route forwards the connections of a port to the endpoints of a backend
+type Route struct {
+	// Name identifies the mapping (namespace/name)
+	Name string
+	// Port to listen on
+	Port int32
+	// Endpoints are the addresses (host:port) of the ready endpoints of the backend
+	Endpoints []string
+	// ProxyProtocol is the version of the PROXY protocol header sent to the endpoints
+	ProxyProtocol ProxyProtocol
+	// MaxConnections limits the concurrent connections of a single client address, unlimited if 0
+	MaxConnections int32
+	// ConnectTimeout is the timeout for establishing a connection to an endpoint
+	ConnectTimeout time.Duration
+	// IdleTimeout closes connections without any data transferred in either direction, disabled if 0
+	IdleTimeout time.Duration
+	// Backends split the connections by weight. Endpoints are ignored if set.
+	Backends []Backend
+}
+
+// Backend is a weighted backend of a route
+type Backend struct {
+	// Name identifies the backend service (namespace/name)
+	Name string
+	// Weight must be at least 1
+	Weight int32
+	// Endpoints are the addresses (host:port) of the ready endpoints of the backend
+	Endpoints []string
+}
+
+// candidates returns the endpoints to try for the n-th connection in order.
+// Without backends the endpoints are rotated round robin. With backends every round of
+// total weight connections is split between them by weight and the endpoints of the
+// selected backend are rotated, the endpoints of the other backends are used for failover.
+func (r *Route) candidates(n int) []string {
+	rotate := func(endpoints []string, n int) []string {
+		var rotated []string
+		for i := range endpoints {
+			rotated = append(rotated, endpoints[(n+i)%len(endpoints)])
+		}
+
+		return rotated
+	}
+
+	var total int
+	for _, b := range r.Backends {
+		if b.Weight > 0 && len(b.Endpoints) > 0 {
+			total += int(b.Weight)
+		}
+	}
+
+	if total == 0 {
+		if len(r.Endpoints) == 0 {
+			return nil
+		}
+
+		return rotate(r.Endpoints, n)
+	}
+
+	var selected []string
+	var failover []string
+	slot := n % total
+	for _, b := range r.Backends {
+		if b.Weight <= 0 || len(b.Endpoints) == 0 {
+			continue
+		}
+
+		weight := int(b.Weight)
+		if selected == nil && slot < weight {
+			selected = rotate(b.Endpoints, n/total*weight+slot)
+			continue
+		}
+
+		slot -= weight
+		failover = append(failover, b.Endpoints...)
+	}
+
+	return append(selected, failover...)
+}
+
+// Proxy listens on the ports of its routes
+type Proxy struct {
+	// Address is the host the ports are bound to, all interfaces if empty
+	Address string
+	// DrainTimeout is the time given to the connections of a removed port before they are closed
+	DrainTimeout time.Duration
+	Log          logr.Logger
+
+	mu    sync.Mutex
+	ports map[int32]*port
+}
+
+// New returns a proxy without any routes
+func New(address string, drainTimeout time.Duration, logger logr.Logger) *Proxy {
+	return &Proxy{
+		Address:      address,
+		DrainTimeout: drainTimeout,
+		Log:          logger,
+		ports:        make(map[int32]*port),
+	}
+}
+
+// Sync listens on the ports of the routes and drains the ports without a route.
+// Routes of ports already listened on are replaced for new connections only.
+// Ports which can not be bound are skipped and reported in the returned error.
+func (p *Proxy) Sync(routes []Route) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wanted := make(map[int32]Route, len(routes))
+	for _, route := range routes {
+		wanted[route.Port] = route
+	}
+
+	for number, l := range p.ports {
+		if _, ok := wanted[number]; !ok {
+			delete(p.ports, number)
+			p.Log.Info("draining port", "port", number)
+			go l.drain(p.DrainTimeout)
+		}
+	}
+
+	var errs []error
+	for number, route := range wanted {
+		route := route
+		if l, ok := p.ports[number]; ok {
+			l.route.Store(&route)
+			continue
+		}
+
+		l, err := listen(p.Address, &route, p.Log.WithValues("port", number))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to listen on port %d: %w", number, err))
+			continue
+		}
+
+		p.Log.Info("listening on port", "port", number, "mapping", route.Name)
+		p.ports[number] = l
+	}
+
+	return errors.Join(errs...)
+}
+
+// Start blocks until the context is done and drains all ports afterwards
+func (p *Proxy) Start(ctx context.Context) error {
+	<-ctx.Done()
+	p.Close()
+	return nil
+}
+
+// NeedLeaderElection is false as every replica serves the ports
+func (p *Proxy) NeedLeaderElection() bool {
+	return false
+}
+
+// Close drains all ports
+func (p *Proxy) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for number, l := range p.ports {
+		wg.Add(1)
+		go func(l *port) {
+			defer wg.Done()
+			l.drain(p.DrainTimeout)
+		}(l)
+
+		delete(p.ports, number)
+	}
+
+	wg.Wait()
+}
+
+type port struct {
+	ln    net.Listener
+	route atomic.Pointer[Route]
+	next  atomic.Uint32
+	label string
+	log   logr.Logger
+
+	mu       sync.Mutex
+	draining bool
+	conns    map[net.Conn]struct{}
+	clients  map[string]int32
+	wg       sync.WaitGroup
+}
+
+func listen(address string, route *Route, logger logr.Logger) (*port, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(int(route.Port))))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &port{
+		ln:      ln,
+		label:   strconv.Itoa(int(route.Port)),
+		log:     logger,
+		conns:   make(map[net.Conn]struct{}),
+		clients: make(map[string]int32),
+	}
+
+	l.route.Store(route)
+	go l.serve()
+
+	return l, nil
+}
+
+func (l *port) serve() {
+	for {
+		conn, err := l.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			l.log.Error(err, "failed to accept connection")
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		l.mu.Lock()
+		if l.draining {
+			l.mu.Unlock()
+			conn.Close()
+			return
+		}
+
+		l.wg.Add(1)
+		l.conns[conn] = struct{}{}
+		l.mu.Unlock()
+
+		go func() {
+			defer l.wg.Done()
+			defer l.untrack(conn)
+			l.handle(conn)
+		}()
+	}
+}
+
+func (l *port) handle(client net.Conn) {
+	defer client.Close()
+
+	route := l.route.Load()
+	host, _, _ := net.SplitHostPort(client.RemoteAddr().String())
+	if !l.acquire(host, route.MaxConnections) {
+		connectionsTotal.WithLabelValues(l.label, "rejected").Inc()
+		return
+	}
+
+	defer l.release(host)
+
+	upstream, err := l.dial(route)
+	if err != nil {
+		connectionsTotal.WithLabelValues(l.label, "failed").Inc()
+		l.log.Info("failed to connect to backend", "mapping", route.Name, "error", err.Error())
+		return
+	}
+
+	l.track(upstream)
+	defer l.untrack(upstream)
+	defer upstream.Close()
+
+	header, err := Header(route.ProxyProtocol, client.RemoteAddr(), client.LocalAddr())
+	if err == nil && len(header) > 0 {
+		_, err = upstream.Write(header)
+	}
+
+	if err != nil {
+		connectionsTotal.WithLabelValues(l.label, "failed").Inc()
+		l.log.Info("failed to send PROXY protocol header", "mapping", route.Name, "error", err.Error())
+		return
+	}
+
+	connectionsTotal.WithLabelValues(l.label, "forwarded").Inc()
+	activeConnections.WithLabelValues(l.label).Inc()
+	defer activeConnections.WithLabelValues(l.label).Dec()
+
+	l.pipe(client, upstream, route.IdleTimeout)
+}
+
+// dial connects to the next endpoint in round-robin order, failing over to the following endpoints
+func (l *port) dial(route *Route) (net.Conn, error) {
+	endpoints := route.candidates(int(l.next.Add(1) - 1))
+	if len(endpoints) == 0 {
+		return nil, errors.New("backend has no ready endpoints")
+	}
+
+	timeout := route.ConnectTimeout
+	if timeout == 0 {
+		timeout = DefaultConnectTimeout
+	}
+
+	var err error
+	for _, endpoint := range endpoints {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", endpoint, timeout)
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// pipe copies data in both directions until both are closed or the connection has been idle for too long
+func (l *port) pipe(client, upstream net.Conn, idle time.Duration) {
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+
+	done := make(chan struct{})
+	defer close(done)
+
+	if idle > 0 {
+		go func() {
+			tick := idle / 4
+			if tick < time.Millisecond {
+				tick = time.Millisecond
+			}
+
+			ticker := time.NewTicker(tick)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case now := <-ticker.C:
+					if now.Sub(time.Unix(0, last.Load())) > idle {
+						client.Close()
+						upstream.Close()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		l.copy(upstream, client, directionReceived, &last)
+	}()
+
+	go func() {
+		defer wg.Done()
+		l.copy(client, upstream, directionSent, &last)
+	}()
+
+	wg.Wait()
+}
+
+func (l *port) copy(dst, src net.Conn, direction string, last *atomic.Int64) {
+	counter := bytesTotal.WithLabelValues(l.label, direction)
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			last.Store(time.Now().UnixNano())
+			counter.Add(float64(n))
+
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	// Forward the half-close so the other direction can still complete
+	if c, ok := dst.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+
+	if c, ok := src.(interface{ CloseRead() error }); ok {
+		_ = c.CloseRead()
+	}
+}
+
+// acquire counts a connection of a client address unless the limit is reached
+func (l *port) acquire(host string, limit int32) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit > 0 && l.clients[host] >= limit {
+		return false
+	}
+
+	l.clients[host]++
+	return true
+}
+
+func (l *port) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.clients[host]--
+	if l.clients[host] <= 0 {
+		delete(l.clients, host)
+	}
+}
+
+func (l *port) track(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns[conn] = struct{}{}
+}
+
+func (l *port) untrack(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, conn)
+}
+
+// drain stops accepting connections and waits for the active ones until the timeout, remaining connections are closed
+func (l *port) drain(timeout time.Duration) {
+	l.mu.Lock()
+	l.draining = true
+	l.mu.Unlock()
+
+	_ = l.ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		l.mu.Lock()
+		for conn := range l.conns {
+			conn.Close()
+		}
+		l.mu.Unlock()
+		<-done
+	}
+
+	activeConnections.DeleteLabelValues(l.label)
+}
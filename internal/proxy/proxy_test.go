@@ -0,0 +1,399 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+func TestHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1025}
+	src6 := &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 40000}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 1025}
+
+	tests := []struct {
+		name    string
+		version ProxyProtocol
+		src     net.Addr
+		dst     net.Addr
+		header  []byte
+		err     bool
+	}{
+		{name: "none", version: ProxyProtocolNone, src: src, dst: dst},
+		{name: "v1 tcp4", version: ProxyProtocolV1, src: src, dst: dst, header: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 40000 1025\r\n")},
+		{name: "v1 tcp6", version: ProxyProtocolV1, src: src6, dst: dst6, header: []byte("PROXY TCP6 fd00::1 fd00::2 40000 1025\r\n")},
+		{name: "v1 mixed families", version: ProxyProtocolV1, src: src, dst: dst6, header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v2 tcp4", version: ProxyProtocolV2, src: src, dst: dst, header: append(append([]byte{}, v2Signature...),
+			0x21, 0x11, 0x00, 0x0c, 10, 0, 0, 1, 10, 0, 0, 2, 0x9c, 0x40, 0x04, 0x01)},
+		{name: "v2 unix", version: ProxyProtocolV2, src: &net.UnixAddr{Name: "a"}, dst: &net.UnixAddr{Name: "b"}, header: append(append([]byte{}, v2Signature...),
+			0x20, 0x00, 0x00, 0x00)},
+		{name: "unknown version", version: "v3", src: src, dst: dst, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header, err := Header(test.version, test.src, test.dst)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if !bytes.Equal(header, test.header) {
+				t.Errorf("expected header %q, got %q", test.header, header)
+			}
+		})
+	}
+
+	header, _ := Header(ProxyProtocolV2, src6, dst6)
+	if len(header) != len(v2Signature)+4+36 {
+		t.Errorf("expected 36 bytes of tcp6 addresses, got header of length %d", len(header))
+	}
+}
+
+// backend answers every connection with its name followed by the first line received
+func backend(t *testing.T, name string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				fmt.Fprintf(conn, "%s %s", name, line)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// freePort returns a loopback port which is not listened on
+func freePort(t *testing.T) int32 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+	return int32(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func request(t *testing.T, port int32, line string) string {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.WriteString(conn, line); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestRoundRobin(t *testing.T) {
+	p := New("127.0.0.1", time.Second, logr.Discard())
+	defer p.Close()
+
+	port := freePort(t)
+	if err := p.Sync([]Route{{
+		Name:      "default/postgres",
+		Port:      port,
+		Endpoints: []string{backend(t, "a"), backend(t, "b")},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var responses []string
+	for i := 0; i < 4; i++ {
+		responses = append(responses, request(t, port, "hello\n"))
+	}
+
+	expected := []string{"a hello\n", "b hello\n", "a hello\n", "b hello\n"}
+	if fmt.Sprint(responses) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, responses)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	p := New("127.0.0.1", time.Second, logr.Discard())
+	defer p.Close()
+
+	port := freePort(t)
+	if err := p.Sync([]Route{{
+		Port:      port,
+		Endpoints: []string{fmt.Sprintf("127.0.0.1:%d", freePort(t)), backend(t, "b")},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if response := request(t, port, "hello\n"); response != "b hello\n" {
+		t.Errorf("expected the next endpoint to be used, got %q", response)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	p := New("127.0.0.1", time.Second, logr.Discard())
+	defer p.Close()
+
+	port := freePort(t)
+	if err := p.Sync([]Route{{
+		Port:          port,
+		Endpoints:     []string{backend(t, "a")},
+		ProxyProtocol: ProxyProtocolV1,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backend answers with the first line received which is the header
+	expected := fmt.Sprintf("a PROXY TCP4 127.0.0.1 127.0.0.1 %%d %d\r\n", port)
+	response := request(t, port, "hello\n")
+
+	var clientPort int
+	if _, err := fmt.Sscanf(response, expected, &clientPort); err != nil {
+		t.Errorf("expected a PROXY protocol header, got %q: %v", response, err)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	p := New("127.0.0.1", time.Second, logr.Discard())
+	defer p.Close()
+
+	port := freePort(t)
+	if err := p.Sync([]Route{{
+		Port:           port,
+		Endpoints:      []string{backend(t, "a")},
+		MaxConnections: 1,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the only connection allowed until the second one is rejected
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	rejected, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rejected.Close()
+	_ = rejected.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The connection is closed without being forwarded, possibly reset
+	_, _ = io.WriteString(rejected, "hello\n")
+	if b, _ := io.ReadAll(rejected); len(b) != 0 {
+		t.Errorf("expected the connection to be rejected, got %q", b)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	p := New("127.0.0.1", time.Second, logr.Discard())
+	defer p.Close()
+
+	// A timeout below the tick resolution must neither panic nor keep the connection open
+	port := freePort(t)
+	if err := p.Sync([]Route{{
+		Port:        port,
+		Endpoints:   []string{backend(t, "a")},
+		IdleTimeout: 3 * time.Nanosecond,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	start := time.Now()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the idle connection to be closed, took %s", elapsed)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	p := New("127.0.0.1", 5*time.Second, logr.Discard())
+	defer p.Close()
+
+	port := freePort(t)
+	if err := p.Sync([]Route{{Port: port, Endpoints: []string{backend(t, "a")}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if err := p.Sync(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// New connections are refused once the listener is closed
+	deadline := time.Now().Add(time.Second)
+	for {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			break
+		}
+
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("expected the port to stop accepting connections")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The connection accepted before is still served
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "hello\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "a hello\n" {
+		t.Errorf("expected the draining connection to be served, got %q", b)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	p := New("127.0.0.1", 100*time.Millisecond, logr.Discard())
+
+	port := freePort(t)
+	if err := p.Sync([]Route{{Port: port, Endpoints: []string{backend(t, "a")}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	// Give the proxy a chance to connect to the backend
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	p.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the idle connection to be closed after the drain timeout, took %s", elapsed)
+	}
+}
+
+func TestWeightedBackends(t *testing.T) {
+	p := New("127.0.0.1", time.Second, logr.Discard())
+	defer p.Close()
+
+	port := freePort(t)
+	if err := p.Sync([]Route{{
+		Port: port,
+		Backends: []Backend{
+			{Name: "default/postgres-old", Weight: 3, Endpoints: []string{backend(t, "old-a"), backend(t, "old-b")}},
+			{Name: "default/postgres-new", Weight: 1, Endpoints: []string{backend(t, "new")}},
+			{Name: "default/postgres-drained", Weight: 0, Endpoints: []string{backend(t, "drained")}},
+		},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var responses []string
+	for i := 0; i < 8; i++ {
+		responses = append(responses, request(t, port, "hello\n"))
+	}
+
+	expected := []string{
+		"old-a hello\n", "old-b hello\n", "old-a hello\n", "new hello\n",
+		"old-b hello\n", "old-a hello\n", "old-b hello\n", "new hello\n",
+	}
+
+	if fmt.Sprint(responses) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, responses)
+	}
+}
+
+func TestWeightedFailover(t *testing.T) {
+	p := New("127.0.0.1", time.Second, logr.Discard())
+	defer p.Close()
+
+	port := freePort(t)
+	if err := p.Sync([]Route{{
+		Port: port,
+		Backends: []Backend{
+			{Name: "default/postgres-old", Weight: 1, Endpoints: []string{fmt.Sprintf("127.0.0.1:%d", freePort(t))}},
+			{Name: "default/postgres-new", Weight: 1, Endpoints: []string{backend(t, "new")}},
+		},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if response := request(t, port, "hello\n"); response != "new hello\n" {
+		t.Errorf("expected the other backend to be used, got %q", response)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// ProxyProtocol is the version of the PROXY protocol header sent to the backends
+type ProxyProtocol string
+
+const (
+	// ProxyProtocolNone sends no header
+	ProxyProtocolNone ProxyProtocol = ""
+	// ProxyProtocolV1 sends the human readable header
+	ProxyProtocolV1 ProxyProtocol = "v1"
+	// ProxyProtocolV2 sends the binary header
+	ProxyProtocolV2 ProxyProtocol = "v2"
+)
+
+// v2Signature starts every binary header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Header encodes the PROXY protocol header of a connection from src to dst.
+// Connections which are not TCP or mix address families are announced as unknown (v1) or local (v2).
+func Header(version ProxyProtocol, src, dst net.Addr) ([]byte, error) {
+	switch version {
+	case ProxyProtocolNone:
+		return nil, nil
+	case ProxyProtocolV1:
+		return headerV1(src, dst), nil
+	case ProxyProtocolV2:
+		return headerV2(src, dst), nil
+	}
+
+	return nil, fmt.Errorf("unknown PROXY protocol version %q", version)
+}
+
+// tcpAddrs returns the addresses of a TCP connection as IPv4 if both are IPv4
+func tcpAddrs(src, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool, bool) {
+	s, ok := src.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false, false
+	}
+
+	d, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false, false
+	}
+
+	v4 := s.IP.To4() != nil && d.IP.To4() != nil
+	v6 := s.IP.To4() == nil && d.IP.To4() == nil
+	return s, d, v4, v4 || v6
+}
+
+func headerV1(src, dst net.Addr) []byte {
+	s, d, v4, ok := tcpAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP6"
+	if v4 {
+		family = "TCP4"
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, s.IP.String(), d.IP.String(), s.Port, d.Port))
+}
+
+func headerV2(src, dst net.Addr) []byte {
+	var b bytes.Buffer
+	b.Write(v2Signature)
+
+	s, d, v4, ok := tcpAddrs(src, dst)
+	if !ok {
+		// LOCAL command without addresses
+		b.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return b.Bytes()
+	}
+
+	// PROXY command over TCP
+	family, srcIP, dstIP := byte(0x21), s.IP.To16(), d.IP.To16()
+	if v4 {
+		family, srcIP, dstIP = 0x11, s.IP.To4(), d.IP.To4()
+	}
+
+	b.Write([]byte{0x21, family})
+	_ = binary.Write(&b, binary.BigEndian, uint16(2*len(srcIP)+4))
+	b.Write(srcIP)
+	b.Write(dstIP)
+	_ = binary.Write(&b, binary.BigEndian, uint16(s.Port))
+	_ = binary.Write(&b, binary.BigEndian, uint16(d.Port))
+
+	return b.Bytes()
+}
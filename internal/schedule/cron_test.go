@@ -0,0 +1,150 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	valid := []string{"* * * * *", "0 8 * * mon-fri", "*/15 9-17 * * 1,3,5", "30 2 1 jan,jul *", "5/10 * * * 7", "@daily", "@hourly"}
+	for _, expr := range valid {
+		if _, err := Parse(expr); err != nil {
+			t.Errorf("expected %q to be valid: %v", expr, err)
+		}
+	}
+
+	invalid := []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "@often"}
+	for _, expr := range invalid {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("expected %q to be invalid", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+
+	tests := []struct {
+		expr string
+		from time.Time
+		next time.Time
+	}{
+		{expr: "* * * * *", from: time.Date(2023, 5, 1, 10, 0, 30, 0, time.UTC), next: time.Date(2023, 5, 1, 10, 1, 0, 0, time.UTC)},
+		{expr: "0 8 * * mon-fri", from: time.Date(2023, 5, 5, 8, 0, 0, 0, time.UTC), next: time.Date(2023, 5, 8, 8, 0, 0, 0, time.UTC)},
+		{expr: "*/15 9-17 * * *", from: time.Date(2023, 5, 1, 17, 50, 0, 0, time.UTC), next: time.Date(2023, 5, 2, 9, 0, 0, 0, time.UTC)},
+		{expr: "0 0 29 2 *", from: time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC), next: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{expr: "@monthly", from: time.Date(2023, 12, 15, 0, 0, 0, 0, time.UTC), next: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// Day of month and day of week match either if both are restricted
+		{expr: "0 0 13 * fri", from: time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC), next: time.Date(2023, 5, 5, 0, 0, 0, 0, time.UTC)},
+		// 02:30 does not exist when the clock is advanced
+		{expr: "30 * * * *", from: time.Date(2023, 3, 26, 1, 45, 0, 0, zurich), next: time.Date(2023, 3, 26, 3, 30, 0, 0, zurich)},
+		{expr: "0 0 30 2 *", from: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), next: time.Time{}},
+	}
+
+	for _, test := range tests {
+		c, err := Parse(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if next := c.Next(test.from); !next.Equal(test.next) {
+			t.Errorf("%s: expected %s after %s, got %s", test.expr, test.next, test.from, next)
+		}
+	}
+}
+
+func TestPrev(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+
+	tests := []struct {
+		expr string
+		from time.Time
+		prev time.Time
+	}{
+		{expr: "* * * * *", from: time.Date(2023, 5, 1, 10, 0, 30, 0, time.UTC), prev: time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{expr: "0 8 * * mon-fri", from: time.Date(2023, 5, 8, 7, 59, 0, 0, time.UTC), prev: time.Date(2023, 5, 5, 8, 0, 0, 0, time.UTC)},
+		{expr: "*/15 9-17 * * *", from: time.Date(2023, 5, 2, 8, 0, 0, 0, time.UTC), prev: time.Date(2023, 5, 1, 17, 45, 0, 0, time.UTC)},
+		{expr: "0 0 29 2 *", from: time.Date(2024, 2, 28, 0, 0, 0, 0, time.UTC), prev: time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{expr: "@monthly", from: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), prev: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{expr: "0 0 13 * fri", from: time.Date(2023, 5, 4, 0, 0, 0, 0, time.UTC), prev: time.Date(2023, 4, 28, 0, 0, 0, 0, time.UTC)},
+		// 02:30 does not exist when the clock is advanced
+		{expr: "30 2 * * *", from: time.Date(2023, 3, 26, 3, 15, 0, 0, zurich), prev: time.Date(2023, 3, 25, 2, 30, 0, 0, zurich)},
+		// 02:30 exists twice when the clock is turned back, the later one is returned
+		{expr: "30 * * * *", from: time.Date(2023, 10, 29, 3, 15, 0, 0, zurich), prev: time.Date(2023, 10, 29, 3, 15, 0, 0, zurich).Add(-45 * time.Minute)},
+		{expr: "0 0 30 2 *", from: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), prev: time.Time{}},
+	}
+
+	for _, test := range tests {
+		c, err := Parse(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if prev := c.Prev(test.from); !prev.Equal(test.prev) {
+			t.Errorf("%s: expected %s before %s, got %s", test.expr, test.prev, test.from, prev)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	workdays, _ := Parse("0 8 * * mon-fri")
+	nightly, _ := Parse("0 22 * * *")
+
+	windows := []Window{
+		{Start: workdays, Duration: 10 * time.Hour},
+		{Start: nightly, Duration: time.Hour},
+	}
+
+	tests := []struct {
+		name       string
+		now        time.Time
+		active     bool
+		transition time.Time
+	}{
+		{name: "within working hours", now: time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC), active: true, transition: time.Date(2023, 5, 1, 18, 0, 0, 0, time.UTC)},
+		{name: "at the start", now: time.Date(2023, 5, 1, 8, 0, 0, 0, time.UTC), active: true, transition: time.Date(2023, 5, 1, 18, 0, 0, 0, time.UTC)},
+		{name: "at the end", now: time.Date(2023, 5, 1, 18, 0, 0, 0, time.UTC), active: false, transition: time.Date(2023, 5, 1, 22, 0, 0, 0, time.UTC)},
+		{name: "nightly window", now: time.Date(2023, 5, 6, 22, 30, 0, 0, time.UTC), active: true, transition: time.Date(2023, 5, 6, 23, 0, 0, 0, time.UTC)},
+		{name: "weekend", now: time.Date(2023, 5, 6, 12, 0, 0, 0, time.UTC), active: false, transition: time.Date(2023, 5, 6, 22, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		active, transition := Evaluate(windows, test.now)
+		if active != test.active || !transition.Equal(test.transition) {
+			t.Errorf("%s: expected active=%t until %s, got active=%t until %s", test.name, test.active, test.transition, active, transition)
+		}
+	}
+}
+
+func TestEvaluateLongWindow(t *testing.T) {
+	// Every minute starts a window of a year which must not be walked activation by activation
+	minutely, _ := Parse("* * * * *")
+	now := time.Date(2023, 5, 1, 12, 0, 30, 0, time.UTC)
+
+	active, transition := Evaluate([]Window{{Start: minutely, Duration: 365 * 24 * time.Hour}}, now)
+	if expected := time.Date(2024, 4, 30, 12, 0, 0, 0, time.UTC); !active || !transition.Equal(expected) {
+		t.Errorf("expected active=true until %s, got active=%t until %s", expected, active, transition)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcpservices
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"math/rand"
+)
+
+// PortSet is a bitmap of ports.
+// The zero value is an empty set.
+type PortSet struct {
+	words [1024]uint64
+}
+
+// Add adds a port to the set, invalid ports are ignored
+func (s *PortSet) Add(port int32) {
+	if port < 0 || port > 65535 {
+		return
+	}
+
+	s.words[port>>6] |= 1 << (port & 63)
+}
+
+// Remove removes a port from the set
+func (s *PortSet) Remove(port int32) {
+	if port < 0 || port > 65535 {
+		return
+	}
+
+	s.words[port>>6] &^= 1 << (port & 63)
+}
+
+// Has reports whether a port is part of the set
+func (s *PortSet) Has(port int32) bool {
+	if port < 0 || port > 65535 {
+		return false
+	}
+
+	return s.words[port>>6]&(1<<(port&63)) != 0
+}
+
+// Union adds all ports of another set
+func (s *PortSet) Union(other *PortSet) {
+	for i := range s.words {
+		s.words[i] |= other.words[i]
+	}
+}
+
+// Reset removes all ports
+func (s *PortSet) Reset() {
+	s.words = [1024]uint64{}
+}
+
+// Elect returns a port within [minPort, maxPort] which is not part of the set according to the election strategy.
+// The identity (namespace/name of the mapping) is only used by ElectionHashedStable.
+// If no port is available 0 is returned.
+func (s *PortSet) Elect(minPort, maxPort int32, strategy ElectionStrategy, identity string) int32 {
+	if minPort == 0 {
+		minPort = DefaultMinPort
+	}
+
+	if maxPort == 0 {
+		maxPort = DefaultMaxPort
+	}
+
+	if minPort < 1 {
+		minPort = 1
+	}
+
+	if maxPort > 65535 {
+		maxPort = 65535
+	}
+
+	if maxPort < minPort {
+		return 0
+	}
+
+	size := uint64(maxPort-minPort) + 1
+	start := minPort
+
+	switch strategy {
+	case ElectionRandom:
+		start += int32(rand.Int63n(int64(size)))
+	case ElectionHashedStable:
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(identity))
+		start += int32(h.Sum64() % size)
+	}
+
+	if port := s.free(start, maxPort); port != 0 {
+		return port
+	}
+
+	if start == minPort {
+		return 0
+	}
+
+	return s.free(minPort, start-1)
+}
+
+// free returns the lowest port within [from, to] which is not part of the set or 0
+func (s *PortSet) free(from, to int32) int32 {
+	for w := from >> 6; w <= to>>6; w++ {
+		word := ^s.words[w]
+		if w == from>>6 {
+			word &= ^uint64(0) << (from & 63)
+		}
+
+		if w == to>>6 {
+			word &= ^uint64(0) >> (63 - to&63)
+		}
+
+		if word != 0 {
+			return w<<6 + int32(bits.TrailingZeros64(word))
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,165 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcpservices
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	v1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
+)
+
+// FrontendServiceKey returns the frontend service of a mapping.
+// A default reference (namespace/name or name) takes precedence over the one from the mapping.
+// False is returned if neither is set.
+func FrontendServiceKey(tcpmap v1beta1.TCPIngressMapping, defaultRef string) (types.NamespacedName, bool) {
+	if defaultRef != "" {
+		return ParseRef(tcpmap.Namespace, defaultRef), true
+	}
+
+	if tcpmap.Spec.FrontendService == nil {
+		return types.NamespacedName{}, false
+	}
+
+	return ref(tcpmap.Namespace, tcpmap.Spec.FrontendService.Namespace, tcpmap.Spec.FrontendService.Name), true
+}
+
+// TCPConfigMapKey returns the tcp configmap of a mapping.
+// A default reference (namespace/name or name) takes precedence over the one from the mapping.
+// False is returned if neither is set.
+func TCPConfigMapKey(tcpmap v1beta1.TCPIngressMapping, defaultRef string) (types.NamespacedName, bool) {
+	if defaultRef != "" {
+		return ParseRef(tcpmap.Namespace, defaultRef), true
+	}
+
+	if tcpmap.Spec.TCPConfigMap == nil {
+		return types.NamespacedName{}, false
+	}
+
+	return ref(tcpmap.Namespace, tcpmap.Spec.TCPConfigMap.Namespace, tcpmap.Spec.TCPConfigMap.Name), true
+}
+
+// BackendServiceKey returns the backend service of a mapping.
+// For a backend in a remote cluster, outside of the cluster or split by weight this is the service mirroring it in the namespace of the mapping.
+func BackendServiceKey(tcpmap v1beta1.TCPIngressMapping) types.NamespacedName {
+	if IsMirrored(tcpmap) {
+		return types.NamespacedName{Namespace: tcpmap.Namespace, Name: MirrorServiceName(tcpmap)}
+	}
+
+	return ref(tcpmap.Namespace, tcpmap.Spec.BackendService.Namespace, tcpmap.Spec.BackendService.Name)
+}
+
+// BackendPort returns the port of the backend service of a mapping
+func BackendPort(tcpmap v1beta1.TCPIngressMapping) intstr.IntOrString {
+	if tcpmap.Spec.BackendService.External != nil {
+		return intstr.FromInt(int(tcpmap.Spec.BackendService.External.Port))
+	}
+
+	if IsWeighted(tcpmap) {
+		return intstr.FromString(WeightedPortName)
+	}
+
+	return tcpmap.Spec.BackendService.Port
+}
+
+// IsMirrored returns true if the backend service of a mapping is created by the controller
+// as it lives in a remote cluster, outside of the cluster or aggregates weighted backends
+func IsMirrored(tcpmap v1beta1.TCPIngressMapping) bool {
+	return tcpmap.Spec.BackendService.KubeConfig != nil || tcpmap.Spec.BackendService.External != nil || IsWeighted(tcpmap)
+}
+
+// IsWeighted returns true if the connections of a mapping are split between multiple backend services
+func IsWeighted(tcpmap v1beta1.TCPIngressMapping) bool {
+	return len(tcpmap.Spec.BackendService.Weighted) > 0
+}
+
+// WeightedBackendKey returns the service of a weighted backend of a mapping
+func WeightedBackendKey(tcpmap v1beta1.TCPIngressMapping, backend v1beta1.WeightedBackend) types.NamespacedName {
+	return ref(tcpmap.Namespace, backend.Namespace, backend.Name)
+}
+
+// Weight returns the weight of a weighted backend
+func Weight(backend v1beta1.WeightedBackend) int32 {
+	if backend.Weight == nil {
+		return 1
+	}
+
+	return *backend.Weight
+}
+
+// TerminatesTLS returns true if TLS of a mapping is terminated at the frontend
+func TerminatesTLS(tcpmap v1beta1.TCPIngressMapping) bool {
+	return tcpmap.Spec.TLS != nil && tcpmap.Spec.TLS.Mode != v1beta1.TLSPassthrough
+}
+
+// RoutesBySNI returns true if a mapping shares its port with other mappings routed by SNI
+func RoutesBySNI(tcpmap v1beta1.TCPIngressMapping) bool {
+	return tcpmap.Spec.TLS != nil && tcpmap.Spec.TLS.Hostname != ""
+}
+
+// HasLimits returns true if a mapping restricts the connections accepted at the frontend
+func HasLimits(tcpmap v1beta1.TCPIngressMapping) bool {
+	return tcpmap.Spec.Limits != nil && *tcpmap.Spec.Limits != (v1beta1.Limits{})
+}
+
+// ServedBySnippet returns true if the dedicated port of a mapping is served by a nginx stream snippet instead of the tcp configmap
+func ServedBySnippet(tcpmap v1beta1.TCPIngressMapping) bool {
+	return !RoutesBySNI(tcpmap) && (TerminatesTLS(tcpmap) || HasLimits(tcpmap))
+}
+
+// RemoteBackendServiceKey returns the backend service of a mapping within the remote cluster
+func RemoteBackendServiceKey(tcpmap v1beta1.TCPIngressMapping) types.NamespacedName {
+	return ref(tcpmap.Namespace, tcpmap.Spec.BackendService.Namespace, tcpmap.Spec.BackendService.Name)
+}
+
+// MirrorServiceName returns the name of the service owned by a mapping which mirrors its backend.
+// Names exceeding the length of a DNS label are truncated and suffixed with a hash of the mapping name.
+func MirrorServiceName(tcpmap v1beta1.TCPIngressMapping) string {
+	name := "tcpmap-" + strings.ReplaceAll(tcpmap.Name, ".", "-")
+	if len(name) <= validation.DNS1035LabelMaxLength {
+		return name
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(tcpmap.Name))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+
+	return strings.TrimRight(name[:validation.DNS1035LabelMaxLength-len(suffix)], "-") + suffix
+}
+
+// ParseRef parses a reference in the format namespace/name or name
+func ParseRef(defaultNamespace, ref string) types.NamespacedName {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 1 {
+		return types.NamespacedName{Namespace: defaultNamespace, Name: parts[0]}
+	}
+
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+}
+
+func ref(defaultNamespace, namespace, name string) types.NamespacedName {
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+
+	return types.NamespacedName{Namespace: namespace, Name: name}
+}
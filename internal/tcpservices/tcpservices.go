@@ -0,0 +1,180 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tcpservices handles the entries of the ingress-nginx tcp services configmap
+// (https://kubernetes.github.io/ingress-nginx/user-guide/exposing-tcp-udp-services/)
+// and the related ports on the frontend service.
+package tcpservices
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+var (
+	ErrInvalidEntry = errors.New("invalid tcp services entry")
+)
+
+const (
+	// ProxyProtocol enables PROXY protocol decoding or encoding in an entry
+	ProxyProtocol = "PROXY"
+
+	// DefaultMinPort is the lowest port elected if no pool is configured
+	DefaultMinPort int32 = 1025
+
+	// DefaultMaxPort is the highest port elected if no pool is configured
+	DefaultMaxPort int32 = 65535
+)
+
+// Entry is a value of the tcp services configmap in the format
+// <namespace/service name>:<service port>:[PROXY]:[PROXY]
+type Entry struct {
+	Namespace string
+	Service   string
+	Port      string
+	// Decode expects the PROXY protocol from clients (listen)
+	Decode bool
+	// Encode sends the PROXY protocol to the backend (proxy_pass)
+	Encode bool
+}
+
+// Backend returns the backend service in the format namespace/name
+func (e Entry) Backend() string {
+	return fmt.Sprintf("%s/%s", e.Namespace, e.Service)
+}
+
+// String formats the entry as tcp services configmap value
+func (e Entry) String() string {
+	v := fmt.Sprintf("%s:%s", e.Backend(), e.Port)
+	if e.Decode || e.Encode {
+		v = fmt.Sprintf("%s:%s", v, proxyField(e.Decode))
+	}
+
+	if e.Encode {
+		v = fmt.Sprintf("%s:%s", v, proxyField(e.Encode))
+	}
+
+	return v
+}
+
+func proxyField(enabled bool) string {
+	if enabled {
+		return ProxyProtocol
+	}
+
+	return ""
+}
+
+// ParseEntry parses a tcp services configmap value
+func ParseEntry(value string) (Entry, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 4 {
+		return Entry{}, fmt.Errorf("%w: %q", ErrInvalidEntry, value)
+	}
+
+	backend := strings.Split(parts[0], "/")
+	if len(backend) != 2 || backend[0] == "" || backend[1] == "" || parts[1] == "" {
+		return Entry{}, fmt.Errorf("%w: %q", ErrInvalidEntry, value)
+	}
+
+	e := Entry{
+		Namespace: backend[0],
+		Service:   backend[1],
+		Port:      parts[1],
+	}
+
+	if len(parts) > 2 {
+		e.Decode = parts[2] == ProxyProtocol
+	}
+
+	if len(parts) > 3 {
+		e.Encode = parts[3] == ProxyProtocol
+	}
+
+	return e, nil
+}
+
+// ParsePort parses a key of the tcp services configmap
+func ParsePort(key string) (int32, error) {
+	p, err := strconv.ParseInt(key, 10, 32)
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %q", key)
+	}
+
+	return int32(p), nil
+}
+
+// SNIPortName is the name of the port on the frontend service shared by the mappings routed by SNI
+const SNIPortName = "tcpmap-sni"
+
+// WeightedPortName is the name of the port of the service aggregating the weighted backends of a mapping
+const WeightedPortName = "tcp"
+
+// PortName returns the name of the port on the frontend service for a backend service
+func PortName(namespace, service string) string {
+	return fmt.Sprintf("%s-%s", namespace, service)
+}
+
+// UsedPorts returns the ports registered on a frontend service and in its tcp configmap
+func UsedPorts(svc v1.Service, cm v1.ConfigMap) []int32 {
+	var ports []int32
+	for _, p := range svc.Spec.Ports {
+		ports = append(ports, p.Port)
+	}
+
+	for k := range cm.Data {
+		if p, err := ParsePort(k); err == nil {
+			ports = append(ports, p)
+		}
+	}
+
+	return ports
+}
+
+// ElectionStrategy defines which of the free ports is elected
+type ElectionStrategy string
+
+const (
+	// ElectionLowest elects the lowest free port
+	ElectionLowest ElectionStrategy = "Lowest"
+	// ElectionRandom elects a random free port
+	ElectionRandom ElectionStrategy = "Random"
+	// ElectionHashedStable elects a port derived from the identity of a mapping.
+	// If the port is used the next higher free port is elected, wrapping around at the end of the pool.
+	ElectionHashedStable ElectionStrategy = "HashedStable"
+)
+
+// FindPort returns the lowest port within [minPort, maxPort] which is not used.
+// If no port is available 0 is returned.
+func FindPort(used []int32, minPort, maxPort int32) int32 {
+	return ElectPort(used, minPort, maxPort, ElectionLowest, "")
+}
+
+// ElectPort returns a port within [minPort, maxPort] which is not used according to the election strategy.
+// The identity (namespace/name of the mapping) is only used by ElectionHashedStable.
+// If no port is available 0 is returned.
+func ElectPort(used []int32, minPort, maxPort int32, strategy ElectionStrategy, identity string) int32 {
+	var set PortSet
+	for _, p := range used {
+		set.Add(p)
+	}
+
+	return set.Elect(minPort, maxPort, strategy, identity)
+}
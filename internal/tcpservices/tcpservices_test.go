@@ -0,0 +1,137 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tcpservices
+
+import (
+	"testing"
+)
+
+func TestParseEntry(t *testing.T) {
+	tests := []struct {
+		value   string
+		entry   Entry
+		invalid bool
+	}{
+		{value: "default/postgres:5432", entry: Entry{Namespace: "default", Service: "postgres", Port: "5432"}},
+		{value: "default/postgres:5432:PROXY", entry: Entry{Namespace: "default", Service: "postgres", Port: "5432", Decode: true}},
+		{value: "default/postgres:5432::PROXY", entry: Entry{Namespace: "default", Service: "postgres", Port: "5432", Encode: true}},
+		{value: "default/postgres:5432:PROXY:PROXY", entry: Entry{Namespace: "default", Service: "postgres", Port: "5432", Decode: true, Encode: true}},
+		{value: "postgres:5432", invalid: true},
+		{value: "default/postgres", invalid: true},
+		{value: "default/postgres:", invalid: true},
+		{value: "default/postgres:5432:PROXY:PROXY:PROXY", invalid: true},
+	}
+
+	for _, test := range tests {
+		entry, err := ParseEntry(test.value)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("expected %q to be invalid", test.value)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("expected %q to be valid, got %v", test.value, err)
+			continue
+		}
+
+		if entry != test.entry {
+			t.Errorf("expected %q to be parsed as %#v, got %#v", test.value, test.entry, entry)
+		}
+
+		if entry.String() != test.value {
+			t.Errorf("expected %#v to be formatted as %q, got %q", entry, test.value, entry.String())
+		}
+	}
+}
+
+func TestElectPort(t *testing.T) {
+	if port := ElectPort([]int32{1025, 1027}, 1025, 1030, ElectionLowest, ""); port != 1026 {
+		t.Errorf("expected lowest free port 1026, got %d", port)
+	}
+
+	if port := ElectPort([]int32{1025, 1026}, 1025, 1026, ElectionLowest, ""); port != 0 {
+		t.Errorf("expected no port in a full pool, got %d", port)
+	}
+
+	for i := 0; i < 100; i++ {
+		if port := ElectPort([]int32{1025, 1026, 1028}, 1025, 1028, ElectionRandom, ""); port != 1027 {
+			t.Fatalf("expected random port 1027 as the only free one, got %d", port)
+		}
+	}
+
+	preferred := ElectPort(nil, 2000, 2999, ElectionHashedStable, "default/postgres")
+	if preferred < 2000 || preferred > 2999 {
+		t.Fatalf("expected hashed port within the pool, got %d", preferred)
+	}
+
+	if port := ElectPort([]int32{2000, 2001}, 2000, 2999, ElectionHashedStable, "default/postgres"); preferred > 2001 && port != preferred {
+		t.Errorf("expected the same hashed port %d independent of other ports, got %d", preferred, port)
+	}
+
+	next := preferred + 1
+	if next > 2999 {
+		next = 2000
+	}
+
+	if port := ElectPort([]int32{preferred}, 2000, 2999, ElectionHashedStable, "default/postgres"); port != next {
+		t.Errorf("expected probing to the next port %d, got %d", next, port)
+	}
+
+	if port := ElectPort([]int32{2999}, 2999, 2999, ElectionHashedStable, "default/postgres"); port != 0 {
+		t.Errorf("expected no port in a full pool, got %d", port)
+	}
+}
+
+func TestPortSet(t *testing.T) {
+	var set PortSet
+	for p := int32(1025); p <= 1100; p++ {
+		set.Add(p)
+	}
+
+	set.Remove(1090)
+
+	if !set.Has(1025) || set.Has(1090) || set.Has(1101) {
+		t.Errorf("unexpected ports in set")
+	}
+
+	if port := set.Elect(1025, 2000, ElectionLowest, ""); port != 1090 {
+		t.Errorf("expected port 1090, got %d", port)
+	}
+
+	set.Add(1090)
+	if port := set.Elect(1025, 2000, ElectionLowest, ""); port != 1101 {
+		t.Errorf("expected port 1101, got %d", port)
+	}
+
+	if port := set.Elect(1025, 1100, ElectionLowest, ""); port != 0 {
+		t.Errorf("expected no port, got %d", port)
+	}
+
+	var other PortSet
+	other.Add(65535)
+	set.Union(&other)
+	if port := set.Elect(65530, 65535, ElectionLowest, ""); port != 65530 {
+		t.Errorf("expected port 65530, got %d", port)
+	}
+
+	if port := set.Elect(65535, 65535, ElectionLowest, ""); port != 0 {
+		t.Errorf("expected no port, got %d", port)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package xds
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	listenerservice "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/log"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/go-logr/logr"
+	"google.golang.org/grpc"
+)
+
+// Server is a xDS control plane serving a snapshot per envoy fleet.
+// A fleet is identified by the cluster of the envoy nodes (--service-cluster) which equals the frontend service (namespace/name).
+type Server struct {
+	// Address the grpc server listens on
+	Address string
+	Log     logr.Logger
+
+	cache cachev3.SnapshotCache
+
+	mu       sync.Mutex
+	versions map[string]string
+}
+
+// New returns a server with an empty in-memory snapshot cache
+func New(address string, logger logr.Logger) *Server {
+	return &Server{
+		Address:  address,
+		Log:      logger,
+		cache:    cachev3.NewSnapshotCache(true, fleetHash{}, logAdapter(logger)),
+		versions: make(map[string]string),
+	}
+}
+
+// fleetHash keys the snapshots by the cluster of the envoy node
+type fleetHash struct{}
+
+func (fleetHash) ID(node *core.Node) string {
+	return node.GetCluster()
+}
+
+// Sync updates the snapshots of all fleets.
+// Fleets which have been synced before but are not part of the update anymore get an empty snapshot.
+func (s *Server) Sync(ctx context.Context, fleets map[string][]Mapping) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := make(map[string][]Mapping, len(fleets))
+	for fleet := range s.versions {
+		all[fleet] = nil
+	}
+
+	for fleet, mappings := range fleets {
+		all[fleet] = mappings
+	}
+
+	for fleet, mappings := range all {
+		v := version(mappings)
+		if s.versions[fleet] == v {
+			continue
+		}
+
+		snapshot, err := NewSnapshot(v, mappings)
+		if err != nil {
+			return fmt.Errorf("failed to build snapshot of fleet %s: %w", fleet, err)
+		}
+
+		if err := s.cache.SetSnapshot(ctx, fleet, snapshot); err != nil {
+			return fmt.Errorf("failed to set snapshot of fleet %s: %w", fleet, err)
+		}
+
+		s.Log.Info("updated xds snapshot", "fleet", fleet, "version", v, "listeners", len(mappings))
+		s.versions[fleet] = v
+	}
+
+	return nil
+}
+
+// Snapshot returns the current snapshot of a fleet
+func (s *Server) Snapshot(fleet string) (cachev3.ResourceSnapshot, error) {
+	return s.cache.GetSnapshot(fleet)
+}
+
+// version derives the version of a snapshot from its mappings, hence unchanged mappings are not pushed again
+func version(mappings []Mapping) string {
+	sorted := append([]Mapping(nil), mappings...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Port < sorted[j].Port
+	})
+
+	h := fnv.New64a()
+	for _, m := range sorted {
+		fmt.Fprintf(h, "%+v\n", m)
+	}
+
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Start serves the xDS services until the context is done
+func (s *Server) Start(ctx context.Context) error {
+	lis, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ctx, lis)
+}
+
+// Serve serves the xDS services on the listener until the context is done
+func (s *Server) Serve(ctx context.Context, lis net.Listener) error {
+	grpcServer := grpc.NewServer()
+	srv := serverv3.NewServer(ctx, s.cache, nil)
+
+	discoverygrpc.RegisterAggregatedDiscoveryServiceServer(grpcServer, srv)
+	listenerservice.RegisterListenerDiscoveryServiceServer(grpcServer, srv)
+	clusterservice.RegisterClusterDiscoveryServiceServer(grpcServer, srv)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(grpcServer, srv)
+
+	go func() {
+		<-ctx.Done()
+		grpcServer.GracefulStop()
+	}()
+
+	s.Log.Info("serving xds", "address", lis.Addr().String())
+	return grpcServer.Serve(lis)
+}
+
+// NeedLeaderElection is false as every replica serves the envoy fleet
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+func logAdapter(logger logr.Logger) log.Logger {
+	return log.LoggerFuncs{
+		DebugFunc: func(format string, args ...interface{}) {
+			logger.V(1).Info(fmt.Sprintf(format, args...))
+		},
+		InfoFunc: func(format string, args ...interface{}) {
+			logger.V(1).Info(fmt.Sprintf(format, args...))
+		},
+		WarnFunc: func(format string, args ...interface{}) {
+			logger.Info(fmt.Sprintf(format, args...))
+		},
+		ErrorFunc: func(format string, args ...interface{}) {
+			logger.Error(nil, fmt.Sprintf(format, args...))
+		},
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package xds
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/go-logr/logr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestNewSnapshot(t *testing.T) {
+	snapshot, err := NewSnapshot("1", []Mapping{
+		{
+			Name:      "default/postgres",
+			Port:      1025,
+			Endpoints: []Endpoint{{Address: "10.0.0.1", Port: 5432}, {Address: "10.0.0.2", Port: 5432}},
+		},
+		{
+			Name:      "default/external",
+			Port:      1026,
+			DNS:       true,
+			Endpoints: []Endpoint{{Address: "db.example.com", Port: 5432}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners := snapshot.GetResources(resource.ListenerType)
+	if _, ok := listeners[ListenerName(1025)]; !ok || len(listeners) != 2 {
+		t.Errorf("expected a listener per port, got %v", listeners)
+	}
+
+	clusters := snapshot.GetResources(resource.ClusterType)
+	if c := clusters["default/external"].(*cluster.Cluster); c.GetType() != cluster.Cluster_STRICT_DNS || c.GetLoadAssignment() == nil {
+		t.Errorf("expected a cluster resolved by dns, got %v", c)
+	}
+
+	if c := clusters["default/postgres"].(*cluster.Cluster); c.GetType() != cluster.Cluster_EDS || c.GetConnectTimeout().AsDuration() != DefaultConnectTimeout {
+		t.Errorf("expected a cluster using eds, got %v", c)
+	}
+
+	endpoints := snapshot.GetResources(resource.EndpointType)
+	if len(endpoints) != 1 {
+		t.Fatalf("expected endpoints for the eds cluster only, got %v", endpoints)
+	}
+
+	if e := endpoints["default/postgres"].(*endpoint.ClusterLoadAssignment); len(e.Endpoints[0].LbEndpoints) != 2 {
+		t.Errorf("expected two endpoints, got %v", e)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	snapshot, err := NewSnapshot("1", []Mapping{{
+		Name:                    "default/postgres",
+		Port:                    1025,
+		DownstreamProxyProtocol: true,
+		UpstreamProxyProtocol:   "v2",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := snapshot.GetResources(resource.ListenerType)[ListenerName(1025)].(*listener.Listener)
+	if len(l.ListenerFilters) != 1 || l.ListenerFilters[0].Name != "envoy.filters.listener.proxy_protocol" {
+		t.Errorf("expected the proxy protocol listener filter, got %v", l.ListenerFilters)
+	}
+
+	c := snapshot.GetResources(resource.ClusterType)["default/postgres"].(*cluster.Cluster)
+	if c.GetTransportSocket().GetName() != upstreamProxyProtocolSocket {
+		t.Errorf("expected the upstream proxy protocol transport socket, got %v", c.GetTransportSocket())
+	}
+
+	if _, err := NewSnapshot("2", []Mapping{{Name: "default/postgres", Port: 1025, UpstreamProxyProtocol: "v3"}}); err == nil {
+		t.Error("expected an unknown version to be rejected")
+	}
+}
+
+func TestWeightedClusters(t *testing.T) {
+	snapshot, err := NewSnapshot("1", []Mapping{{
+		Name: "default/postgres",
+		Port: 1025,
+		Backends: []Backend{
+			{Name: "default/postgres-old", Weight: 90, Endpoints: []Endpoint{{Address: "10.0.0.1", Port: 5432}}},
+			{Name: "default/postgres-new", Weight: 10, Endpoints: []Endpoint{{Address: "10.0.1.1", Port: 5432}}},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusters := snapshot.GetResources(resource.ClusterType)
+	endpoints := snapshot.GetResources(resource.EndpointType)
+	for _, name := range []string{"default/postgres/default/postgres-old", "default/postgres/default/postgres-new"} {
+		if _, ok := clusters[name]; !ok {
+			t.Errorf("expected cluster %q, got %v", name, clusters)
+		}
+
+		if _, ok := endpoints[name]; !ok {
+			t.Errorf("expected endpoints of cluster %q, got %v", name, endpoints)
+		}
+	}
+
+	l := snapshot.GetResources(resource.ListenerType)[ListenerName(1025)].(*listener.Listener)
+	var proxy tcp.TcpProxy
+	if err := l.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(&proxy); err != nil {
+		t.Fatal(err)
+	}
+
+	weighted := proxy.GetWeightedClusters().GetClusters()
+	if len(weighted) != 2 || weighted[0].Weight != 90 || weighted[1].Weight != 10 {
+		t.Errorf("expected weighted clusters, got %v", weighted)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	a := []Mapping{{Name: "default/a", Port: 1025}, {Name: "default/b", Port: 1026}}
+	b := []Mapping{{Name: "default/b", Port: 1026}, {Name: "default/a", Port: 1025}}
+
+	if version(a) != version(b) {
+		t.Error("expected the version to be independent of the order of the mappings")
+	}
+
+	if version(a) == version(a[:1]) {
+		t.Error("expected the version to change with the mappings")
+	}
+}
+
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s := New("", logr.Discard())
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = s.Serve(ctx, lis)
+	}()
+
+	if err := s.Sync(ctx, map[string][]Mapping{
+		"ingress/envoy": {{Name: "default/postgres", Port: 1025, Endpoints: []Endpoint{{Address: "10.0.0.1", Port: 5432}}}},
+		"ingress/other": {{Name: "default/redis", Port: 1025}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.DialContext(ctx, lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	stream, err := discoverygrpc.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fetch acknowledges the previous response and waits for the next one
+	fetch := func(previous *discoverygrpc.DiscoveryResponse) *discoverygrpc.DiscoveryResponse {
+		if err := stream.Send(&discoverygrpc.DiscoveryRequest{
+			Node:          &core.Node{Id: "envoy-0", Cluster: "ingress/envoy"},
+			TypeUrl:       resource.ListenerType,
+			VersionInfo:   previous.GetVersionInfo(),
+			ResponseNonce: previous.GetNonce(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return res
+	}
+
+	res := fetch(nil)
+	if len(res.Resources) != 1 {
+		t.Fatalf("expected a single listener, got %d", len(res.Resources))
+	}
+
+	l := &listener.Listener{}
+	if err := res.Resources[0].UnmarshalTo(l); err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Name != ListenerName(1025) || l.GetAddress().GetSocketAddress().GetPortValue() != 1025 {
+		t.Errorf("unexpected listener %v", l)
+	}
+
+	// The fleet has no mappings left, an empty snapshot is pushed
+	if err := s.Sync(ctx, map[string][]Mapping{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := fetch(res); len(res.Resources) != 0 {
+		t.Errorf("expected no listeners, got %d", len(res.Resources))
+	}
+}
@@ -0,0 +1,305 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package xds serves the mappings to a fleet of envoy proxies using the xDS protocol.
+// Each elected port results in a listener proxying to a cluster whose endpoints are the ready endpoints of the backend.
+package xds
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	proxyprotocol "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/proxy_protocol/v3"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	upstreamproxyprotocol "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/proxy_protocol/v3"
+	rawbuffer "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/raw_buffer/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// DefaultConnectTimeout is used for clusters of mappings without a connect timeout
+const DefaultConnectTimeout = 5 * time.Second
+
+// upstreamProxyProtocolSocket is the transport socket sending the PROXY protocol header to the endpoints
+const upstreamProxyProtocolSocket = "envoy.transport_sockets.upstream_proxy_protocol"
+
+// Mapping is a port served by the envoy fleet
+type Mapping struct {
+	// Name identifies the mapping (namespace/name)
+	Name string
+	// Port is the elected port
+	Port int32
+	// Endpoints are the ready endpoints of the backend
+	Endpoints []Endpoint
+	// DNS resolves the endpoints by their hostname instead of using them as IP addresses
+	DNS bool
+	// ConnectTimeout is the timeout for establishing a connection to an endpoint
+	ConnectTimeout time.Duration
+	// IdleTimeout closes connections without any data transferred, the envoy default is used if 0
+	IdleTimeout time.Duration
+	// DownstreamProxyProtocol expects a PROXY protocol header (v1 or v2) from the clients
+	DownstreamProxyProtocol bool
+	// UpstreamProxyProtocol is the version (v1 or v2) of the PROXY protocol header sent to the endpoints, none if empty
+	UpstreamProxyProtocol string
+	// Backends split the connections by weight, each backend gets its own cluster. Endpoints are ignored if set.
+	Backends []Backend
+}
+
+// Backend is a weighted backend of a mapping
+type Backend struct {
+	// Name identifies the backend service (namespace/name)
+	Name string
+	// Weight must be at least 1
+	Weight uint32
+	// Endpoints are the ready endpoints of the backend
+	Endpoints []Endpoint
+}
+
+// Endpoint is an address of a backend
+type Endpoint struct {
+	Address string
+	Port    int32
+}
+
+// ListenerName returns the name of the listener of a port
+func ListenerName(port int32) string {
+	return fmt.Sprintf("tcpmap_%d", port)
+}
+
+// ClusterName returns the name of the cluster of a weighted backend of a mapping
+func ClusterName(mapping, backend string) string {
+	return fmt.Sprintf("%s/%s", mapping, backend)
+}
+
+// NewSnapshot builds the listeners, clusters and endpoints of the mappings
+func NewSnapshot(version string, mappings []Mapping) (*cachev3.Snapshot, error) {
+	sorted := append([]Mapping(nil), mappings...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Port < sorted[j].Port
+	})
+
+	var listeners, clusters, endpoints []types.Resource
+	for _, m := range sorted {
+		l, err := newListener(m)
+		if err != nil {
+			return nil, err
+		}
+
+		listeners = append(listeners, l)
+
+		if len(m.Backends) == 0 {
+			c, err := newCluster(m.Name, m, m.DNS, m.Endpoints)
+			if err != nil {
+				return nil, err
+			}
+
+			clusters = append(clusters, c)
+
+			// Clusters resolved by DNS carry their endpoints inline
+			if !m.DNS {
+				endpoints = append(endpoints, newLoadAssignment(m.Name, m.Endpoints))
+			}
+
+			continue
+		}
+
+		for _, b := range m.Backends {
+			name := ClusterName(m.Name, b.Name)
+			c, err := newCluster(name, m, false, b.Endpoints)
+			if err != nil {
+				return nil, err
+			}
+
+			clusters = append(clusters, c)
+			endpoints = append(endpoints, newLoadAssignment(name, b.Endpoints))
+		}
+	}
+
+	snapshot, err := cachev3.NewSnapshot(version, map[resource.Type][]types.Resource{
+		resource.ListenerType: listeners,
+		resource.ClusterType:  clusters,
+		resource.EndpointType: endpoints,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot, snapshot.Consistent()
+}
+
+func newListener(m Mapping) (*listener.Listener, error) {
+	proxy := &tcp.TcpProxy{
+		StatPrefix: ListenerName(m.Port),
+		ClusterSpecifier: &tcp.TcpProxy_Cluster{
+			Cluster: m.Name,
+		},
+	}
+
+	if len(m.Backends) > 0 {
+		weighted := &tcp.TcpProxy_WeightedCluster{}
+		for _, b := range m.Backends {
+			weighted.Clusters = append(weighted.Clusters, &tcp.TcpProxy_WeightedCluster_ClusterWeight{
+				Name:   ClusterName(m.Name, b.Name),
+				Weight: b.Weight,
+			})
+		}
+
+		proxy.ClusterSpecifier = &tcp.TcpProxy_WeightedClusters{WeightedClusters: weighted}
+	}
+
+	if m.IdleTimeout > 0 {
+		proxy.IdleTimeout = durationpb.New(m.IdleTimeout)
+	}
+
+	config, err := anypb.New(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listener.Listener{
+		Name:    ListenerName(m.Port),
+		Address: socketAddress("0.0.0.0", m.Port),
+		FilterChains: []*listener.FilterChain{{
+			Filters: []*listener.Filter{{
+				Name:       wellknown.TCPProxy,
+				ConfigType: &listener.Filter_TypedConfig{TypedConfig: config},
+			}},
+		}},
+	}
+
+	if m.DownstreamProxyProtocol {
+		config, err := anypb.New(&proxyprotocol.ProxyProtocol{})
+		if err != nil {
+			return nil, err
+		}
+
+		l.ListenerFilters = []*listener.ListenerFilter{{
+			Name:       wellknown.ProxyProtocol,
+			ConfigType: &listener.ListenerFilter_TypedConfig{TypedConfig: config},
+		}}
+	}
+
+	return l, nil
+}
+
+func newCluster(name string, m Mapping, dns bool, endpoints []Endpoint) (*cluster.Cluster, error) {
+	timeout := m.ConnectTimeout
+	if timeout == 0 {
+		timeout = DefaultConnectTimeout
+	}
+
+	c := &cluster.Cluster{
+		Name:           name,
+		ConnectTimeout: durationpb.New(timeout),
+		LbPolicy:       cluster.Cluster_ROUND_ROBIN,
+	}
+
+	if m.UpstreamProxyProtocol != "" {
+		socket, err := newUpstreamProxyProtocolSocket(m.UpstreamProxyProtocol)
+		if err != nil {
+			return nil, err
+		}
+
+		c.TransportSocket = socket
+	}
+
+	if dns {
+		c.ClusterDiscoveryType = &cluster.Cluster_Type{Type: cluster.Cluster_STRICT_DNS}
+		c.LoadAssignment = newLoadAssignment(name, endpoints)
+		return c, nil
+	}
+
+	c.ClusterDiscoveryType = &cluster.Cluster_Type{Type: cluster.Cluster_EDS}
+	c.EdsClusterConfig = &cluster.Cluster_EdsClusterConfig{
+		EdsConfig: &core.ConfigSource{
+			ResourceApiVersion:    core.ApiVersion_V3,
+			ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}},
+		},
+	}
+
+	return c, nil
+}
+
+// newUpstreamProxyProtocolSocket wraps the plain transport socket to send a PROXY protocol header first
+func newUpstreamProxyProtocolSocket(version string) (*core.TransportSocket, error) {
+	config := &core.ProxyProtocolConfig{}
+	switch version {
+	case "v1":
+		config.Version = core.ProxyProtocolConfig_V1
+	case "v2":
+		config.Version = core.ProxyProtocolConfig_V2
+	default:
+		return nil, fmt.Errorf("unknown PROXY protocol version %q", version)
+	}
+
+	raw, err := anypb.New(&rawbuffer.RawBuffer{})
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := anypb.New(&upstreamproxyprotocol.ProxyProtocolUpstreamTransport{
+		Config: config,
+		TransportSocket: &core.TransportSocket{
+			Name:       wellknown.TransportSocketRawBuffer,
+			ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: raw},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &core.TransportSocket{
+		Name:       upstreamProxyProtocolSocket,
+		ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: transport},
+	}, nil
+}
+
+func newLoadAssignment(name string, endpoints []Endpoint) *endpoint.ClusterLoadAssignment {
+	var lbEndpoints []*endpoint.LbEndpoint
+	for _, e := range endpoints {
+		lbEndpoints = append(lbEndpoints, &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{Address: socketAddress(e.Address, e.Port)},
+			},
+		})
+	}
+
+	return &endpoint.ClusterLoadAssignment{
+		ClusterName: name,
+		Endpoints:   []*endpoint.LocalityLbEndpoints{{LbEndpoints: lbEndpoints}},
+	}
+}
+
+func socketAddress(address string, port int32) *core.Address {
+	return &core.Address{
+		Address: &core.Address_SocketAddress{
+			SocketAddress: &core.SocketAddress{
+				Protocol:      core.SocketAddress_TCP,
+				Address:       address,
+				PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(port)},
+			},
+		},
+	}
+}
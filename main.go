@@ -23,6 +23,8 @@ import (
 
 	infrav1beta1 "github.com/DoodleScheduling/tcpmap-controller/api/v1beta1"
 	"github.com/DoodleScheduling/tcpmap-controller/internal/controllers"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/tcpservices"
+	"github.com/DoodleScheduling/tcpmap-controller/internal/xds"
 	"github.com/fluxcd/pkg/runtime/client"
 	helper "github.com/fluxcd/pkg/runtime/controller"
 	"github.com/fluxcd/pkg/runtime/leaderelection"
@@ -58,6 +60,27 @@ var (
 	maxPort                 int32 = 65535
 	tcpConfigMap                  = ""
 	frontendService               = ""
+	backendGating                 = string(controllers.BackendGatingNone)
+	electionStrategy              = string(tcpservices.ElectionLowest)
+	dryRun                  bool
+	probe                   bool
+	probeTimeout            time.Duration
+	probeInterval           time.Duration
+	probeBanner             string
+	holdDown                time.Duration
+	reissueReleasedPorts    bool
+	shard                   string
+	remoteSyncInterval      time.Duration
+	expiryWarning           time.Duration
+	streamSnippetConfigMap  string
+	ingressNginxConfigMap   string
+	tlsSecret               string
+	tlsDir                  string
+	streamStatusPort        int32
+	nginxResolver           string
+	clusterDomain           string
+	provider                string
+	xdsAddr                 string
 	metricsAddr             string
 	healthAddr              string
 	concurrent              int
@@ -75,6 +98,27 @@ func main() {
 	flag.Int32Var(&maxPort, "max-port", 65535, "Do not elect a port above")
 	flag.StringVar(&tcpConfigMap, "tcp-services-configmap", "", "Set the default tcp configmap (https://kubernetes.github.io/ingress-nginx/user-guide/exposing-tcp-udp-services/). Might be set in the resource itself.")
 	flag.StringVar(&frontendService, "frontend-service", "", "Set the default nginx controller service. Might be set in the resource itself")
+	flag.StringVar(&backendGating, "backend-gating", string(controllers.BackendGatingNone), "Gate mappings on ready backend endpoints. One of 'none', 'ready' (only report Ready once the backend has ready endpoints) or 'publish' (only publish a mapping once the backend has ready endpoints).")
+	flag.StringVar(&electionStrategy, "election-strategy", string(tcpservices.ElectionLowest), "Strategy used to elect a free port. One of 'Lowest' (the lowest free port), 'Random' (a random free port) or 'HashedStable' (a port derived from the mapping namespace/name, stable across clusters).")
+	flag.BoolVar(&dryRun, "dry-run", false, "Do not modify frontend services and tcp configmaps. Planned changes are validated using a server-side dry-run and reported in the status, events and logs. Deleted mappings carrying the finalizer stay terminating until released by a controller without --dry-run.")
+	flag.BoolVar(&probe, "probe", false, "Periodically dial the elected port on the frontend service and report the result in the Reachable condition.")
+	flag.DurationVar(&probeTimeout, "probe-timeout", 5*time.Second, "Timeout of a single frontend port probe.")
+	flag.DurationVar(&probeInterval, "probe-interval", 5*time.Minute, "Interval at which reachable frontend ports are probed again.")
+	flag.StringVar(&probeBanner, "probe-banner", "", "Expected prefix of the data sent by the backend once connected for mappings without spec.probe.banner. Not verified if empty.")
+	flag.DurationVar(&holdDown, "hold-down", 0, "Period during which a port released by a deleted mapping is not elected again. Might be overridden per frontend service using the tcpmap.infra.doodle.com/hold-down annotation.")
+	flag.BoolVar(&reissueReleasedPorts, "reissue-released-ports", false, "Re-issue a held down port to a mapping recreated with the same namespace and name within the hold-down period.")
+	flag.StringVar(&shard, "shard", "", "Only manage pools whose frontend service (and tcp configmap) carry the label tcpmap.infra.doodle.com/shard with this value. Pools without the label are managed by the controller running without a shard.")
+	flag.DurationVar(&remoteSyncInterval, "remote-sync-interval", time.Minute, "Interval at which the endpoints of backends in remote clusters are mirrored again.")
+	flag.DurationVar(&expiryWarning, "expiry-warning", controllers.DefaultExpiryWarning, "Time before the expiry of a mapping with a ttl or expiresAt at which an Expiring warning event is emitted.")
+	flag.StringVar(&streamSnippetConfigMap, "stream-snippet-configmap", "", "ConfigMap (namespace/name or name within the namespace of the frontend service) receiving the nginx stream server blocks of mappings terminating TLS, routed by SNI or limiting connections. These features are unsupported if not set.")
+	flag.StringVar(&ingressNginxConfigMap, "ingress-nginx-configmap", "", "Controller ConfigMap of ingress-nginx (namespace/name or name within the namespace of the frontend service) whose stream-snippet setting receives the rendered stream snippets, ingress-nginx reloads on every change.")
+	flag.StringVar(&tlsSecret, "tls-secret", "", "Secret (namespace/name or name within the namespace of the frontend service) receiving the certificates of mappings terminating TLS. Must be mounted at --tls-dir in the ingress-nginx pods.")
+	flag.StringVar(&tlsDir, "tls-dir", controllers.DefaultTLSDir, "Directory in the ingress-nginx pods the --tls-secret is mounted at.")
+	flag.Int32Var(&streamStatusPort, "stream-status-port", controllers.DefaultStreamStatusPort, "Port in the ingress-nginx pods reporting the served stream snippets. A mapping served by a stream snippet only becomes ready once all pods serve it.")
+	flag.StringVar(&nginxResolver, "nginx-resolver", controllers.DefaultNginxResolver, "DNS server the ingress-nginx pods resolve the backends of the stream snippets with on every connection. If empty the backends are resolved while nginx loads its configuration, which fails for a deleted backend.")
+	flag.StringVar(&clusterDomain, "cluster-domain", controllers.DefaultClusterDomain, "Domain the in-cluster addresses of the backend services in the stream snippets and of the frontend services in the connection details are qualified with.")
+	flag.StringVar(&provider, "provider", string(controllers.ProviderIngressNginx), "Proxy serving the frontend ports. One of 'ingress-nginx' (tcp services configmap), 'envoy' (envoy fleet configured by the embedded xDS server) or 'tcpmap-proxy' (the tcpmap-proxy binary serving the ports itself).")
+	flag.StringVar(&xdsAddr, "xds-addr", ":18000", "The address the xDS server binds to if the provider is envoy.")
 	flag.StringVar(&metricsAddr, "metrics-addr", ":9556",
 		"The address the metric endpoint binds to.")
 	flag.StringVar(&healthAddr, "health-addr", ":9557",
@@ -94,11 +138,36 @@ func main() {
 	flag.Parse()
 	logger.SetLogger(logger.NewLogger(logOptions))
 
+	switch controllers.BackendGating(backendGating) {
+	case controllers.BackendGatingNone, controllers.BackendGatingReady, controllers.BackendGatingPublish:
+	default:
+		setupLog.Error(fmt.Errorf("invalid value %q", backendGating), "unable to configure backend gating")
+		os.Exit(1)
+	}
+
+	switch controllers.Provider(provider) {
+	case controllers.ProviderIngressNginx, controllers.ProviderEnvoy, controllers.ProviderProxy:
+	default:
+		setupLog.Error(fmt.Errorf("invalid value %q", provider), "unable to configure provider")
+		os.Exit(1)
+	}
+
+	switch tcpservices.ElectionStrategy(electionStrategy) {
+	case tcpservices.ElectionLowest, tcpservices.ElectionRandom, tcpservices.ElectionHashedStable:
+	default:
+		setupLog.Error(fmt.Errorf("invalid value %q", electionStrategy), "unable to configure election strategy")
+		os.Exit(1)
+	}
+
 	leaderElectionId := fmt.Sprintf("%s-%s", controllerName, "leader-election")
 	if watchOptions.LabelSelector != "" {
 		leaderElectionId = leaderelection.GenerateID(leaderElectionId, watchOptions.LabelSelector)
 	}
 
+	if shard != "" {
+		leaderElectionId = leaderelection.GenerateID(leaderElectionId, fmt.Sprintf("%s=%s", controllers.ShardLabel, shard))
+	}
+
 	watchNamespace := ""
 	if !watchOptions.AllNamespaces {
 		watchNamespace = os.Getenv("RUNTIME_NAMESPACE")
@@ -151,23 +220,84 @@ func main() {
 	}
 
 	setReconciler := &controllers.TCPIngressMappingReconciler{
-		Log:             ctrl.Log.WithName("controllers").WithName("TCPIngressMapping"),
+		Log:                    ctrl.Log.WithName("controllers").WithName("TCPIngressMapping"),
+		Scheme:                 mgr.GetScheme(),
+		Recorder:               mgr.GetEventRecorderFor("TCPIngressMapping"),
+		TCPConfigMap:           tcpConfigMap,
+		FrontendService:        frontendService,
+		BackendGating:          controllers.BackendGating(backendGating),
+		ElectionStrategy:       tcpservices.ElectionStrategy(electionStrategy),
+		DryRun:                 dryRun,
+		HoldDown:               holdDown,
+		ReissueReleasedPorts:   reissueReleasedPorts,
+		Shard:                  shard,
+		KubeConfigOpts:         kubeConfigOpts,
+		RemoteSyncInterval:     remoteSyncInterval,
+		ExpiryWarning:          expiryWarning,
+		StreamSnippetConfigMap: streamSnippetConfigMap,
+		IngressNginxConfigMap:  ingressNginxConfigMap,
+		TLSSecret:              tlsSecret,
+		TLSDir:                 tlsDir,
+		StreamStatusPort:       streamStatusPort,
+		NginxResolver:          nginxResolver,
+		ClusterDomain:          clusterDomain,
+		Provider:               controllers.Provider(provider),
+		MinPort:                minPort,
+		MaxPort:                maxPort,
+		Client:                 mgr.GetClient(),
+	}
+
+	// Probing a port which is never published in dry-run mode is pointless
+	if probe && !dryRun {
+		setReconciler.Prober = &controllers.Prober{
+			Timeout:  probeTimeout,
+			Interval: probeInterval,
+			Banner:   probeBanner,
+		}
+	}
+
+	if err = setReconciler.SetupWithManager(mgr, controllers.TCPIngressMappingReconcilerOptions{
+		MaxConcurrentReconciles: concurrent,
+	}); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "TCPIngressMapping")
+		os.Exit(1)
+	}
+
+	serviceReconciler := &controllers.ServiceReconciler{
+		Log:             ctrl.Log.WithName("controllers").WithName("Service"),
 		Scheme:          mgr.GetScheme(),
-		Recorder:        mgr.GetEventRecorderFor("TCPIngressMapping"),
-		TCPConfigMap:    tcpConfigMap,
+		Recorder:        mgr.GetEventRecorderFor("Service"),
 		FrontendService: frontendService,
-		MinPort:         minPort,
-		MaxPort:         maxPort,
+		Shard:           shard,
 		Client:          mgr.GetClient(),
 	}
 
-	if err = setReconciler.SetupWithManager(mgr, controllers.TCPIngressMappingReconcilerOptions{
+	if dryRun {
+		serviceReconciler.Client = ctrlclient.NewDryRunClient(mgr.GetClient())
+	}
+
+	if err = serviceReconciler.SetupWithManager(mgr, controllers.ServiceReconcilerOptions{
 		MaxConcurrentReconciles: concurrent,
 	}); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "TCPIngressMapping")
+		setupLog.Error(err, "unable to create controller", "controller", "Service")
 		os.Exit(1)
 	}
 
+	if controllers.Provider(provider) == controllers.ProviderEnvoy {
+		xdsReconciler := &controllers.XDSReconciler{
+			Log:             ctrl.Log.WithName("controllers").WithName("XDS"),
+			FrontendService: frontendService,
+			Shard:           shard,
+			Server:          xds.New(xdsAddr, ctrl.Log.WithName("xds")),
+			Client:          mgr.GetClient(),
+		}
+
+		if err = xdsReconciler.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "XDS")
+			os.Exit(1)
+		}
+	}
+
 	// +kubebuilder:scaffold:builder
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {